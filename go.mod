@@ -4,5 +4,5 @@ go 1.13
 
 require (
 	github.com/edsrzf/mmap-go v1.0.0
-	golang.org/x/sys v0.0.0-20200427175716-29b57079015a // indirect
+	golang.org/x/sys v0.0.0-20200427175716-29b57079015a
 )
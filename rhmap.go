@@ -50,6 +50,19 @@ type RHMap struct {
 
 	// Overridable func to grow the RHMap.
 	Grow func(m *RHMap, newSize int)
+
+	// Old, when non-nil, is the RHMap from before an incremental
+	// grow, whose items are migrated into Items a few at a time by
+	// each Set/Del, and which lookups also consult until the migration
+	// is done. See GrowIncremental().
+	Old *RHMap
+
+	// MigrateIdx is the next slot of the Old items to be migrated.
+	MigrateIdx int
+
+	// MigrateStep is the max number of Old item slots that are
+	// migrated by each Set/Del. Defaults to 8.
+	MigrateStep int
 }
 
 // Item represents an entry in the RHMap.
@@ -76,6 +89,7 @@ func New(size int) *RHMap {
 		MaxDistance: 10,
 		Growth:      func(m *RHMap) float64 { return 2.0 },
 		Grow:        Grow,
+		MigrateStep: 8,
 	}
 }
 
@@ -86,14 +100,33 @@ func (m *RHMap) Reset() {
 	}
 
 	m.Count = 0
+
+	m.Old = nil
+	m.MigrateIdx = 0
 }
 
-// Get retrieves the val for a given key.
+// Get retrieves the val for a given key. Get does not migrate items,
+// so lookups are safe during a Visit().
 func (m *RHMap) Get(k Key) (v Val, found bool) {
 	if k == nil {
 		return Val(nil), false
 	}
 
+	idx := m.findIdx(k)
+	if idx >= 0 {
+		return m.Items[idx].Val, true
+	}
+
+	if m.Old != nil {
+		return m.Old.Get(k)
+	}
+
+	return Val(nil), false
+}
+
+// findIdx returns the slot index of a key in the Items, or -1 when
+// the key is not found.
+func (m *RHMap) findIdx(k Key) int {
 	num := len(m.Items)
 	idx := int(m.HashFunc(k) % uint32(num))
 	idxStart := idx
@@ -101,11 +134,11 @@ func (m *RHMap) Get(k Key) (v Val, found bool) {
 	for {
 		e := &m.Items[idx]
 		if e.Key == nil {
-			return Val(nil), false
+			return -1
 		}
 
 		if bytes.Equal(e.Key, k) {
-			return e.Val, true
+			return idx
 		}
 
 		idx++
@@ -114,7 +147,7 @@ func (m *RHMap) Get(k Key) (v Val, found bool) {
 		}
 
 		if idx == idxStart { // Went all the way around.
-			return Val(nil), false
+			return -1
 		}
 	}
 }
@@ -133,6 +166,27 @@ func (m *RHMap) Set(k Key, v Val) (wasNew bool, err error) {
 		return false, ErrNilKey
 	}
 
+	if m.Old != nil {
+		m.Migrate(m.MigrateStep)
+
+		// An update of an item that's still in the Old items moves
+		// the item over to the Items.
+		if m.Old != nil {
+			if idx := m.Old.findIdx(k); idx >= 0 {
+				m.Old.delIdx(idx)
+				m.Count--
+
+				m.set(k, v)
+
+				return false, nil
+			}
+		}
+	}
+
+	return m.set(k, v)
+}
+
+func (m *RHMap) set(k Key, v Val) (wasNew bool, err error) {
 	num := len(m.Items)
 	idx := int(m.HashFunc(k) % uint32(num))
 	idxStart := idx
@@ -183,30 +237,32 @@ func (m *RHMap) Del(k Key) (prev Val, existed bool) {
 		return Val(nil), false
 	}
 
-	num := len(m.Items)
-	idx := int(m.HashFunc(k) % uint32(num))
-	idxStart := idx
+	if m.Old != nil {
+		m.Migrate(m.MigrateStep)
+	}
 
-	for {
-		e := &m.Items[idx]
-		if e.Key == nil {
-			return Val(nil), false
+	idx := m.findIdx(k)
+	if idx < 0 {
+		if m.Old != nil {
+			prev, existed = m.Old.Del(k)
+			if existed {
+				m.Count--
+			}
 		}
 
-		if bytes.Equal(e.Key, k) {
-			prev = e.Val
-			break // Found the item.
-		}
+		return prev, existed
+	}
 
-		idx++
-		if idx >= num {
-			idx = 0
-		}
+	prev = m.Items[idx].Val
 
-		if idx == idxStart {
-			return Val(nil), false
-		}
-	}
+	m.delIdx(idx)
+
+	return prev, true
+}
+
+// delIdx removes the item at a slot index of the Items.
+func (m *RHMap) delIdx(idx int) {
+	num := len(m.Items)
 
 	// Left-shift succeeding items in the linear chain.
 	for {
@@ -233,8 +289,6 @@ func (m *RHMap) Del(k Key) (prev Val, existed bool) {
 
 	m.Items[idx] = Item{}
 	m.Count--
-
-	return prev, true
 }
 
 // CopyTo copies key/val's to the dest RHMap.
@@ -245,14 +299,24 @@ func (m *RHMap) CopyTo(dest *RHMap) {
 // Visit invokes the callback on key/val. The callback can return
 // false to exit the visitation early.
 func (m *RHMap) Visit(callback func(k Key, v Val) (keepGoing bool)) {
+	m.visit(callback)
+}
+
+func (m *RHMap) visit(callback func(k Key, v Val) (keepGoing bool)) bool {
 	for i := range m.Items {
 		e := &m.Items[i]
 		if e.Key != nil {
 			if !callback(e.Key, e.Val) {
-				return
+				return false
 			}
 		}
 	}
+
+	if m.Old != nil {
+		return m.Old.visit(callback)
+	}
+
+	return true
 }
 
 // Grow is the default implementation to grow a RHMap.
@@ -263,7 +327,53 @@ func Grow(m *RHMap, newSize int) {
 	grow.Growth = m.Growth
 	grow.Grow = m.Grow
 
+	grow.MigrateStep = m.MigrateStep
+
 	m.CopyTo(grow)
 
 	*m = *grow
 }
+
+// GrowIncremental is an alternative implementation to grow a RHMap,
+// which avoids a long pause by keeping the existing items as the Old
+// items, to be migrated a few at a time by later Set/Del's. If a
+// migration is still in progress, the RHMap is grown by Grow().
+func GrowIncremental(m *RHMap, newSize int) {
+	if m.Old != nil {
+		Grow(m, newSize)
+		return
+	}
+
+	old := *m
+
+	m.Items = make([]Item, newSize)
+	m.Old = &old
+	m.MigrateIdx = 0
+}
+
+// Migrate moves the items of up to n Old item slots into the Items,
+// and returns true when the migration is done.
+func (m *RHMap) Migrate(n int) (done bool) {
+	for ; n > 0 && m.Old != nil; n-- {
+		if m.MigrateIdx >= len(m.Old.Items) || m.Old.Count <= 0 {
+			m.Old = nil
+			m.MigrateIdx = 0
+			break
+		}
+
+		e := m.Old.Items[m.MigrateIdx]
+		if e.Key == nil {
+			m.MigrateIdx++
+			continue
+		}
+
+		// The del left-shifts the succeeding items, so the slot at
+		// the MigrateIdx is revisited until it's empty.
+		m.Old.delIdx(m.MigrateIdx)
+		m.Count--
+
+		m.set(e.Key, e.Val)
+	}
+
+	return m.Old == nil
+}
@@ -13,6 +13,7 @@ package rhmap
 
 import (
 	"bytes"
+	"fmt"
 	"reflect"
 	"testing"
 )
@@ -315,3 +316,84 @@ func test(t *testing.T, r *RHMap,
 		andThen(g, get, set, del)
 	}
 }
+
+func TestGrowIncremental(t *testing.T) {
+	r := New(2)
+	r.Grow = GrowIncremental
+	r.MigrateStep = 1
+
+	sawOld := false
+
+	test(t, r, true, func(g map[string][]byte,
+		get func(k string),
+		set func(k, v string),
+		del func(k string)) {
+		for i := 0; i < 1000; i++ {
+			k := string([]byte{'k', byte(i % 251), byte(i % 7)})
+
+			switch i % 5 {
+			case 0, 1, 2:
+				set(k, k+"-v")
+			case 3:
+				del(k)
+			default:
+				get(k)
+			}
+
+			if r.Old != nil {
+				sawOld = true
+			}
+		}
+
+		for k := range g {
+			get(k)
+		}
+	})
+
+	if !sawOld {
+		t.Fatalf("expected an incremental migration")
+	}
+
+	for !r.Migrate(1) {
+	}
+
+	if r.Old != nil {
+		t.Fatalf("expected migration done")
+	}
+}
+
+func TestGrowIncrementalGetDuringVisit(t *testing.T) {
+	r := New(8)
+	r.Grow = GrowIncremental
+	r.MigrateStep = 1
+
+	n := 0
+	for ; n < 1000 && (n < 200 || r.Old == nil); n++ {
+		r.Set([]byte(fmt.Sprintf("k%d", n)), []byte("v"))
+	}
+
+	if r.Old == nil {
+		t.Fatalf("expected an incremental migration")
+	}
+
+	// Lookups do not migrate items, so a visit sees each item once.
+	seen := map[string]bool{}
+
+	r.Visit(func(k Key, v Val) bool {
+		if seen[string(k)] {
+			t.Fatalf("visited twice, k: %s", k)
+		}
+		seen[string(k)] = true
+
+		if _, found := r.Get(k); !found {
+			t.Fatalf("expected get during visit, k: %s", k)
+		}
+
+		return true
+	})
+
+	if len(seen) != n || r.Old == nil {
+		t.Fatalf("expected %d visited and no migration, got: %d, %t",
+			n, len(seen), r.Old == nil)
+	}
+}
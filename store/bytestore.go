@@ -0,0 +1,319 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"errors"
+	"os"
+)
+
+// ByteStore is the storage backend for the key/val bytes of an
+// RHStore or RHStoreFile, and for the slots and data of a Heap. Chunks
+// is the default, mmap()-based implementation.
+type ByteStore interface {
+	// BytesTruncate discards the bytes at and beyond size.
+	BytesTruncate(size uint64) error
+
+	// BytesAppend appends b and returns where it was placed.
+	BytesAppend(b []byte) (offset, size uint64, err error)
+
+	// BytesRead returns previously appended bytes. Depending on the
+	// implementation, the returned slice might be a copy, so changes
+	// must be made via BytesWrite() rather than to the slice.
+	BytesRead(offset, size uint64) ([]byte, error)
+
+	// BytesWrite overwrites previously appended bytes in-place.
+	BytesWrite(offset uint64, b []byte) error
+
+	// Close releases the resources of the ByteStore.
+	Close() error
+}
+
+// UseByteStore hooks the RHStore's backing bytes callbacks to the
+// ByteStore, including the BytesAlloc and BytesFree callbacks when the
+// ByteStore is also an Allocator. The ByteStore is not closed by the
+// RHStore.
+func (m *RHStore) UseByteStore(bs ByteStore) {
+	m.BytesAlloc, m.BytesFree = nil, nil
+
+	if a, ok := bs.(Allocator); ok {
+		m.BytesAlloc = func(m *RHStore, b []byte) (
+			offset, size uint64, err error) {
+			if len(b) <= 0 {
+				return 0, 0, nil
+			}
+
+			offset, err = a.Alloc(uint64(len(b)))
+			if err != nil {
+				return 0, 0, err
+			}
+
+			return offset, uint64(len(b)), bs.BytesWrite(offset, b)
+		}
+
+		m.BytesFree = func(m *RHStore, offset, size uint64) error {
+			return a.Free(offset, size)
+		}
+	}
+
+	m.BytesTruncate = func(m *RHStore, size uint64) error {
+		return bs.BytesTruncate(size)
+	}
+
+	m.BytesAppend = func(m *RHStore, b []byte) (
+		offset, size uint64, err error) {
+		return bs.BytesAppend(b)
+	}
+
+	m.BytesRead = func(m *RHStore, offset, size uint64) ([]byte, error) {
+		return bs.BytesRead(offset, size)
+	}
+
+	m.BytesWrite = func(m *RHStore, offset uint64, b []byte) error {
+		return bs.BytesWrite(offset, b)
+	}
+}
+
+// ---------------------------------------------
+
+// ErrOutOfRange means a ByteStore access was beyond its bytes.
+var ErrOutOfRange = errors.New("out of range")
+
+// MemoryByteStore is a ByteStore that's a plain []byte in memory.
+type MemoryByteStore struct {
+	Bytes []byte
+}
+
+func (s *MemoryByteStore) BytesTruncate(size uint64) error {
+	if size > uint64(len(s.Bytes)) {
+		return ErrOutOfRange
+	}
+
+	s.Bytes = s.Bytes[:size]
+
+	return nil
+}
+
+func (s *MemoryByteStore) BytesAppend(b []byte) (
+	offset, size uint64, err error) {
+	offset = uint64(len(s.Bytes))
+
+	s.Bytes = append(s.Bytes, b...)
+
+	return offset, uint64(len(b)), nil
+}
+
+func (s *MemoryByteStore) BytesRead(offset, size uint64) ([]byte, error) {
+	if offset+size > uint64(len(s.Bytes)) {
+		return nil, ErrOutOfRange
+	}
+
+	return s.Bytes[offset : offset+size], nil
+}
+
+func (s *MemoryByteStore) BytesWrite(offset uint64, b []byte) error {
+	if offset+uint64(len(b)) > uint64(len(s.Bytes)) {
+		return ErrOutOfRange
+	}
+
+	copy(s.Bytes[offset:], b)
+
+	return nil
+}
+
+func (s *MemoryByteStore) Close() error {
+	s.Bytes = nil
+
+	return nil
+}
+
+// ---------------------------------------------
+
+// FileByteStore is a ByteStore that uses pread()/pwrite() style
+// access to a file, without mmap(), so every BytesRead() returns a
+// newly allocated copy. The file is removed on Close().
+type FileByteStore struct {
+	Path string
+
+	File *os.File
+
+	// Size is the logical length of the bytes in the file.
+	Size uint64
+}
+
+// CreateFileByteStore creates a new, empty file for a FileByteStore.
+func CreateFileByteStore(path string) (*FileByteStore, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileByteStore{Path: path, File: file}, nil
+}
+
+func (s *FileByteStore) BytesTruncate(size uint64) error {
+	if size > s.Size {
+		return ErrOutOfRange
+	}
+
+	err := s.File.Truncate(int64(size))
+	if err != nil {
+		return err
+	}
+
+	s.Size = size
+
+	return nil
+}
+
+func (s *FileByteStore) BytesAppend(b []byte) (
+	offset, size uint64, err error) {
+	_, err = s.File.WriteAt(b, int64(s.Size))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	offset = s.Size
+
+	s.Size += uint64(len(b))
+
+	return offset, uint64(len(b)), nil
+}
+
+func (s *FileByteStore) BytesRead(offset, size uint64) ([]byte, error) {
+	if offset+size > s.Size {
+		return nil, ErrOutOfRange
+	}
+
+	rv := make([]byte, size)
+
+	_, err := s.File.ReadAt(rv, int64(offset))
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+func (s *FileByteStore) BytesWrite(offset uint64, b []byte) error {
+	if offset+uint64(len(b)) > s.Size {
+		return ErrOutOfRange
+	}
+
+	_, err := s.File.WriteAt(b, int64(offset))
+
+	return err
+}
+
+// Flush fsync()'s the file for FlushSync, and is a no-op for
+// FlushAsync, as writes are already handed to the operating system.
+func (s *FileByteStore) Flush(mode FlushMode) error {
+	if mode == FlushAsync {
+		return nil
+	}
+
+	return s.File.Sync()
+}
+
+func (s *FileByteStore) Close() error {
+	if s.File == nil {
+		return nil
+	}
+
+	err := s.File.Close()
+	s.File = nil
+
+	os.Remove(s.Path)
+
+	return err
+}
+
+// ---------------------------------------------
+
+// FaultByteStore is a ByteStore for tests, which wraps another
+// ByteStore and can inject errors into any of its operations.
+type FaultByteStore struct {
+	// ByteStore is the wrapped ByteStore, and defaults to a
+	// MemoryByteStore when nil.
+	ByteStore ByteStore
+
+	// Fault, when non-nil, is invoked before every operation, where a
+	// returned error fails the operation. The op is the name of the
+	// ByteStore method, such as "BytesAppend".
+	Fault func(op string, offset, size uint64) error
+}
+
+func (s *FaultByteStore) byteStore() ByteStore {
+	if s.ByteStore == nil {
+		s.ByteStore = &MemoryByteStore{}
+	}
+
+	return s.ByteStore
+}
+
+func (s *FaultByteStore) fault(op string, offset, size uint64) error {
+	if s.Fault == nil {
+		return nil
+	}
+
+	return s.Fault(op, offset, size)
+}
+
+func (s *FaultByteStore) BytesTruncate(size uint64) error {
+	if err := s.fault("BytesTruncate", 0, size); err != nil {
+		return err
+	}
+
+	return s.byteStore().BytesTruncate(size)
+}
+
+func (s *FaultByteStore) BytesAppend(b []byte) (
+	offset, size uint64, err error) {
+	if err = s.fault("BytesAppend", 0, uint64(len(b))); err != nil {
+		return 0, 0, err
+	}
+
+	return s.byteStore().BytesAppend(b)
+}
+
+func (s *FaultByteStore) BytesRead(offset, size uint64) ([]byte, error) {
+	if err := s.fault("BytesRead", offset, size); err != nil {
+		return nil, err
+	}
+
+	return s.byteStore().BytesRead(offset, size)
+}
+
+func (s *FaultByteStore) BytesWrite(offset uint64, b []byte) error {
+	if err := s.fault("BytesWrite", offset, uint64(len(b))); err != nil {
+		return err
+	}
+
+	return s.byteStore().BytesWrite(offset, b)
+}
+
+// Flush also flushes the wrapped ByteStore, when it's a Flusher.
+func (s *FaultByteStore) Flush(mode FlushMode) error {
+	if err := s.fault("Flush", 0, 0); err != nil {
+		return err
+	}
+
+	if f, ok := s.byteStore().(Flusher); ok {
+		return f.Flush(mode)
+	}
+
+	return nil
+}
+
+func (s *FaultByteStore) Close() error {
+	return s.byteStore().Close()
+}
@@ -0,0 +1,264 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testByteStores(t *testing.T, dir string) map[string]ByteStore {
+	fbs, err := CreateFileByteStore(dir + "/fbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]ByteStore{
+		"chunks": &Chunks{
+			PathPrefix:     dir + "/chunks",
+			ChunkSizeBytes: 16,
+		},
+		"memory": &MemoryByteStore{},
+		"file":   fbs,
+		"fault":  &FaultByteStore{},
+	}
+}
+
+func TestByteStores(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testByteStore")
+	defer os.RemoveAll(dir)
+
+	for name, bs := range testByteStores(t, dir) {
+		offset, size, err := bs.BytesAppend([]byte("hello"))
+		if err != nil || offset != 0 || size != 5 {
+			t.Fatalf("%s: append, offset: %d, size: %d, err: %v",
+				name, offset, size, err)
+		}
+
+		offset, size, err = bs.BytesAppend([]byte("world"))
+		if err != nil || offset != 5 || size != 5 {
+			t.Fatalf("%s: append, offset: %d, size: %d, err: %v",
+				name, offset, size, err)
+		}
+
+		err = bs.BytesWrite(5, []byte("WO"))
+		if err != nil {
+			t.Fatalf("%s: write, err: %v", name, err)
+		}
+
+		b, err := bs.BytesRead(3, 5)
+		if err != nil || string(b) != "loWOr" {
+			t.Fatalf("%s: read, b: %s, err: %v", name, b, err)
+		}
+
+		if _, err = bs.BytesRead(8, 5); err == nil {
+			t.Fatalf("%s: expected err on read beyond the end", name)
+		}
+
+		err = bs.BytesTruncate(3)
+		if err != nil {
+			t.Fatalf("%s: truncate, err: %v", name, err)
+		}
+
+		offset, _, err = bs.BytesAppend([]byte("p"))
+		if err != nil || offset != 3 {
+			t.Fatalf("%s: append after truncate, offset: %d, err: %v",
+				name, offset, err)
+		}
+
+		b, err = bs.BytesRead(0, 4)
+		if err != nil || string(b) != "help" {
+			t.Fatalf("%s: read after truncate, b: %s, err: %v", name, b, err)
+		}
+
+		if err = bs.Close(); err != nil {
+			t.Fatalf("%s: close, err: %v", name, err)
+		}
+	}
+
+	if _, err := os.Stat(dir + "/fbs"); !os.IsNotExist(err) {
+		t.Fatalf("expected file byte store to be removed, err: %v", err)
+	}
+}
+
+func TestRHStoreUseByteStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testByteStore")
+	defer os.RemoveAll(dir)
+
+	for name, bs := range testByteStores(t, dir) {
+		m := NewRHStore(10)
+		m.UseByteStore(bs)
+
+		for i := 0; i < 200; i++ {
+			_, err := m.Set([]byte(fmt.Sprintf("k%d", i)),
+				[]byte(fmt.Sprintf("v%d", i)))
+			if err != nil {
+				t.Fatalf("%s: set, i: %d, err: %v", name, i, err)
+			}
+		}
+
+		for i := 0; i < 200; i++ {
+			v, found := m.Get([]byte(fmt.Sprintf("k%d", i)))
+			if !found || string(v) != fmt.Sprintf("v%d", i) {
+				t.Fatalf("%s: get, i: %d, v: %s", name, i, v)
+			}
+		}
+
+		if err := m.Validate(); err != nil {
+			t.Fatalf("%s: validate, err: %v", name, err)
+		}
+
+		bs.Close()
+	}
+}
+
+func TestRHStoreFileNewByteStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testByteStore")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 256
+	options.NewByteStore = func(pathPrefix string) (ByteStore, error) {
+		return CreateFileByteStore(pathPrefix + "_bytes")
+	}
+
+	sf, err := CreateRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		_, err = sf.Set([]byte(fmt.Sprintf("k%d", i)),
+			[]byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatalf("set, i: %d, err: %v", i, err)
+		}
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		sf.Del([]byte(fmt.Sprintf("k%d", i)))
+	}
+
+	for i := 0; i < 1000; i++ {
+		v, found := sf.Get([]byte(fmt.Sprintf("k%d", i)))
+		if found != (i%2 == 1) ||
+			(found && string(v) != fmt.Sprintf("v%d", i)) {
+			t.Fatalf("get, i: %d, v: %s, found: %t", i, v, found)
+		}
+	}
+
+	if len(sf.Chunks.Chunks) != 0 {
+		t.Fatalf("expected no chunks, got: %d", len(sf.Chunks.Chunks))
+	}
+
+	if _, err = os.Stat(dir + "/test_bytes"); err != nil {
+		t.Fatalf("expected byte store file, err: %v", err)
+	}
+
+	if err = sf.Freeze(); err == nil {
+		t.Fatalf("expected Freeze err with a ByteStore")
+	}
+
+	sf.Close()
+
+	if _, err = os.Stat(dir + "/test_bytes"); !os.IsNotExist(err) {
+		t.Fatalf("expected byte store file removed, err: %v", err)
+	}
+}
+
+func TestHeapByteStores(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testByteStore")
+	defer os.RemoveAll(dir)
+
+	hfbs, _ := CreateFileByteStore(dir + "/heap")
+	dfbs, _ := CreateFileByteStore(dir + "/data")
+
+	h := &Heap{
+		LessFunc: func(a, b []byte) bool { return bytes.Compare(a, b) < 0 },
+		Heap:     hfbs,
+		Data:     dfbs,
+	}
+
+	defer h.Close()
+
+	for i := 0; i < 100; i++ {
+		heap.Push(h, []byte(fmt.Sprintf("%03d", (i*37)%100)))
+	}
+
+	for i := 0; i < 100; i++ {
+		x := heap.Pop(h).([]byte)
+		if string(x) != fmt.Sprintf("%03d", i) {
+			t.Fatalf("i: %d, got: %s", i, x)
+		}
+	}
+
+	if h.Err != nil {
+		t.Fatalf("err: %v", h.Err)
+	}
+}
+
+func TestFaultByteStore(t *testing.T) {
+	errFault := errors.New("fault")
+
+	appends := 0
+
+	fbs := &FaultByteStore{
+		Fault: func(op string, offset, size uint64) error {
+			if op == "BytesAppend" {
+				appends++
+				if appends > 5 {
+					return errFault
+				}
+			}
+			return nil
+		},
+	}
+
+	m := NewRHStore(100)
+	m.UseByteStore(fbs)
+
+	var err error
+
+	n := 0
+
+	for ; n < 10; n++ {
+		_, err = m.Set([]byte(fmt.Sprintf("k%d", n)), []byte("v"))
+		if err != nil {
+			break
+		}
+	}
+
+	if err != errFault {
+		t.Fatalf("expected errFault, got: %v", err)
+	}
+
+	if n == 0 || m.Count != n {
+		t.Fatalf("expected %d items, got: %d", n, m.Count)
+	}
+
+	for i := 0; i < n; i++ {
+		if v, found := m.Get([]byte(fmt.Sprintf("k%d", i))); !found ||
+			string(v) != "v" {
+			t.Fatalf("i: %d, v: %s, found: %t", i, v, found)
+		}
+	}
+
+	if err = m.Validate(); err != nil {
+		t.Fatalf("validate, err: %v", err)
+	}
+}
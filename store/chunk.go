@@ -13,6 +13,7 @@ package store
 
 import (
 	"fmt"
+	"runtime/debug"
 )
 
 // Chunks tracks a sequence of persisted chunk files.
@@ -35,17 +36,110 @@ type Chunks struct {
 
 	// Recycled is a stack of chunks that are ready to reuse.
 	Recycled []*MMapRef
+
+	// UseMemory is an optional callback that decides whether a new
+	// chunk of the given size may be kept in memory instead of in a
+	// chunk file. See SpillToFiles().
+	UseMemory func(size int) (bool, error)
+
+	// Quota, when non-nil, limits the bytes of the chunk files, where
+	// AddChunk() returns ErrDiskQuotaExceeded when a new chunk file
+	// would exceed the quota.
+	Quota *DiskQuota
+
+	// QuotaOwner is the owner name that's used with the Quota, and
+	// defaults to the PathPrefix.
+	QuotaOwner string
+
+	// Compress, when true, compresses each chunk other than the 0'th
+	// chunk once BytesAppend() moves past it into a new chunk, which
+	// seals the chunk. Reads of sealed chunks are decompressed through
+	// a small cache, and a BytesWrite() into a sealed chunk unseals it.
+	Compress bool
+
+	// CacheChunks is the max number of decompressed sealed chunks
+	// that are cached for reads. Defaults to 4.
+	CacheChunks int
+
+	// Pool, when non-nil, lends the chunk files, which are returned to
+	// the Pool instead of being removed. A Pool can be shared by many
+	// Chunks, RHStoreFile's and Heap's.
+	Pool *ChunkPool
+
+	// CatchFaults, when true, uses debug.SetPanicOnFault() while
+	// copying bytes into and out of the chunks, so that a memory
+	// fault, such as a SIGBUS from a chunk file that was truncated or
+	// that could not be written, is returned as ErrMMapFault instead
+	// of crashing the process. This needs go 1.17 or later, where the
+	// runtime reports the address of a fault.
+	CatchFaults bool
+
+	// FileIO, when true, reads and writes the chunk files with file
+	// I/O instead of mmap()'ing them, keeping at most the
+	// FileIOCacheChunks most recently used chunk files in memory. The
+	// FileIO is also turned on when a chunk file cannot be mmap()'ed,
+	// such as due to a low vm.max_map_count.
+	FileIO bool
+
+	// FileIOCacheChunks is the max number of chunk files that are
+	// kept in memory in the FileIO mode. Defaults to 8.
+	FileIOCacheChunks int
+
+	// SingleFile, when true, holds the chunks in the windows of one
+	// MappedFile at the SingleFilePath(), instead of in a file per
+	// chunk, which uses fewer file descriptors and inodes. The sealed
+	// chunks of the Compress option remain in their own files. The
+	// file does not shrink, so the windows of removed chunks are
+	// reused, and the Quota holds the whole file until Close(). The
+	// SingleFile is ignored with a Pool or with FileIO.
+	SingleFile bool
+
+	// Advice is the access pattern hint that's applied to each chunk
+	// file, such as AdviseRandom for point lookups. Recycled chunk
+	// files are instead advised with AdviseDontNeed. See Advise().
+	Advice Advice
+
+	// sealed tracks the chunks that hold compressed bytes.
+	sealed map[*MMapRef]bool
+
+	compressor *compressor
+
+	// free tracks the freed space that's reusable by Alloc().
+	free *freeSpace
+
+	// zeros is used to append new, zeroed space. See zeroBytes().
+	zeros []byte
+
+	// loaded tracks the chunk files that are in memory in the FileIO
+	// mode, most recently used first. See loadChunk().
+	loaded []*MMapRef
+
+	// file holds the chunks with the SingleFile option.
+	file *MappedFile
+
+	// freeWindows are the indexes of the windows of the file whose
+	// chunks were removed, which are reused by createWindow().
+	freeWindows []int
 }
 
 // ---------------------------------------------
 
+// BytesTruncate discards the data at and beyond size, which may be any
+// offset up to BytesLen(), so a previous BytesLen() can be used as a
+// savepoint that's later rolled back to. The chunks after the chunk
+// that holds the new end are recycled.
 func (cs *Chunks) BytesTruncate(size uint64) error {
-	prevChunkLens := cs.PrevChunkLens()
+	if size > cs.BytesLen() {
+		return fmt.Errorf("chunk: BytesTruncate size: %d"+
+			" greater than chunks: %d", size, cs.BytesLen())
+	}
 
-	if size > uint64(prevChunkLens+cs.ChunkSizeBytes) {
-		return nil
+	if cs.free != nil {
+		cs.free.truncate(size)
 	}
 
+	prevChunkLens := cs.PrevChunkLens()
+
 	if uint64(prevChunkLens) <= size {
 		// The truncate is within the last chunk.
 		cs.LastChunkLen = int(size) - prevChunkLens
@@ -59,18 +153,40 @@ func (cs *Chunks) BytesTruncate(size uint64) error {
 	}
 
 	if size != 0 {
-		return fmt.Errorf("chunk: BytesTruncate unsupported size")
-	}
+		// The truncate is within an earlier chunk, such as when
+		// truncating away data that spanned multiple chunks, so
+		// recycle the chunks after the chunk that holds the new end.
+		lastIdx := int((size - 1) / uint64(cs.ChunkSizeBytes))
 
-	if len(cs.Chunks) > 0 {
-		// The truncate is to 0, so recycle all file-based chunks.
-		for i := len(cs.Chunks) - 1; i >= 1; i-- {
-			cs.Recycled = append(cs.Recycled, cs.Chunks[i])
+		cs.recycleChunksAfter(lastIdx)
 
-			cs.Chunks[i] = nil
+		cs.LastChunkLen = int(size) - lastIdx*cs.ChunkSizeBytes
+
+		if cs.sealed[cs.Chunks[lastIdx]] {
+			// The chunk that holds the new end is appended to again.
+			err := cs.unseal(lastIdx)
+			if err != nil {
+				return err
+			}
 		}
 
-		cs.Chunks = cs.Chunks[:1] // Keep 0'th in-memory-only chunk.
+		if lastIdx == 0 {
+			// Special case the 0'th in-memory chunk, which might
+			// have been left shorter than ChunkSizeBytes.
+			buf := cs.Chunks[0].Buf
+			for len(buf) < cs.LastChunkLen {
+				buf = append(buf, 0)
+			}
+
+			cs.Chunks[0].Buf = buf[:cs.LastChunkLen]
+		}
+
+		return nil
+	}
+
+	if len(cs.Chunks) > 0 {
+		// The truncate is to 0, so recycle all file-based chunks.
+		cs.recycleChunksAfter(0)
 
 		// Special case the 0'th in-memory chunk.
 		cs.Chunks[0].Buf = cs.Chunks[0].Buf[:0]
@@ -81,19 +197,49 @@ func (cs *Chunks) BytesTruncate(size uint64) error {
 	return nil
 }
 
+// recycleChunksAfter moves the chunks after the given chunk index
+// onto the recycled stack.
+func (cs *Chunks) recycleChunksAfter(idx int) {
+	for i := len(cs.Chunks) - 1; i > idx; i-- {
+		if cs.sealed[cs.Chunks[i]] {
+			// A sealed chunk is too small to be reused.
+			cs.removeSealed(cs.Chunks[i])
+		} else {
+			// The recycled bytes will be overwritten before being
+			// read, so their pages are not needed.
+			cs.Chunks[i].Advise(AdviseDontNeed)
+
+			cs.recycleFile(cs.Chunks[i])
+
+			cs.Recycled = append(cs.Recycled, cs.Chunks[i])
+		}
+
+		cs.Chunks[i] = nil
+	}
+
+	cs.Chunks = cs.Chunks[:idx+1]
+}
+
 // ---------------------------------------------
 
+// BytesAppend appends data to the chunks. Data that's larger than
+// ChunkSizeBytes is appended contiguously across multiple chunks,
+// starting from the end of the last chunk.
 func (cs *Chunks) BytesAppend(b []byte) (
 	offsetOut, sizeOut uint64, err error) {
 	if len(b) > cs.ChunkSizeBytes {
-		return 0, 0, fmt.Errorf(
-			"chunk: BytesAppend len(b) > ChunkSizeBytes")
+		return cs.BytesAppendSpan(b)
 	}
 
 	if len(b) <= 0 {
 		return 0, 0, nil
 	}
 
+	if cs.CatchFaults {
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer recoverFault(&err)
+	}
+
 	if len(cs.Chunks) <= 0 || cs.LastChunkLen+len(b) > cs.ChunkSizeBytes {
 		err = cs.AddChunk()
 		if err != nil {
@@ -105,37 +251,201 @@ func (cs *Chunks) BytesAppend(b []byte) (
 
 	lastChunkLen := cs.LastChunkLen
 
-	cs.LastChunkLen = lastChunkLen + len(b)
+	lastChunkBuf, err := cs.loadChunk(len(cs.Chunks) - 1)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	// Special case in-memory only chunk which uses append().
-	if lastChunk.File == nil {
+	lastChunk.dirty = true
+
+	// Special case the 0'th in-memory chunk which uses append().
+	if len(cs.Chunks) == 1 {
 		lastChunk.Buf = append(lastChunk.Buf, b...)
 	} else {
-		copy(lastChunk.Buf[lastChunkLen:cs.LastChunkLen], b)
+		copy(lastChunkBuf[lastChunkLen:lastChunkLen+len(b)], b)
 	}
 
+	cs.LastChunkLen = lastChunkLen + len(b)
+
 	return uint64(cs.PrevChunkLens() + lastChunkLen), uint64(len(b)), nil
 }
 
+// BytesAppendSpan appends data contiguously, starting from the end
+// of the last chunk and adding as many chunks as needed.
+func (cs *Chunks) BytesAppendSpan(b []byte) (
+	offsetOut, sizeOut uint64, err error) {
+	if len(b) <= 0 {
+		return 0, 0, nil
+	}
+
+	if cs.CatchFaults {
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer recoverFault(&err)
+	}
+
+	if len(cs.Chunks) <= 0 {
+		err = cs.AddChunk()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	offsetOut = uint64(cs.PrevChunkLens() + cs.LastChunkLen)
+	sizeOut = uint64(len(b))
+
+	for len(b) > 0 {
+		if cs.LastChunkLen >= cs.ChunkSizeBytes {
+			err = cs.AddChunk()
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		lastChunk := cs.Chunks[len(cs.Chunks)-1]
+
+		n := cs.ChunkSizeBytes - cs.LastChunkLen
+		if n > len(b) {
+			n = len(b)
+		}
+
+		lastChunkBuf, err := cs.loadChunk(len(cs.Chunks) - 1)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// Special case the 0'th in-memory chunk which uses append().
+		if len(cs.Chunks) == 1 {
+			lastChunk.Buf = append(lastChunk.Buf, b[:n]...)
+		} else {
+			copy(lastChunkBuf[cs.LastChunkLen:cs.LastChunkLen+n], b[:n])
+		}
+
+		cs.LastChunkLen += n
+
+		lastChunk.dirty = true
+
+		b = b[n:]
+	}
+
+	return offsetOut, sizeOut, nil
+}
+
 // ---------------------------------------------
 
-// BytesRead returns a slice of data from the chunks.
+// BytesRead returns a slice of data from the chunks. When the data
+// spans multiple chunks, the returned slice is a copy.
 func (cs *Chunks) BytesRead(offset, size uint64) (
 	[]byte, error) {
-	if size > uint64(cs.ChunkSizeBytes) {
-		return nil, fmt.Errorf(
-			"chunk: BytesRead size > ChunkSizeBytes")
+	chunkIdx, chunkOffset, err := cs.locate(offset, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if chunkOffset+size <= uint64(cs.ChunkSizeBytes) {
+		chunkBuf, err := cs.chunkBuf(chunkIdx)
+		if err != nil {
+			return nil, err
+		}
+
+		return chunkBuf[chunkOffset : chunkOffset+size], nil
 	}
 
-	chunkIdx := int(offset / uint64(cs.ChunkSizeBytes))
+	rv := make([]byte, size)
+
+	err = cs.visitSpan(chunkIdx, chunkOffset, rv, func(chunkBuf, b []byte) {
+		copy(b, chunkBuf)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// ---------------------------------------------
+
+// BytesWrite overwrites previously appended data in-place.
+func (cs *Chunks) BytesWrite(offset uint64, b []byte) error {
+	chunkIdx, chunkOffset, err := cs.locate(offset, uint64(len(b)))
+	if err != nil {
+		return err
+	}
+
+	if len(b) > 0 {
+		lastIdx := int((offset + uint64(len(b)) - 1) / uint64(cs.ChunkSizeBytes))
+
+		for i := chunkIdx; i <= lastIdx; i++ {
+			if cs.sealed[cs.Chunks[i]] {
+				err = cs.unseal(i)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// A chunk is marked dirty only once it's loaded and modified, as in
+	// the FileIO mode, loading a chunk of a long span might write back
+	// and unload another chunk of the span, which clears its dirty.
+	i := chunkIdx
+
+	return cs.visitSpan(chunkIdx, chunkOffset, b, func(chunkBuf, b []byte) {
+		copy(chunkBuf, b)
+
+		cs.Chunks[i].dirty = true
+		i++
+	})
+}
+
+// ---------------------------------------------
+
+// locate returns the chunk index and the offset within that chunk for
+// a given offset, checking that the chunks hold the requested size.
+func (cs *Chunks) locate(offset, size uint64) (
+	chunkIdx int, chunkOffset uint64, err error) {
+	chunkIdx = int(offset / uint64(cs.ChunkSizeBytes))
 	if chunkIdx >= len(cs.Chunks) {
-		return nil, fmt.Errorf(
-			"chunk: BytesRead offset greater than chunks")
+		return 0, 0, fmt.Errorf(
+			"chunk: offset greater than chunks")
 	}
 
-	chunkOffset := offset % uint64(cs.ChunkSizeBytes)
+	if offset+size > cs.BytesLen() && size > 0 {
+		return 0, 0, fmt.Errorf(
+			"chunk: offset+size greater than chunks")
+	}
+
+	return chunkIdx, offset % uint64(cs.ChunkSizeBytes), nil
+}
+
+// visitSpan invokes the callback on the successive pieces of each
+// chunk that's covered by b, starting from the given chunk position.
+func (cs *Chunks) visitSpan(chunkIdx int, chunkOffset uint64, b []byte,
+	callback func(chunkBuf, b []byte)) (err error) {
+	if cs.CatchFaults {
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer recoverFault(&err)
+	}
+
+	for len(b) > 0 {
+		n := cs.ChunkSizeBytes - int(chunkOffset)
+		if n > len(b) {
+			n = len(b)
+		}
+
+		chunkBuf, err := cs.chunkBuf(chunkIdx)
+		if err != nil {
+			return err
+		}
+
+		callback(chunkBuf[int(chunkOffset):int(chunkOffset)+n], b[:n])
 
-	return cs.Chunks[chunkIdx].Buf[chunkOffset : chunkOffset+size], nil
+		b = b[n:]
+
+		chunkIdx++
+		chunkOffset = 0
+	}
+
+	return nil
 }
 
 // ---------------------------------------------
@@ -143,19 +453,39 @@ func (cs *Chunks) BytesRead(offset, size uint64) (
 // Close releases resources used by the chunk files.
 func (cs *Chunks) Close() error {
 	for _, chunk := range cs.Chunks {
-		chunk.Close()
-		chunk.Remove()
+		if cs.sealed[chunk] {
+			cs.removeSealed(chunk)
+		} else {
+			cs.removeFile(chunk)
+		}
 	}
 	cs.Chunks = nil
 
 	cs.LastChunkLen = 0
 
 	for _, chunk := range cs.Recycled {
-		chunk.Close()
-		chunk.Remove()
+		cs.removeFile(chunk)
 	}
 	cs.Recycled = nil
 
+	cs.free = nil
+
+	cs.loaded = nil
+
+	if cs.file != nil {
+		size := cs.file.Size()
+
+		cs.file.Close()
+		cs.file.Remove()
+		cs.file = nil
+
+		if cs.Quota != nil {
+			cs.Quota.Release(cs.quotaOwner(), size)
+		}
+	}
+
+	cs.freeWindows = nil
+
 	return nil
 }
 
@@ -171,12 +501,26 @@ func (cs *Chunks) AddChunk() (err error) {
 		var chunkSizeBytes int
 
 		if len(cs.Chunks) > 0 {
-			chunkPath = fmt.Sprintf("%s_chunk_%09d%s",
-				cs.PathPrefix, len(cs.Chunks), cs.FileSuffix)
 			chunkSizeBytes = cs.ChunkSizeBytes
+
+			useMemory := false
+			if cs.UseMemory != nil {
+				useMemory, err = cs.UseMemory(chunkSizeBytes)
+				if err != nil {
+					return err
+				}
+			}
+
+			if !useMemory {
+				chunkPath = cs.ChunkPath(len(cs.Chunks))
+			}
 		}
 
-		chunk, err = CreateFileAsMMapRef(chunkPath, chunkSizeBytes)
+		if chunkPath != "" {
+			chunk, err = cs.createChunkFile(len(cs.Chunks))
+		} else {
+			chunk, err = cs.createFile(chunkPath, chunkSizeBytes)
+		}
 		if err != nil {
 			return err
 		}
@@ -186,15 +530,64 @@ func (cs *Chunks) AddChunk() (err error) {
 		cs.Recycled = cs.Recycled[:len(cs.Recycled)-1]
 	}
 
+	if len(cs.Chunks) == 1 && len(cs.Chunks[0].Buf) < cs.ChunkSizeBytes {
+		// Pad the append()'ed, in-memory 0'th chunk to its full size,
+		// so that every chunk before the last chunk is addressable.
+		cs.Chunks[0].Buf = append(cs.Chunks[0].Buf,
+			make([]byte, cs.ChunkSizeBytes-len(cs.Chunks[0].Buf))...)
+	}
+
+	if cs.Advice != AdviseNormal {
+		chunk.Advise(cs.Advice)
+	}
+
+	err = cs.addFile(chunk)
+	if err != nil {
+		cs.removeFile(chunk)
+
+		return err
+	}
+
 	cs.Chunks = append(cs.Chunks, chunk)
 
 	cs.LastChunkLen = 0
 
+	if cs.Compress && len(cs.Chunks) > 2 {
+		// BytesAppend() has moved past the previous chunk.
+		return cs.seal(len(cs.Chunks) - 2)
+	}
+
+	return nil
+}
+
+// ---------------------------------------------
+
+// Advise sets the Advice of the chunks, and applies it to the
+// current chunk files.
+func (cs *Chunks) Advise(advice Advice) error {
+	cs.Advice = advice
+
+	for _, chunk := range cs.Chunks {
+		if cs.sealed[chunk] {
+			continue // Sealed chunks are only read via decompression.
+		}
+
+		err := chunk.Advise(advice)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // ---------------------------------------------
 
+// BytesLen returns the logical length of the data in the chunks.
+func (cs *Chunks) BytesLen() uint64 {
+	return uint64(cs.PrevChunkLens() + cs.LastChunkLen)
+}
+
 // PrevChunkLens returns the sum of the chunk lengths for all but the
 // last chunk.
 func (cs *Chunks) PrevChunkLens() int {
@@ -204,3 +597,327 @@ func (cs *Chunks) PrevChunkLens() int {
 
 	return 0
 }
+
+// createFile is like CreateFileAsMMapRef(), but also acquires the
+// bytes of a file from the Quota.
+func (cs *Chunks) createFile(path string, size int) (*MMapRef, error) {
+	return cs.createFileWith(path, size, false)
+}
+
+// createMappedFile is like createFile(), but always mmap()'s the file
+// as a single mapping, even in the FileIO mode, for a large, randomly
+// accessed file that must not be held in memory, such as the slots.
+func (cs *Chunks) createMappedFile(path string, size int) (*MMapRef, error) {
+	return cs.createFileWith(path, size, true)
+}
+
+func (cs *Chunks) createFileWith(path string, size int, mapped bool) (
+	*MMapRef, error) {
+	if path != "" && cs.Quota != nil {
+		err := cs.Quota.Acquire(cs.quotaOwner(), int64(size))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rv *MMapRef
+	var err error
+
+	if cs.FileIO && !mapped {
+		rv, err = CreateFileAsFileRef(path, size)
+	} else {
+		rv, err = CreateFileAsMMapRef(path, size)
+		if err != nil && path != "" && !mapped {
+			// The file might be creatable but not mmap()'able, such as
+			// due to a low vm.max_map_count, so fall back to FileIO.
+			rv, err = CreateFileAsFileRef(path, size)
+			if err == nil {
+				cs.FileIO = true
+			}
+		}
+	}
+
+	if err != nil && path != "" && cs.Quota != nil {
+		cs.Quota.Release(cs.quotaOwner(), int64(size))
+	}
+
+	return rv, err
+}
+
+// createChunkFile returns a new file for the i'th chunk, which is lent
+// by the Pool when there is one, or is a new window of the SingleFile,
+// acquiring its bytes from the Quota.
+func (cs *Chunks) createChunkFile(i int) (*MMapRef, error) {
+	if cs.FileIO || (cs.Pool == nil && !cs.SingleFile) {
+		return cs.createFile(cs.ChunkPath(i), cs.ChunkSizeBytes)
+	}
+
+	// A reused window does not grow the SingleFile, whose bytes are
+	// held from the Quota until the file is removed.
+	if cs.Pool == nil && len(cs.freeWindows) > 0 {
+		return cs.createWindow()
+	}
+
+	// An idle file of the Pool is taken before acquiring its bytes, as
+	// the Pool's own charge for the idle file is then released.
+	var idle *MMapRef
+	if cs.Pool != nil {
+		idle = cs.Pool.getIdle(cs.ChunkSizeBytes)
+	}
+
+	if cs.Quota != nil {
+		err := cs.Quota.Acquire(cs.quotaOwner(), int64(cs.ChunkSizeBytes))
+		if err != nil {
+			if idle != nil {
+				cs.Pool.Put(idle)
+			}
+
+			return nil, err
+		}
+	}
+
+	if idle != nil {
+		return idle, nil
+	}
+
+	var rv *MMapRef
+	var err error
+
+	if cs.Pool != nil {
+		rv, err = cs.Pool.Get(cs.ChunkSizeBytes)
+	} else {
+		rv, err = cs.createWindow()
+	}
+	if err != nil && cs.Quota != nil {
+		cs.Quota.Release(cs.quotaOwner(), int64(cs.ChunkSizeBytes))
+	}
+
+	return rv, err
+}
+
+// removeFile closes and removes a file that was created with
+// createFile(), or returns a file that was lent by a ChunkPool,
+// releasing its bytes back to the Quota. A window of the SingleFile is
+// instead closed and kept for reuse, as the file does not shrink.
+func (cs *Chunks) removeFile(r *MMapRef) {
+	path, size := r.Path, r.Len()
+
+	cs.uncacheFile(r)
+
+	if r.mappedFile != nil {
+		r.Close()
+
+		cs.freeWindows = append(cs.freeWindows, r.window)
+
+		return
+	}
+
+	// The bytes are released first, so that a Pool that shares the
+	// Quota may charge them to itself for an idle file.
+	if path != "" && cs.Quota != nil {
+		cs.Quota.Release(cs.quotaOwner(), int64(size))
+	}
+
+	if r.pool != nil {
+		r.pool.Put(r)
+	} else {
+		r.Close()
+		r.Remove()
+	}
+}
+
+func (cs *Chunks) quotaOwner() string {
+	if cs.QuotaOwner != "" {
+		return cs.QuotaOwner
+	}
+
+	return cs.PathPrefix
+}
+
+// createWindow returns a window of the SingleFile, which is created on
+// first use, by reusing a window whose chunk was removed, or else by
+// growing the file with a new window at its end.
+func (cs *Chunks) createWindow() (*MMapRef, error) {
+	if cs.file == nil {
+		f, err := CreateMappedFile(cs.SingleFilePath(), cs.ChunkSizeBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		cs.file = f
+	}
+
+	i := cs.file.NumWindows()
+	if n := len(cs.freeWindows); n > 0 {
+		i = cs.freeWindows[n-1]
+		cs.freeWindows = cs.freeWindows[:n-1]
+	}
+
+	r, err := cs.file.Window(i)
+	if err != nil {
+		if i < cs.file.NumWindows() {
+			cs.freeWindows = append(cs.freeWindows, i)
+		}
+
+		return nil, err
+	}
+
+	// The chunk holds the only ref, so the window is unmapped when the
+	// chunk is removed, while its file space is kept in freeWindows.
+	cs.file.Release(i)
+
+	return r, nil
+}
+
+// SingleFilePath returns the file path of the SingleFile.
+func (cs *Chunks) SingleFilePath() string {
+	return fmt.Sprintf("%s_chunks%s", cs.PathPrefix, cs.FileSuffix)
+}
+
+// ChunkPath returns the file path for the i'th chunk.
+func (cs *Chunks) ChunkPath(i int) string {
+	return fmt.Sprintf("%s_chunk_%09d%s", cs.PathPrefix, i, cs.FileSuffix)
+}
+
+// ---------------------------------------------
+
+// MemoryBytes returns the number of bytes held by in-memory chunks,
+// including any recycled in-memory chunks.
+func (cs *Chunks) MemoryBytes() (rv int) {
+	for _, chunk := range cs.Chunks {
+		if chunk.Path == "" {
+			rv += len(chunk.Buf)
+		}
+	}
+
+	for _, chunk := range cs.Recycled {
+		if chunk.Path == "" {
+			rv += len(chunk.Buf)
+		}
+	}
+
+	return rv
+}
+
+// SpillToFiles moves the data of any in-memory chunks, other than the
+// 0'th chunk, into chunk files, and releases any recycled in-memory
+// chunks.
+func (cs *Chunks) SpillToFiles() error {
+	for i := 1; i < len(cs.Chunks); i++ {
+		chunk := cs.Chunks[i]
+		if chunk.Path != "" {
+			continue
+		}
+
+		var fileChunk *MMapRef
+		var err error
+
+		if cs.sealed[chunk] {
+			fileChunk, err = cs.createFile(cs.SealedChunkPath(i), len(chunk.Buf))
+		} else {
+			fileChunk, err = cs.createChunkFile(i)
+		}
+		if err != nil {
+			return err
+		}
+
+		copy(fileChunk.Buf, chunk.Buf)
+
+		fileChunk.dirty = true
+
+		if cs.Advice != AdviseNormal && !cs.sealed[chunk] {
+			fileChunk.Advise(cs.Advice)
+		}
+
+		cs.replaceSealed(chunk, fileChunk)
+
+		chunk.Close()
+
+		cs.Chunks[i] = fileChunk
+
+		err = cs.addFile(fileChunk)
+		if err != nil {
+			return err
+		}
+	}
+
+	recycled := cs.Recycled[:0]
+
+	for i, chunk := range cs.Recycled {
+		if chunk.Path != "" {
+			recycled = append(recycled, chunk)
+		} else {
+			chunk.Close()
+		}
+
+		cs.Recycled[i] = nil
+	}
+
+	cs.Recycled = recycled
+
+	return nil
+}
+
+// Freeze moves all the chunks, including the 0'th chunk, into chunk
+// files and flushes them, so that the chunk files can be mmap()'ed by
+// other processes. The chunks must not be appended to afterwards. An
+// empty 0'th chunk remains in memory, as it has no bytes to share.
+func (cs *Chunks) Freeze() error {
+	if cs.Compress {
+		return fmt.Errorf("chunk: Freeze does not support Compress")
+	}
+
+	if cs.Pool != nil {
+		return fmt.Errorf("chunk: Freeze does not support a Pool")
+	}
+
+	if cs.SingleFile {
+		return fmt.Errorf("chunk: Freeze does not support SingleFile")
+	}
+
+	err := cs.SpillToFiles()
+	if err != nil {
+		return err
+	}
+
+	if len(cs.Chunks) > 0 && cs.Chunks[0].Path == "" &&
+		len(cs.Chunks[0].Buf) > 0 {
+		chunk := cs.Chunks[0]
+
+		fileChunk, err := cs.createFile(cs.ChunkPath(0), len(chunk.Buf))
+		if err != nil {
+			return err
+		}
+
+		copy(fileChunk.Buf, chunk.Buf)
+
+		fileChunk.dirty = true
+
+		chunk.Close()
+
+		cs.Chunks[0] = fileChunk
+	}
+
+	return cs.Flush(FlushSync)
+}
+
+// Flush writes the modified chunk files to disk. The in-memory
+// chunks, such as the 0'th chunk, are not flushed, so see
+// SpillToFiles() or Freeze() for moving them into files first.
+func (cs *Chunks) Flush(mode FlushMode) error {
+	for _, chunk := range cs.Chunks {
+		if chunk.dirty {
+			err := chunk.Flush(mode)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// The windows of the SingleFile do not fsync() the shared file.
+	if cs.file != nil && mode == FlushSync {
+		return cs.file.File.Sync()
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Allocator is implemented by a ByteStore that can reuse the space of
+// freed bytes, such as Chunks.
+type Allocator interface {
+	// Alloc returns the offset of size bytes, which are either from
+	// previously freed space or are newly appended. The contents of
+	// the bytes are undefined, and are expected to be overwritten via
+	// BytesWrite().
+	Alloc(size uint64) (offset uint64, err error)
+
+	// Free marks previously appended or allocated bytes as unused,
+	// so their space can be reused by a later Alloc().
+	Free(offset, size uint64) error
+}
+
+// Alloc returns the offset of size bytes, preferring the freed space
+// of the chunks, otherwise appending.
+func (cs *Chunks) Alloc(size uint64) (offset uint64, err error) {
+	if size == 0 {
+		return 0, nil
+	}
+
+	if cs.free != nil {
+		if offset, ok := cs.free.alloc(size); ok {
+			return offset, nil
+		}
+	}
+
+	offset, _, err = cs.BytesAppend(cs.zeroBytes(int(size)))
+
+	return offset, err
+}
+
+// zeroBytes returns a slice of n zero bytes, which must not be
+// modified.
+func (cs *Chunks) zeroBytes(n int) []byte {
+	if len(cs.zeros) < n {
+		cs.zeros = make([]byte, n)
+	}
+
+	return cs.zeros[:n]
+}
+
+// Free marks bytes of the chunks as unused, where freed bytes that
+// are adjacent are coalesced into a larger free extent.
+func (cs *Chunks) Free(offset, size uint64) error {
+	if size == 0 {
+		return nil
+	}
+
+	if offset+size > cs.BytesLen() {
+		return fmt.Errorf("chunk: Free offset+size greater than chunks")
+	}
+
+	if cs.free == nil {
+		cs.free = &freeSpace{
+			starts: map[uint64]uint64{},
+			ends:   map[uint64]uint64{},
+		}
+	}
+
+	return cs.free.add(offset, size)
+}
+
+// ---------------------------------------------
+
+// freeSpace tracks free extents of bytes in size-class bins, where
+// the i'th bin holds the extents whose sizes have a bit length of i+1,
+// so sizes in the range [2^i, 2^(i+1)).
+type freeSpace struct {
+	bins [64][]uint64 // The start offsets of the free extents.
+
+	starts map[uint64]uint64 // Keyed by start offset, valued by size.
+	ends   map[uint64]uint64 // Keyed by end offset, valued by start.
+
+	bytes uint64
+}
+
+func sizeClass(size uint64) int {
+	return bits.Len64(size) - 1
+}
+
+// add inserts a free extent, coalescing it with any adjacent extents.
+func (f *freeSpace) add(offset, size uint64) error {
+	if _, exists := f.starts[offset]; exists {
+		return fmt.Errorf("chunk: Free of already free offset: %d", offset)
+	}
+
+	if start, exists := f.ends[offset]; exists {
+		prevSize := f.starts[start]
+
+		f.remove(start, prevSize)
+
+		offset, size = start, prevSize+size
+	}
+
+	if nextSize, exists := f.starts[offset+size]; exists {
+		f.remove(offset+size, nextSize)
+
+		size += nextSize
+	}
+
+	f.insert(offset, size)
+
+	return nil
+}
+
+func (f *freeSpace) insert(offset, size uint64) {
+	c := sizeClass(size)
+
+	f.bins[c] = append(f.bins[c], offset)
+
+	f.starts[offset] = size
+	f.ends[offset+size] = offset
+
+	f.bytes += size
+}
+
+func (f *freeSpace) remove(offset, size uint64) {
+	bin := f.bins[sizeClass(size)]
+
+	for i, start := range bin {
+		if start == offset {
+			bin[i] = bin[len(bin)-1]
+			f.bins[sizeClass(size)] = bin[:len(bin)-1]
+			break
+		}
+	}
+
+	delete(f.starts, offset)
+	delete(f.ends, offset+size)
+
+	f.bytes -= size
+}
+
+// alloc takes size bytes from the first fitting free extent, starting
+// from the size class of the size, where any remainder of the extent
+// stays free.
+func (f *freeSpace) alloc(size uint64) (uint64, bool) {
+	for c := sizeClass(size); c < len(f.bins); c++ {
+		for _, start := range f.bins[c] {
+			extentSize := f.starts[start]
+			if extentSize < size {
+				continue // Only possible in the first size class.
+			}
+
+			f.remove(start, extentSize)
+
+			if extentSize > size {
+				f.insert(start+size, extentSize-size)
+			}
+
+			return start, true
+		}
+	}
+
+	return 0, false
+}
+
+// truncate discards the free space at and beyond size.
+func (f *freeSpace) truncate(size uint64) {
+	for start, extentSize := range f.starts {
+		if start+extentSize <= size {
+			continue
+		}
+
+		f.remove(start, extentSize)
+
+		if start < size {
+			f.insert(start, size-start)
+		}
+	}
+}
+
+// largest returns the size of the largest free extent.
+func (f *freeSpace) largest() (rv uint64) {
+	for c := len(f.bins) - 1; c >= 0; c-- {
+		for _, start := range f.bins[c] {
+			if f.starts[start] > rv {
+				rv = f.starts[start]
+			}
+		}
+
+		if rv > 0 {
+			return rv
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,259 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestChunksAllocFree(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksAlloc")
+	defer os.RemoveAll(dir)
+
+	cs := &Chunks{
+		PathPrefix:     dir + "/test",
+		ChunkSizeBytes: 1024,
+	}
+
+	defer cs.Close()
+
+	var offsets []uint64
+
+	for i := 0; i < 10; i++ {
+		offset, err := cs.Alloc(10)
+		if err != nil || offset != uint64(i*10) {
+			t.Fatalf("alloc, i: %d, offset: %d, err: %v", i, offset, err)
+		}
+
+		offsets = append(offsets, offset)
+	}
+
+	// Non-adjacent frees are separate extents.
+	for _, i := range []int{1, 3, 5} {
+		if err := cs.Free(offsets[i], 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := cs.Stats()
+	if stats.FreeBytes != 30 || stats.FreeExtents != 3 ||
+		stats.LargestFreeBytes != 10 || stats.Fragmentation() <= 0.5 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	if err := cs.Free(offsets[3], 10); err == nil {
+		t.Fatalf("expected err on double free")
+	}
+
+	// Adjacent frees are coalesced.
+	for _, i := range []int{2, 4} {
+		if err := cs.Free(offsets[i], 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats = cs.Stats()
+	if stats.FreeBytes != 50 || stats.FreeExtents != 1 ||
+		stats.LargestFreeBytes != 50 || stats.Fragmentation() != 0 {
+		t.Fatalf("expected coalesced, stats: %+v", stats)
+	}
+
+	// An alloc splits the free extent, leaving the remainder free.
+	offset, err := cs.Alloc(15)
+	if err != nil || offset != 10 {
+		t.Fatalf("alloc, offset: %d, err: %v", offset, err)
+	}
+
+	stats = cs.Stats()
+	if stats.FreeBytes != 35 || stats.FreeExtents != 1 {
+		t.Fatalf("expected split, stats: %+v", stats)
+	}
+
+	// An alloc larger than any free extent appends.
+	offset, err = cs.Alloc(40)
+	if err != nil || offset != 100 {
+		t.Fatalf("alloc append, offset: %d, err: %v", offset, err)
+	}
+
+	if err = cs.BytesWrite(offset, bytes.Repeat([]byte("x"), 40)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := cs.BytesRead(offset, 40)
+	if err != nil || !bytes.Equal(b, bytes.Repeat([]byte("x"), 40)) {
+		t.Fatalf("read, b: %q, err: %v", b, err)
+	}
+
+	if err = cs.Free(130, 20); err == nil {
+		t.Fatalf("expected err on free beyond the end")
+	}
+
+	// A truncate trims the free space.
+	if err = cs.BytesTruncate(40); err != nil {
+		t.Fatal(err)
+	}
+
+	stats = cs.Stats()
+	if stats.FreeBytes != 15 || stats.FreeExtents != 1 {
+		t.Fatalf("expected trimmed free space, stats: %+v", stats)
+	}
+
+	offset, err = cs.Alloc(15)
+	if err != nil || offset != 25 {
+		t.Fatalf("alloc after truncate, offset: %d, err: %v", offset, err)
+	}
+
+	if cs.Stats().FreeBytes != 0 {
+		t.Fatalf("expected no free space, stats: %+v", cs.Stats())
+	}
+}
+
+func TestRHStoreFileAllocReuse(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksAlloc")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 100
+	options.ChunkSizeBytes = 1024
+
+	sf, err := CreateRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	set := func(round int) {
+		for i := 0; i < 50; i++ {
+			_, err := sf.Set([]byte(fmt.Sprintf("key-%d", i)),
+				[]byte(fmt.Sprintf("val-%d-%03d", i, round)))
+			if err != nil {
+				t.Fatalf("round: %d, i: %d, err: %v", round, i, err)
+			}
+		}
+	}
+
+	set(0)
+
+	used := sf.Chunks.PrevChunkLens() + sf.Chunks.LastChunkLen
+
+	for round := 1; round < 20; round++ {
+		set(round)
+	}
+
+	// Without reuse, each round would append another 500+ bytes.
+	if sf.Chunks.PrevChunkLens()+sf.Chunks.LastChunkLen > used+200 {
+		t.Fatalf("expected overwrites to reuse space, used: %d, now: %d",
+			used, sf.Chunks.PrevChunkLens()+sf.Chunks.LastChunkLen)
+	}
+
+	for i := 0; i < 50; i += 2 {
+		sf.Del([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	if sf.Chunks.Stats().FreeBytes <= 0 {
+		t.Fatalf("expected deletes to free space, stats: %+v",
+			sf.Chunks.Stats())
+	}
+
+	for i := 0; i < 50; i++ {
+		v, found := sf.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if found != (i%2 == 1) ||
+			(found && string(v) != fmt.Sprintf("val-%d-%03d", i, 19)) {
+			t.Fatalf("i: %d, v: %s, found: %t", i, v, found)
+		}
+	}
+
+	if err = sf.Validate(); err != nil {
+		t.Fatalf("validate, err: %v", err)
+	}
+}
+
+func TestHeapChunksAllocReuse(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksAlloc")
+	defer os.RemoveAll(dir)
+
+	data := &Chunks{
+		PathPrefix:     dir + "/data",
+		ChunkSizeBytes: 256,
+	}
+
+	h := &Heap{
+		LessFunc: func(a, b []byte) bool { return bytes.Compare(a, b) < 0 },
+		Heap: &Chunks{
+			PathPrefix:     dir + "/heap",
+			ChunkSizeBytes: 256,
+		},
+		Data: data,
+	}
+
+	defer h.Close()
+
+	var used int
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 100; i++ {
+			heap.Push(h, []byte(fmt.Sprintf("%03d", (i*37)%100)))
+		}
+
+		if round == 0 {
+			if err := h.Sort(0); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := int64(0); i < 100; i++ {
+				x, err := h.Get(i)
+				if err != nil || string(x) != fmt.Sprintf("%03d", 99-i) {
+					t.Fatalf("sorted, i: %d, x: %s, err: %v", i, x, err)
+				}
+			}
+
+			if data.Stats().FreeBytes != 0 {
+				t.Fatalf("expected Sort to not free, stats: %+v",
+					data.Stats())
+			}
+
+			h.Reset()
+
+			continue
+		}
+
+		if round == 1 {
+			used = data.PrevChunkLens() + data.LastChunkLen
+		}
+
+		for i := 0; i < 100; i++ {
+			x := heap.Pop(h).([]byte)
+			if string(x) != fmt.Sprintf("%03d", i) {
+				t.Fatalf("round: %d, i: %d, got: %s", round, i, x)
+			}
+		}
+	}
+
+	if h.Err != nil {
+		t.Fatalf("err: %v", h.Err)
+	}
+
+	if len(h.Free) != 0 {
+		t.Fatalf("expected the chunks free space to be used")
+	}
+
+	if data.PrevChunkLens()+data.LastChunkLen != used {
+		t.Fatalf("expected pops to reuse space, got: %d",
+			data.PrevChunkLens()+data.LastChunkLen)
+	}
+}
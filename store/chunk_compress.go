@@ -0,0 +1,309 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ChunksStats reports on the sealed, compressed chunks and on the
+// freed space of a Chunks.
+type ChunksStats struct {
+	// SealedChunks is the number of chunks that are compressed.
+	SealedChunks int
+
+	// RawBytes and CompressedBytes are the sizes of the sealed chunks
+	// before and after compression.
+	RawBytes, CompressedBytes int64
+
+	// CacheHits and CacheMisses count the reads of sealed chunks.
+	CacheHits, CacheMisses int64
+
+	// FreeBytes is the number of freed bytes that are reusable by
+	// Alloc(), held in FreeExtents extents.
+	FreeBytes, FreeExtents int64
+
+	// LargestFreeBytes is the size of the largest free extent.
+	LargestFreeBytes int64
+}
+
+// CompressionRatio returns the RawBytes divided by the
+// CompressedBytes, or 0 when no chunks are sealed.
+func (s ChunksStats) CompressionRatio() float64 {
+	if s.CompressedBytes <= 0 {
+		return 0
+	}
+
+	return float64(s.RawBytes) / float64(s.CompressedBytes)
+}
+
+// Fragmentation returns the fraction of the FreeBytes that are
+// outside of the largest free extent, from 0 (none) to nearly 1.
+func (s ChunksStats) Fragmentation() float64 {
+	if s.FreeBytes <= 0 {
+		return 0
+	}
+
+	return 1 - float64(s.LargestFreeBytes)/float64(s.FreeBytes)
+}
+
+// Stats returns the compression and free space stats of the chunks.
+func (cs *Chunks) Stats() (rv ChunksStats) {
+	if cs.compressor != nil {
+		cs.compressor.m.Lock()
+		rv = cs.compressor.stats
+		cs.compressor.m.Unlock()
+	}
+
+	if cs.free != nil {
+		rv.FreeBytes = int64(cs.free.bytes)
+		rv.FreeExtents = int64(len(cs.free.starts))
+		rv.LargestFreeBytes = int64(cs.free.largest())
+	}
+
+	return rv
+}
+
+// SealedChunkPath returns the file path for the i'th chunk when it's
+// sealed and compressed.
+func (cs *Chunks) SealedChunkPath(i int) string {
+	return fmt.Sprintf("%s_chunkz_%09d%s", cs.PathPrefix, i, cs.FileSuffix)
+}
+
+// ---------------------------------------------
+
+// compressor holds the compression state of a Chunks, where the
+// mutex protects the cache and stats, so that concurrent reads of a
+// read-only Chunks are safe.
+type compressor struct {
+	w *flate.Writer
+
+	buf bytes.Buffer
+
+	m sync.Mutex
+
+	// cache holds the most recently used decompressed chunks, with
+	// the most recent first.
+	cache []cachedChunk
+
+	stats ChunksStats
+}
+
+type cachedChunk struct {
+	chunk *MMapRef
+	buf   []byte
+}
+
+// seal compresses the i'th chunk, unless compression doesn't reduce
+// its size, in which case the chunk is left as-is.
+func (cs *Chunks) seal(i int) error {
+	if cs.compressor == nil {
+		w, err := flate.NewWriter(nil, flate.BestSpeed)
+		if err != nil {
+			return err
+		}
+
+		cs.compressor = &compressor{w: w}
+	}
+
+	c := cs.compressor
+
+	chunk := cs.Chunks[i]
+
+	buf, err := cs.loadChunk(i)
+	if err != nil {
+		return err
+	}
+
+	c.buf.Reset()
+	c.w.Reset(&c.buf)
+
+	_, err = c.w.Write(buf)
+	if err == nil {
+		err = c.w.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.buf.Len() >= len(buf) {
+		return nil
+	}
+
+	path := ""
+	if chunk.Path != "" {
+		path = cs.SealedChunkPath(i)
+	}
+
+	sealed, err := cs.createFile(path, c.buf.Len())
+	if err != nil {
+		return err
+	}
+
+	copy(sealed.Buf, c.buf.Bytes())
+
+	sealed.dirty = true
+
+	if cs.sealed == nil {
+		cs.sealed = map[*MMapRef]bool{}
+	}
+
+	cs.sealed[sealed] = true
+
+	c.m.Lock()
+	c.stats.SealedChunks++
+	c.stats.RawBytes += int64(len(buf))
+	c.stats.CompressedBytes += int64(len(sealed.Buf))
+	c.m.Unlock()
+
+	cs.removeFile(chunk)
+
+	cs.Chunks[i] = sealed
+
+	return cs.addFile(sealed)
+}
+
+// unseal replaces the sealed i'th chunk with its decompressed bytes.
+func (cs *Chunks) unseal(i int) error {
+	chunk := cs.Chunks[i]
+
+	buf, err := cs.chunkBuf(i)
+	if err != nil {
+		return err
+	}
+
+	var raw *MMapRef
+	if chunk.Path != "" {
+		raw, err = cs.createChunkFile(i)
+	} else {
+		raw, err = cs.createFile("", cs.ChunkSizeBytes)
+	}
+	if err != nil {
+		return err
+	}
+
+	copy(raw.Buf, buf)
+
+	raw.dirty = true
+
+	cs.removeSealed(chunk)
+
+	cs.Chunks[i] = raw
+
+	return cs.addFile(raw)
+}
+
+// removeSealed removes a sealed chunk, and its cache entry and stats.
+func (cs *Chunks) removeSealed(chunk *MMapRef) {
+	c := cs.compressor
+
+	c.m.Lock()
+	c.uncache(chunk)
+	c.stats.SealedChunks--
+	c.stats.RawBytes -= int64(cs.ChunkSizeBytes)
+	c.stats.CompressedBytes -= int64(chunk.Len())
+	c.m.Unlock()
+
+	delete(cs.sealed, chunk)
+
+	cs.removeFile(chunk)
+}
+
+// replaceSealed transfers the sealed state of a chunk that was moved.
+func (cs *Chunks) replaceSealed(chunk, replacement *MMapRef) {
+	if !cs.sealed[chunk] {
+		return
+	}
+
+	c := cs.compressor
+
+	c.m.Lock()
+	c.uncache(chunk)
+	c.m.Unlock()
+
+	delete(cs.sealed, chunk)
+
+	cs.sealed[replacement] = true
+}
+
+// chunkBuf returns the bytes of the i'th chunk, decompressing a sealed
+// chunk through the cache.
+func (cs *Chunks) chunkBuf(i int) ([]byte, error) {
+	chunk := cs.Chunks[i]
+	if !cs.sealed[chunk] {
+		return cs.loadChunk(i)
+	}
+
+	c := cs.compressor
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for j, cached := range c.cache {
+		if cached.chunk == chunk {
+			c.stats.CacheHits++
+
+			copy(c.cache[1:j+1], c.cache[:j])
+			c.cache[0] = cached
+
+			return cached.buf, nil
+		}
+	}
+
+	c.stats.CacheMisses++
+
+	// A new buf is allocated rather than reusing an evicted buf, as
+	// slices previously returned by BytesRead() might still be in use.
+	buf := make([]byte, cs.ChunkSizeBytes)
+
+	sealedBuf, err := cs.loadChunk(i)
+	if err != nil {
+		return nil, err
+	}
+
+	r := flate.NewReader(bytes.NewReader(sealedBuf))
+
+	_, err = io.ReadFull(r, buf)
+	r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("chunk: decompress chunk: %d, err: %v", i, err)
+	}
+
+	cacheChunks := cs.CacheChunks
+	if cacheChunks <= 0 {
+		cacheChunks = 4
+	}
+
+	if len(c.cache) < cacheChunks {
+		c.cache = append(c.cache, cachedChunk{})
+	}
+
+	copy(c.cache[1:], c.cache[:len(c.cache)-1])
+	c.cache[0] = cachedChunk{chunk: chunk, buf: buf}
+
+	return buf, nil
+}
+
+// uncache removes any cache entry of a chunk, and must be invoked
+// with the mutex held.
+func (c *compressor) uncache(chunk *MMapRef) {
+	for j, cached := range c.cache {
+		if cached.chunk == chunk {
+			c.cache = append(c.cache[:j], c.cache[j+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunksCompress(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksCompress")
+	defer os.RemoveAll(dir)
+
+	cs := &Chunks{
+		PathPrefix:     dir + "/test",
+		FileSuffix:     ".rhstore",
+		ChunkSizeBytes: 1024,
+		Compress:       true,
+		CacheChunks:    2,
+	}
+
+	var offsets []OffsetSize
+	var vals []string
+
+	for i := 0; i < 500; i++ {
+		v := fmt.Sprintf("some text-heavy value number %d, ", i)
+		if i%100 == 0 {
+			for j := 0; j < 100; j++ { // Spans multiple chunks.
+				v += "lorem ipsum "
+			}
+		}
+
+		offset, size, err := cs.BytesAppend([]byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		offsets = append(offsets, OffsetSize{offset, size})
+		vals = append(vals, v)
+	}
+
+	check := func(msg string) {
+		for i, o := range offsets {
+			b, err := cs.BytesRead(o.Offset, o.Size)
+			if err != nil || string(b) != vals[i] {
+				t.Fatalf("%s, i: %d, got: %q, err: %v", msg, i, b, err)
+			}
+		}
+	}
+
+	check("initial")
+
+	stats := cs.Stats()
+	if stats.SealedChunks <= 0 || stats.SealedChunks != len(cs.sealed) ||
+		stats.CompressionRatio() <= 2 {
+		t.Fatalf("expected sealed, compressed chunks, stats: %+v", stats)
+	}
+
+	if stats.CacheHits <= 0 || stats.CacheMisses <= 0 {
+		t.Fatalf("expected cache hits and misses, stats: %+v", stats)
+	}
+
+	if len(cs.compressor.cache) != 2 {
+		t.Fatalf("expected bounded cache, got: %d", len(cs.compressor.cache))
+	}
+
+	sealedFiles, _ := filepath.Glob(dir + "/test_chunkz_*")
+	if len(sealedFiles) != stats.SealedChunks {
+		t.Fatalf("expected sealed files, got: %v", sealedFiles)
+	}
+
+	// A write into a sealed chunk unseals it.
+	vals[50] = fmt.Sprintf("SOME TEXT-HEAVY VALUE NUMBER %d, ", 50)
+
+	err := cs.BytesWrite(offsets[50].Offset, []byte(vals[50]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cs.Stats().SealedChunks >= stats.SealedChunks {
+		t.Fatalf("expected an unsealed chunk, stats: %+v", cs.Stats())
+	}
+
+	check("after write")
+
+	// A truncate into a sealed chunk unseals it for more appends.
+	n := 250
+
+	err = cs.BytesTruncate(offsets[n].Offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offsets, vals = offsets[:n], vals[:n]
+
+	for i := n; i < 400; i++ {
+		v := fmt.Sprintf("another value %d, ", i)
+
+		offset, size, err := cs.BytesAppend([]byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		offsets = append(offsets, OffsetSize{offset, size})
+		vals = append(vals, v)
+	}
+
+	check("after truncate")
+
+	stats = cs.Stats()
+	if stats.SealedChunks != len(cs.sealed) {
+		t.Fatalf("mismatched stats: %+v, sealed: %d", stats, len(cs.sealed))
+	}
+
+	cs.Close()
+
+	files, _ := filepath.Glob(dir + "/*")
+	if len(files) != 0 {
+		t.Fatalf("expected no files after close, got: %v", files)
+	}
+
+	if cs.Stats().SealedChunks != 0 || cs.Stats().CompressedBytes != 0 {
+		t.Fatalf("expected empty stats after close, got: %+v", cs.Stats())
+	}
+}
+
+func TestChunksCompressIncompressible(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksCompress")
+	defer os.RemoveAll(dir)
+
+	cs := &Chunks{
+		PathPrefix:     dir + "/test",
+		ChunkSizeBytes: 1024,
+		Compress:       true,
+	}
+
+	defer cs.Close()
+
+	b := make([]byte, 100)
+
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 100; i++ {
+		r.Read(b)
+
+		if _, _, err := cs.BytesAppend(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cs.Stats().SealedChunks != 0 {
+		t.Fatalf("expected no sealed chunks, stats: %+v", cs.Stats())
+	}
+}
+
+func TestRHStoreFileCompressChunks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksCompress")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 512
+	options.CompressChunks = true
+	options.CompressCacheChunks = 3
+
+	sf, err := CreateRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	for i := 0; i < 2000; i++ {
+		_, err = sf.Set([]byte(fmt.Sprintf("key-%d", i)),
+			[]byte(fmt.Sprintf("a text-heavy value for key %d", i)))
+		if err != nil {
+			t.Fatalf("i: %d, err: %v", i, err)
+		}
+	}
+
+	for i := 0; i < 2000; i += 3 {
+		sf.Del([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	for i := 0; i < 2000; i++ {
+		v, found := sf.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if found != (i%3 != 0) || (found &&
+			string(v) != fmt.Sprintf("a text-heavy value for key %d", i)) {
+			t.Fatalf("i: %d, v: %s, found: %t", i, v, found)
+		}
+	}
+
+	if err = sf.Validate(); err != nil {
+		t.Fatalf("validate, err: %v", err)
+	}
+
+	if sf.Chunks.Stats().CompressionRatio() <= 1 {
+		t.Fatalf("expected compression, stats: %+v", sf.Chunks.Stats())
+	}
+
+	if err = sf.Freeze(); err == nil {
+		t.Fatalf("expected Freeze err with CompressChunks")
+	}
+}
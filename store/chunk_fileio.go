@@ -0,0 +1,117 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+// In the FileIO mode, the chunk files are file refs that are read and
+// written with file I/O instead of being mmap()'ed, so a process with
+// many large Chunks, RHStoreFile's and Heap's does not run out of
+// mmap()'s, such as due to a low vm.max_map_count. The bytes of the
+// most recently used chunk files are loaded into memory, and the
+// least recently used chunk file is unloaded, writing back its bytes
+// when modified, once more than FileIOCacheChunks are loaded.
+
+// loadChunk returns the bytes of the i'th chunk, loading the bytes of
+// a file ref chunk into memory when needed.
+func (cs *Chunks) loadChunk(i int) ([]byte, error) {
+	chunk := cs.Chunks[i]
+	if !chunk.IsFileRef() {
+		return chunk.Buf, nil
+	}
+
+	err := chunk.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cs.touchFile(chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	return chunk.Buf, nil
+}
+
+// touchFile moves a loaded file ref chunk to the front of the loaded
+// chunks, unloading the least recently used chunks that are beyond
+// the FileIOCacheChunks.
+func (cs *Chunks) touchFile(chunk *MMapRef) error {
+	if len(cs.loaded) > 0 && cs.loaded[0] == chunk {
+		return nil
+	}
+
+	cs.uncacheFile(chunk)
+
+	cs.loaded = append(cs.loaded, nil)
+	copy(cs.loaded[1:], cs.loaded)
+	cs.loaded[0] = chunk
+
+	maxLoaded := cs.FileIOCacheChunks
+	if maxLoaded <= 0 {
+		maxLoaded = 8
+	}
+
+	for len(cs.loaded) > maxLoaded {
+		last := cs.loaded[len(cs.loaded)-1]
+
+		// An unload error leaves the chunk loaded, for a retry by a
+		// later touchFile().
+		err := last.unload(false)
+		if err != nil {
+			return err
+		}
+
+		cs.loaded[len(cs.loaded)-1] = nil
+		cs.loaded = cs.loaded[:len(cs.loaded)-1]
+	}
+
+	return nil
+}
+
+// uncacheFile forgets a chunk that's no longer used as a loaded chunk,
+// such as when it's recycled or removed.
+func (cs *Chunks) uncacheFile(chunk *MMapRef) {
+	for j, loaded := range cs.loaded {
+		if loaded == chunk {
+			copy(cs.loaded[j:], cs.loaded[j+1:])
+			cs.loaded[len(cs.loaded)-1] = nil
+			cs.loaded = cs.loaded[:len(cs.loaded)-1]
+
+			return
+		}
+	}
+}
+
+// recycleFile releases the bytes of a file ref chunk that's recycled,
+// as its bytes will be overwritten before being read.
+func (cs *Chunks) recycleFile(chunk *MMapRef) {
+	if chunk.IsFileRef() {
+		cs.uncacheFile(chunk)
+
+		chunk.Buf = nil
+		chunk.dirty = false
+	}
+}
+
+// addFile tracks a file ref chunk that's new or reused as loaded,
+// where a recycled chunk gets a new, zeroed Buf, which does not need
+// to be loaded, as its leftover bytes are not read.
+func (cs *Chunks) addFile(chunk *MMapRef) error {
+	if !chunk.IsFileRef() {
+		return nil
+	}
+
+	if chunk.Buf == nil {
+		chunk.Buf = make([]byte, chunk.size)
+	}
+
+	return cs.touchFile(chunk)
+}
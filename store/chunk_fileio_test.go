@@ -0,0 +1,303 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// numLoaded returns the number of file ref chunks with a loaded Buf.
+func numLoaded(cs *Chunks) (rv int) {
+	for _, chunk := range cs.Chunks {
+		if chunk.IsFileRef() && chunk.Buf != nil {
+			rv++
+		}
+	}
+
+	return rv
+}
+
+func TestChunksFileIO(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir, _ := ioutil.TempDir("", "testChunksFileIO")
+		defer os.RemoveAll(dir)
+
+		cs := &Chunks{
+			PathPrefix:        dir + "/test",
+			ChunkSizeBytes:    100,
+			FileIO:            true,
+			FileIOCacheChunks: 2,
+			Compress:          compress,
+		}
+
+		var expected []byte
+
+		for i := 0; i < 200; i++ {
+			b := []byte(fmt.Sprintf("item-%03d|", i))
+
+			if _, err := cs.Write(b); err != nil {
+				t.Fatal(err)
+			}
+
+			expected = append(expected, b...)
+
+			if numLoaded(cs) > 2 {
+				t.Fatalf("compress: %t, i: %d, expected bounded loaded chunks: %d",
+					compress, i, numLoaded(cs))
+			}
+		}
+
+		for _, chunk := range cs.Chunks {
+			if chunk.MMap != nil {
+				t.Fatalf("compress: %t, expected no mmap()'s", compress)
+			}
+		}
+
+		// Overwrite an early span that crosses chunks, which needs
+		// evicted chunks to be reloaded and written back.
+		copy(expected[95:], "OVERWRITE")
+
+		if err := cs.BytesWrite(95, []byte("OVERWRITE")); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]byte, len(expected))
+
+		if _, err := cs.ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, expected) {
+			t.Fatalf("compress: %t, mismatched bytes", compress)
+		}
+
+		if numLoaded(cs) > 2 {
+			t.Fatalf("compress: %t, expected bounded loaded chunks: %d",
+				compress, numLoaded(cs))
+		}
+
+		if !compress {
+			if err := cs.Flush(FlushSync); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := ioutil.ReadFile(cs.ChunkPath(1))
+			if err != nil || string(b[:4]) != "RITE" {
+				t.Fatalf("expected flushed chunk file, err: %v", err)
+			}
+		}
+
+		// Truncate and reuse the recycled chunk files.
+		if err := cs.BytesTruncate(150); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := cs.Write(bytes.Repeat([]byte("z"), 500)); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := cs.BytesRead(140, 20)
+		if err != nil || string(b) != string(expected[140:150])+"zzzzzzzzzz" {
+			t.Fatalf("compress: %t, expected reused chunks, b: %q, err: %v",
+				compress, b, err)
+		}
+
+		cs.Close()
+	}
+}
+
+func TestChunksFileIOFreeze(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksFileIO")
+	defer os.RemoveAll(dir)
+
+	cs := &Chunks{
+		PathPrefix:        dir + "/test",
+		ChunkSizeBytes:    100,
+		FileIO:            true,
+		FileIOCacheChunks: 1,
+	}
+
+	defer cs.Close()
+
+	for i := 0; i < 50; i++ {
+		if _, err := cs.Write([]byte(fmt.Sprintf("%09d|", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cs.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range cs.Chunks {
+		b, err := ioutil.ReadFile(cs.ChunkPath(i))
+		if err != nil || string(b[:10]) != fmt.Sprintf("%09d|", i*10) {
+			t.Fatalf("i: %d, expected frozen chunk file, b: %q, err: %v",
+				i, b, err)
+		}
+	}
+}
+
+func TestRHStoreFileFileIO(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksFileIO")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 1024
+	options.FileIO = true
+	options.FileIOCacheChunks = 2
+
+	sf, err := CreateRHStoreFile(dir+"/sf", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	// Move past the in-memory 0'th chunk.
+	for i := 0; i < 200; i++ {
+		_, err = sf.Set([]byte(fmt.Sprintf("key-%d", i)),
+			[]byte(fmt.Sprintf("val-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A val that spans more chunks than the FileIOCacheChunks, so its
+	// dirty chunks are evicted before the val is completely written.
+	big := bytes.Repeat([]byte("0123456789"), 500)
+
+	_, err = sf.Set([]byte("big"), big)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if numLoaded(&sf.Chunks) > 2 {
+		t.Fatalf("expected bounded loaded chunks: %d", numLoaded(&sf.Chunks))
+	}
+
+	v, found := sf.Get([]byte("big"))
+	if !found || !bytes.Equal(v, big) {
+		t.Fatalf("expected big val after its chunks were evicted")
+	}
+
+	// An in-place overwrite of the val also spans the evictions.
+	big = bytes.Repeat([]byte("abcdefghij"), 500)
+
+	_, err = sf.SetMerge([]byte("big"), big, MergeLast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := sf.Find([]byte("big"))
+	if err != nil || e == nil {
+		t.Fatalf("expected big item, err: %v", err)
+	}
+
+	vOffset, vSize := e.ValOffsetSize()
+	if vOffset < uint64(options.ChunkSizeBytes) || vSize != uint64(len(big)) {
+		t.Fatalf("expected big val in chunk files, vOffset: %d", vOffset)
+	}
+
+	if err = sf.Flush(FlushSync); err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunk files hold the written back val.
+	var got []byte
+
+	for i := int(vOffset) / options.ChunkSizeBytes; i*options.ChunkSizeBytes <
+		int(vOffset+vSize); i++ {
+		b, err := ioutil.ReadFile(sf.Chunks.ChunkPath(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got = append(got, b...)
+	}
+
+	start := int(vOffset) % options.ChunkSizeBytes
+	if !bytes.Equal(got[start:start+len(big)], big) {
+		t.Fatalf("expected written back val in the chunk files")
+	}
+
+	for i := 0; i < 200; i++ {
+		v, found := sf.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if !found || string(v) != fmt.Sprintf("val-%d", i) {
+			t.Fatalf("i: %d, v: %s", i, v)
+		}
+	}
+
+	for _, chunk := range sf.Chunks.Chunks {
+		if chunk.MMap != nil {
+			t.Fatalf("expected no chunk mmap()'s")
+		}
+	}
+
+	if numLoaded(&sf.Chunks) > 2 {
+		t.Fatalf("expected bounded loaded chunks")
+	}
+
+	// The slots are a single mapping rather than held in memory.
+	if sf.Slots.Path == "" || sf.Slots.MMap == nil || sf.OldSlots != nil ||
+		sf.MemoryBytes() > options.ChunkSizeBytes*3 {
+		t.Fatalf("expected mmap()'ed slots, memory: %d", sf.MemoryBytes())
+	}
+
+	if err = sf.Freeze(); err == nil {
+		t.Fatalf("expected Freeze err with FileIO")
+	}
+}
+
+func TestHeapFileIO(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksFileIO")
+	defer os.RemoveAll(dir)
+
+	h := &Heap{
+		LessFunc: func(a, b []byte) bool { return bytes.Compare(a, b) < 0 },
+		Heap: &Chunks{
+			PathPrefix:        dir + "/heap",
+			ChunkSizeBytes:    160,
+			FileIO:            true,
+			FileIOCacheChunks: 2,
+		},
+		Data: &Chunks{
+			PathPrefix:        dir + "/data",
+			ChunkSizeBytes:    100,
+			FileIO:            true,
+			FileIOCacheChunks: 2,
+		},
+	}
+
+	defer h.Close()
+
+	for i := 0; i < 500; i++ {
+		heap.Push(h, []byte(fmt.Sprintf("%05d", (i*37)%500)))
+	}
+
+	for i := 0; i < 500; i++ {
+		x := heap.Pop(h).([]byte)
+		if string(x) != fmt.Sprintf("%05d", i) {
+			t.Fatalf("i: %d, x: %s", i, x)
+		}
+	}
+
+	if h.Err != nil {
+		t.Fatal(h.Err)
+	}
+}
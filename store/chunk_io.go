@@ -0,0 +1,117 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"io"
+)
+
+// The io adapters treat the Chunks as one large, spillable byte
+// buffer, whose reads and writes can cross chunk boundaries.
+var (
+	_ io.Writer   = &Chunks{}
+	_ io.ReaderAt = &Chunks{}
+	_ io.WriterAt = &Chunks{}
+)
+
+// Write implements io.Writer by appending p contiguously to the end of
+// the chunks, unlike BytesAppend(), which might skip ahead to the
+// start of a new chunk.
+func (cs *Chunks) Write(p []byte) (n int, err error) {
+	_, _, err = cs.BytesAppendSpan(p)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// ReadAt implements io.ReaderAt, returning io.EOF when fewer than
+// len(p) bytes are available at the offset.
+func (cs *Chunks) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("chunk: ReadAt negative offset: %d", off)
+	}
+
+	end := int64(cs.BytesLen())
+	if off >= end {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > end-off {
+		p = p[:end-off]
+
+		err = io.EOF
+	}
+
+	chunkIdx, chunkOffset, errLocate := cs.locate(uint64(off), uint64(len(p)))
+	if errLocate != nil {
+		return 0, errLocate
+	}
+
+	errSpan := cs.visitSpan(chunkIdx, chunkOffset, p, func(chunkBuf, b []byte) {
+		copy(b, chunkBuf)
+	})
+	if errSpan != nil {
+		return 0, errSpan
+	}
+
+	return len(p), err
+}
+
+// WriteAt implements io.WriterAt, where the bytes of p beyond the end
+// of the chunks are appended, and a gap between the end of the chunks
+// and the offset is first filled with zeros.
+func (cs *Chunks) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("chunk: WriteAt negative offset: %d", off)
+	}
+
+	for end := int64(cs.BytesLen()); end < off; end = int64(cs.BytesLen()) {
+		gap := off - end
+		if gap > int64(cs.ChunkSizeBytes) {
+			gap = int64(cs.ChunkSizeBytes)
+		}
+
+		_, _, err = cs.BytesAppendSpan(cs.zeroBytes(int(gap)))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	m := int64(cs.BytesLen()) - off
+	if m > int64(len(p)) {
+		m = int64(len(p))
+	}
+
+	if m > 0 {
+		err = cs.BytesWrite(uint64(off), p[:m])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, _, err = cs.BytesAppendSpan(p[m:])
+	if err != nil {
+		return int(m), err
+	}
+
+	return len(p), nil
+}
+
+// NewReader returns a sequential reader of the bytes of the chunks,
+// up to the BytesLen() at the time of the call, which also implements
+// io.Seeker and io.ReaderAt.
+func (cs *Chunks) NewReader() *io.SectionReader {
+	return io.NewSectionReader(cs, 0, int64(cs.BytesLen()))
+}
@@ -0,0 +1,166 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestChunksIO(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksIO")
+	defer os.RemoveAll(dir)
+
+	for _, compress := range []bool{false, true} {
+		cs := &Chunks{
+			PathPrefix:     dir + "/test",
+			ChunkSizeBytes: 100,
+			Compress:       compress,
+		}
+
+		var expected []byte
+
+		r := rand.New(rand.NewSource(1))
+
+		// Writes of varying sizes, some crossing chunk boundaries.
+		for i := 0; i < 50; i++ {
+			p := bytes.Repeat([]byte{byte('a' + i%26)}, r.Intn(250))
+
+			n, err := cs.Write(p)
+			if err != nil || n != len(p) {
+				t.Fatalf("write, n: %d, err: %v", n, err)
+			}
+
+			expected = append(expected, p...)
+		}
+
+		if cs.BytesLen() != uint64(len(expected)) {
+			t.Fatalf("expected contiguous writes, len: %d, expected: %d",
+				cs.BytesLen(), len(expected))
+		}
+
+		// Overwrites crossing chunk boundaries and past the end.
+		for _, off := range []int{0, 95, 250, len(expected) - 10} {
+			p := bytes.Repeat([]byte("XYZ"), 20)
+
+			n, err := cs.WriteAt(p, int64(off))
+			if err != nil || n != len(p) {
+				t.Fatalf("write at: %d, n: %d, err: %v", off, n, err)
+			}
+
+			for len(expected) < off+len(p) {
+				expected = append(expected, 0)
+			}
+
+			copy(expected[off:], p)
+		}
+
+		// A write after a gap zero fills the gap.
+		off := len(expected) + 333
+
+		if _, err := cs.WriteAt([]byte("end"), int64(off)); err != nil {
+			t.Fatal(err)
+		}
+
+		expected = append(expected, make([]byte, 333)...)
+		expected = append(expected, "end"...)
+
+		for _, off := range []int{0, 1, 99, 100, 150, len(expected) - 60} {
+			p := make([]byte, 60)
+
+			n, err := cs.ReadAt(p, int64(off))
+			if err != nil || n != 60 || !bytes.Equal(p, expected[off:off+60]) {
+				t.Fatalf("read at: %d, n: %d, err: %v", off, n, err)
+			}
+		}
+
+		p := make([]byte, 60)
+
+		n, err := cs.ReadAt(p, int64(len(expected)-10))
+		if err != io.EOF || n != 10 ||
+			!bytes.Equal(p[:n], expected[len(expected)-10:]) {
+			t.Fatalf("short read at the end, n: %d, err: %v", n, err)
+		}
+
+		if _, err = cs.ReadAt(p, int64(len(expected))); err != io.EOF {
+			t.Fatalf("expected EOF, err: %v", err)
+		}
+
+		if _, err = cs.ReadAt(p, -1); err == nil {
+			t.Fatalf("expected err on negative offset")
+		}
+
+		all, err := ioutil.ReadAll(cs.NewReader())
+		if err != nil || !bytes.Equal(all, expected) {
+			t.Fatalf("read all, compress: %t, len: %d, expected: %d, err: %v",
+				compress, len(all), len(expected), err)
+		}
+
+		cs.Close()
+	}
+}
+
+func TestChunksIOCopy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksIO")
+	defer os.RemoveAll(dir)
+
+	cs := &Chunks{
+		PathPrefix:     dir + "/test",
+		ChunkSizeBytes: 1024,
+	}
+
+	defer cs.Close()
+
+	src := make([]byte, 10000)
+	rand.New(rand.NewSource(2)).Read(src)
+
+	n, err := io.Copy(cs, bytes.NewReader(src))
+	if err != nil || n != int64(len(src)) {
+		t.Fatalf("copy in, n: %d, err: %v", n, err)
+	}
+
+	var dst bytes.Buffer
+
+	n, err = io.Copy(&dst, cs.NewReader())
+	if err != nil || n != int64(len(src)) || !bytes.Equal(dst.Bytes(), src) {
+		t.Fatalf("copy out, n: %d, err: %v", n, err)
+	}
+}
+
+func TestChunksIOPadding(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunksIO")
+	defer os.RemoveAll(dir)
+
+	cs := &Chunks{
+		PathPrefix:     dir + "/test",
+		ChunkSizeBytes: 100,
+	}
+
+	defer cs.Close()
+
+	// A BytesAppend() that doesn't fit skips ahead to a new chunk,
+	// leaving padding in the in-memory 0'th chunk.
+	cs.BytesAppend(bytes.Repeat([]byte("a"), 90))
+	cs.BytesAppend(bytes.Repeat([]byte("b"), 20))
+
+	expected := append(bytes.Repeat([]byte("a"), 90), make([]byte, 10)...)
+	expected = append(expected, bytes.Repeat([]byte("b"), 20)...)
+
+	all, err := ioutil.ReadAll(cs.NewReader())
+	if err != nil || !bytes.Equal(all, expected) {
+		t.Fatalf("read all, got: %q, err: %v", all, err)
+	}
+}
@@ -0,0 +1,230 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ChunkPool lends pre-sized, mmap()'ed chunk files to many Chunks,
+// such as the many short-lived RHStoreFile's and Heap's of the
+// queries of a process, so that chunk files are not repeatedly
+// created, sized, mmap()'ed and removed. Returned chunk files are
+// kept idle, by size, for reuse by any Chunks with the same
+// ChunkSizeBytes. A ChunkPool is concurrent safe.
+type ChunkPool struct {
+	// PathPrefix is the path prefix of the pooled chunk files, such as
+	// a path prefix from a SpillDir.
+	PathPrefix string
+
+	// FileSuffix is the file suffix of the pooled chunk files.
+	FileSuffix string
+
+	// MaxIdle is the max number of idle chunk files that are kept,
+	// where chunk files returned beyond the MaxIdle are removed.
+	MaxIdle int
+
+	// Quota, when non-nil, is charged with the bytes of the idle chunk
+	// files, as they're no longer charged to the Chunks that returned
+	// them. A returned chunk file that would exceed the Quota is
+	// removed rather than kept idle. The Quota is usually the same
+	// DiskQuota as the Chunks use, so idle files count toward it.
+	Quota *DiskQuota
+
+	// QuotaOwner is the owner name that's used with the Quota, and
+	// defaults to the PathPrefix.
+	QuotaOwner string
+
+	m sync.Mutex
+
+	idle map[int][]*MMapRef // Keyed by chunk size.
+
+	numIdle int
+
+	nextID uint64
+
+	closed bool
+
+	stats ChunkPoolStats
+}
+
+// ChunkPoolStats reports on the reuse of the chunk files of a
+// ChunkPool.
+type ChunkPoolStats struct {
+	// Created and Reused count the chunk files that were lent by
+	// creating a new file or by reusing an idle file.
+	Created, Reused int64
+
+	// Removed counts the chunk files that were removed, due to the
+	// MaxIdle or the Close() of the ChunkPool.
+	Removed int64
+
+	// Idle is the current number of idle chunk files.
+	Idle int
+}
+
+// NewChunkPool returns a ready-to-use ChunkPool.
+func NewChunkPool(pathPrefix, fileSuffix string, maxIdle int) *ChunkPool {
+	return &ChunkPool{
+		PathPrefix: pathPrefix,
+		FileSuffix: fileSuffix,
+		MaxIdle:    maxIdle,
+		idle:       map[int][]*MMapRef{},
+	}
+}
+
+// Get lends a chunk file of the given size, reusing an idle chunk
+// file when possible, whose bytes are leftovers from its earlier use.
+func (p *ChunkPool) Get(size int) (*MMapRef, error) {
+	if r := p.getIdle(size); r != nil {
+		return r, nil
+	}
+
+	p.m.Lock()
+
+	if p.closed {
+		p.m.Unlock()
+
+		return nil, fmt.Errorf("chunk: ChunkPool Get after Close")
+	}
+
+	p.nextID++
+
+	path := fmt.Sprintf("%s_pool_%09d%s", p.PathPrefix, p.nextID, p.FileSuffix)
+
+	p.m.Unlock()
+
+	// The file is created outside of the lock, as it's slow.
+	r, err := CreateFileAsMMapRef(path, size)
+	if err != nil {
+		return nil, err
+	}
+
+	r.pool = p
+
+	p.m.Lock()
+	p.stats.Created++
+	p.m.Unlock()
+
+	return r, nil
+}
+
+// getIdle lends an idle chunk file of the given size, if any, whose
+// bytes are then no longer charged to the Quota.
+func (p *ChunkPool) getIdle(size int) *MMapRef {
+	p.m.Lock()
+
+	idle := p.idle[size]
+	if len(idle) <= 0 {
+		p.m.Unlock()
+
+		return nil
+	}
+
+	r := idle[len(idle)-1]
+	idle[len(idle)-1] = nil
+	p.idle[size] = idle[:len(idle)-1]
+
+	p.numIdle--
+	p.stats.Reused++
+
+	p.m.Unlock()
+
+	if p.Quota != nil {
+		p.Quota.Release(p.quotaOwner(), int64(size))
+	}
+
+	return r
+}
+
+// Put returns a chunk file that was lent by Get(), which is kept idle
+// for reuse, or is removed when there are already MaxIdle idle chunk
+// files, when the file's bytes would exceed the Quota, or when the
+// ChunkPool is closed.
+func (p *ChunkPool) Put(r *MMapRef) {
+	// The leftover bytes are not needed until the next Get().
+	r.Advise(AdviseDontNeed)
+
+	p.m.Lock()
+
+	if p.closed || p.numIdle >= p.MaxIdle || (p.Quota != nil &&
+		p.Quota.Acquire(p.quotaOwner(), int64(len(r.Buf))) != nil) {
+		p.stats.Removed++
+
+		p.m.Unlock()
+
+		r.Close()
+		r.Remove()
+
+		return
+	}
+
+	if p.idle == nil {
+		p.idle = map[int][]*MMapRef{}
+	}
+
+	p.idle[len(r.Buf)] = append(p.idle[len(r.Buf)], r)
+
+	p.numIdle++
+
+	p.m.Unlock()
+}
+
+func (p *ChunkPool) quotaOwner() string {
+	if p.QuotaOwner != "" {
+		return p.QuotaOwner
+	}
+
+	return p.PathPrefix
+}
+
+// Stats returns the reuse stats of the ChunkPool.
+func (p *ChunkPool) Stats() ChunkPoolStats {
+	p.m.Lock()
+	rv := p.stats
+	rv.Idle = p.numIdle
+	p.m.Unlock()
+
+	return rv
+}
+
+// Close removes the idle chunk files, where chunk files that are
+// still lent out are removed when they're later returned by Put().
+func (p *ChunkPool) Close() error {
+	p.m.Lock()
+
+	idle := p.idle
+
+	p.idle = nil
+	p.numIdle = 0
+	p.closed = true
+
+	for _, rs := range idle {
+		p.stats.Removed += int64(len(rs))
+	}
+
+	p.m.Unlock()
+
+	for _, rs := range idle {
+		for _, r := range rs {
+			if p.Quota != nil {
+				p.Quota.Release(p.quotaOwner(), int64(len(r.Buf)))
+			}
+
+			r.Close()
+			r.Remove()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,290 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestChunkPool(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunkPool")
+	defer os.RemoveAll(dir)
+
+	p := NewChunkPool(dir+"/pool", ".rhstore", 2)
+
+	var rs []*MMapRef
+
+	for i := 0; i < 3; i++ {
+		r, err := p.Get(1024)
+		if err != nil || len(r.Buf) != 1024 {
+			t.Fatalf("get, err: %v", err)
+		}
+
+		rs = append(rs, r)
+	}
+
+	for _, r := range rs {
+		p.Put(r)
+	}
+
+	stats := p.Stats()
+	if stats.Created != 3 || stats.Idle != 2 || stats.Removed != 1 {
+		t.Fatalf("expected MaxIdle to be respected, stats: %+v", stats)
+	}
+
+	// Idle chunk files are only reused for the same size.
+	r, err := p.Get(2048)
+	if err != nil || len(r.Buf) != 2048 || p.Stats().Created != 4 {
+		t.Fatalf("expected a new chunk file, stats: %+v", p.Stats())
+	}
+
+	r2, err := p.Get(1024)
+	if err != nil || len(r2.Buf) != 1024 || p.Stats().Reused != 1 {
+		t.Fatalf("expected a reused chunk file, stats: %+v", p.Stats())
+	}
+
+	p.Put(r2)
+
+	files, _ := filepath.Glob(dir + "/pool_pool_*")
+	if len(files) != 3 {
+		t.Fatalf("expected 2 idle and 1 lent files, got: %v", files)
+	}
+
+	p.Close()
+
+	files, _ = filepath.Glob(dir + "/pool_pool_*")
+	if len(files) != 1 {
+		t.Fatalf("expected idle files removed on close, got: %v", files)
+	}
+
+	if _, err = p.Get(1024); err == nil {
+		t.Fatalf("expected err on get after close")
+	}
+
+	// A chunk file returned after the close is removed.
+	p.Put(r)
+
+	files, _ = filepath.Glob(dir + "/*")
+	if len(files) != 0 {
+		t.Fatalf("expected no files, got: %v", files)
+	}
+}
+
+func TestChunkPoolConcurrent(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunkPool")
+	defer os.RemoveAll(dir)
+
+	p := NewChunkPool(dir+"/pool", "", 4)
+
+	var wg sync.WaitGroup
+
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 20; i++ {
+				r, err := p.Get(4096)
+				if err != nil {
+					t.Errorf("g: %d, get, err: %v", g, err)
+					return
+				}
+
+				r.Buf[0] = byte(g)
+
+				p.Put(r)
+			}
+		}(g)
+	}
+
+	wg.Wait()
+
+	stats := p.Stats()
+	if stats.Created+stats.Reused != 160 ||
+		stats.Created-stats.Removed != int64(stats.Idle) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	p.Close()
+
+	files, _ := filepath.Glob(dir + "/*")
+	if len(files) != 0 {
+		t.Fatalf("expected no files, got: %v", files)
+	}
+}
+
+func TestChunkPoolRHStoreFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunkPool")
+	defer os.RemoveAll(dir)
+
+	p := NewChunkPool(dir+"/pool", ".rhstore", 100)
+
+	defer p.Close()
+
+	quota := NewDiskQuota(0)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 100
+	options.ChunkSizeBytes = 1024
+	options.ChunkPool = p
+	options.Quota = quota
+
+	for q := 0; q < 10; q++ {
+		sf, err := CreateRHStoreFile(fmt.Sprintf("%s/sf-%d", dir, q), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 500; i++ {
+			_, err = sf.Set([]byte(fmt.Sprintf("key-%d", i)),
+				[]byte(fmt.Sprintf("val-%d-%d", i, q)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := 0; i < 500; i++ {
+			v, found := sf.Get([]byte(fmt.Sprintf("key-%d", i)))
+			if !found || string(v) != fmt.Sprintf("val-%d-%d", i, q) {
+				t.Fatalf("q: %d, i: %d, v: %s", q, i, v)
+			}
+		}
+
+		if err = sf.Freeze(); err == nil {
+			t.Fatalf("expected Freeze err with a ChunkPool")
+		}
+
+		h := &Heap{
+			LessFunc: func(a, b []byte) bool { return bytes.Compare(a, b) < 0 },
+			Heap: &Chunks{
+				PathPrefix:     fmt.Sprintf("%s/heap-%d", dir, q),
+				ChunkSizeBytes: 1024,
+				Pool:           p,
+			},
+			Data: &Chunks{
+				PathPrefix:     fmt.Sprintf("%s/data-%d", dir, q),
+				ChunkSizeBytes: 1024,
+				Pool:           p,
+			},
+		}
+
+		for i := 0; i < 500; i++ {
+			heap.Push(h, []byte(fmt.Sprintf("%05d", (i*37)%500)))
+		}
+
+		for i := 0; i < 500; i++ {
+			x := heap.Pop(h).([]byte)
+			if string(x) != fmt.Sprintf("%05d", i) {
+				t.Fatalf("q: %d, i: %d, x: %s", q, i, x)
+			}
+		}
+
+		h.Close()
+		sf.Close()
+
+		if quota.UsedBytes() != 0 {
+			t.Fatalf("expected quota released, used: %d", quota.UsedBytes())
+		}
+	}
+
+	stats := p.Stats()
+	if stats.Created <= 0 || stats.Reused <= stats.Created*5 {
+		t.Fatalf("expected chunk files to be reused, stats: %+v", stats)
+	}
+
+	files, _ := filepath.Glob(dir + "/*")
+	if len(files) != stats.Idle {
+		t.Fatalf("expected only the idle pool files, got: %v", files)
+	}
+}
+
+func TestChunkPoolQuota(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunkPool")
+	defer os.RemoveAll(dir)
+
+	quota := NewDiskQuota(3 * 1024)
+
+	p := NewChunkPool(dir+"/pool", "", 10)
+	p.Quota = quota
+
+	newChunks := func(name string) *Chunks {
+		return &Chunks{
+			PathPrefix:     dir + "/" + name,
+			ChunkSizeBytes: 1024,
+			Pool:           p,
+			Quota:          quota,
+		}
+	}
+
+	a := newChunks("a")
+
+	if _, _, err := a.BytesAppend(make([]byte, 4*1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	if quota.UsedBytes() != 3*1024 || quota.OwnerBytes()[dir+"/a"] != 3*1024 {
+		t.Fatalf("expected lent files charged to a, got: %v", quota.OwnerBytes())
+	}
+
+	// The returned files stay charged to the quota, but to the pool.
+	a.Close()
+
+	if quota.UsedBytes() != 3*1024 || quota.OwnerBytes()[dir+"/pool"] != 3*1024 ||
+		p.Stats().Idle != 3 {
+		t.Fatalf("expected idle files charged to the pool, got: %v, stats: %+v",
+			quota.OwnerBytes(), p.Stats())
+	}
+
+	// A full quota of idle files can still be reused.
+	b := newChunks("b")
+
+	if _, _, err := b.BytesAppend(make([]byte, 4*1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	if quota.UsedBytes() != 3*1024 || quota.OwnerBytes()[dir+"/b"] != 3*1024 ||
+		p.Stats().Reused != 3 || p.Stats().Created != 3 {
+		t.Fatalf("expected reused files charged to b, got: %v, stats: %+v",
+			quota.OwnerBytes(), p.Stats())
+	}
+
+	// Beyond the quota, a new file is not created.
+	if _, _, err := b.BytesAppend(make([]byte, 1024)); err != ErrDiskQuotaExceeded {
+		t.Fatalf("expected ErrDiskQuotaExceeded, got: %v", err)
+	}
+
+	// A returned file that would exceed the pool's quota is removed.
+	p.Quota = NewDiskQuota(2 * 1024)
+
+	b.Close()
+
+	stats := p.Stats()
+	if stats.Idle != 2 || stats.Removed != 1 || p.Quota.UsedBytes() != 2*1024 ||
+		quota.UsedBytes() != 0 {
+		t.Fatalf("expected the pool's quota to be respected, stats: %+v", stats)
+	}
+
+	p.Close()
+
+	files, _ := filepath.Glob(dir + "/*")
+	if len(files) != 0 || p.Quota.UsedBytes() != 0 {
+		t.Fatalf("expected no files, got: %v, used: %d", files, p.Quota.UsedBytes())
+	}
+}
@@ -15,6 +15,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"runtime"
+	"runtime/debug"
 	"testing"
 )
 
@@ -66,3 +68,278 @@ func BenchmarkChunkTruncate(b *testing.B) {
 		appendStuff()
 	}
 }
+
+func TestChunksBytesTruncate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunk")
+	defer os.RemoveAll(dir)
+
+	cs := &Chunks{
+		PathPrefix:     dir + "/test",
+		FileSuffix:     ".testChunk",
+		ChunkSizeBytes: 100,
+	}
+
+	defer cs.Close()
+
+	var savepoints, offsets []uint64
+	var vals []string
+
+	for i := 0; i < 60; i++ {
+		v := fmt.Sprintf("val-%d-", i)
+		for j := 0; j < i%7; j++ {
+			v += v // Some vals span multiple chunks.
+		}
+
+		savepoints = append(savepoints, cs.BytesLen())
+
+		offset, _, err := cs.BytesAppend([]byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		offsets = append(offsets, offset)
+		vals = append(vals, v)
+	}
+
+	end := cs.BytesLen()
+
+	if err := cs.BytesTruncate(end + 1); err == nil {
+		t.Fatalf("expected err on truncate beyond the end")
+	}
+
+	if cs.BytesLen() != end {
+		t.Fatalf("expected unchanged len, got: %d", cs.BytesLen())
+	}
+
+	// Roll back to each savepoint, from last to first.
+	for i := len(savepoints) - 1; i >= 0; i -= 7 {
+		err := cs.BytesTruncate(savepoints[i])
+		if err != nil {
+			t.Fatalf("i: %d, truncate, err: %v", i, err)
+		}
+
+		if cs.BytesLen() != savepoints[i] {
+			t.Fatalf("i: %d, expected len: %d, got: %d",
+				i, savepoints[i], cs.BytesLen())
+		}
+
+		if cs.LastChunkLen < 0 || cs.LastChunkLen > cs.ChunkSizeBytes {
+			t.Fatalf("i: %d, unexpected LastChunkLen: %d",
+				i, cs.LastChunkLen)
+		}
+
+		if len(cs.Chunks) > int(cs.BytesLen()/100)+1 {
+			t.Fatalf("i: %d, expected later chunks recycled, chunks: %d",
+				i, len(cs.Chunks))
+		}
+
+		for j := 0; j < i; j++ {
+			b, err := cs.BytesRead(offsets[j], uint64(len(vals[j])))
+			if err != nil || string(b) != vals[j] {
+				t.Fatalf("i: %d, j: %d, b: %s, err: %v", i, j, b, err)
+			}
+		}
+
+		// Appends after a rollback reuse the same offsets.
+		offset, _, err := cs.BytesAppend([]byte(vals[i]))
+		if err != nil || offset != offsets[i] {
+			t.Fatalf("i: %d, append, offset: %d, expected: %d, err: %v",
+				i, offset, offsets[i], err)
+		}
+
+		err = cs.BytesTruncate(savepoints[i])
+		if err != nil {
+			t.Fatalf("i: %d, truncate again, err: %v", i, err)
+		}
+	}
+}
+
+func TestChunksAdvise(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunk")
+	defer os.RemoveAll(dir)
+
+	cs := &Chunks{
+		PathPrefix:     dir + "/test",
+		FileSuffix:     ".testChunk",
+		ChunkSizeBytes: 4096,
+		Advice:         AdviseRandom,
+	}
+
+	defer cs.Close()
+
+	buf := make([]byte, 1000)
+
+	for i := 0; i < 20; i++ {
+		buf[0] = byte(i)
+
+		if _, _, err := cs.BytesAppend(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cs.Advise(AdviseSequential); err != nil ||
+		cs.Advice != AdviseSequential {
+		t.Fatalf("advise, err: %v, advice: %d", err, cs.Advice)
+	}
+
+	// Recycled chunks are advised away, and are reused afterwards.
+	if err := cs.BytesTruncate(1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cs.Recycled) == 0 {
+		t.Fatalf("expected recycled chunks")
+	}
+
+	for i := 1; i < 20; i++ {
+		buf[0] = byte(i)
+
+		if _, _, err := cs.BytesAppend(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		chunkIdx := i / 4
+		chunkOffset := (i % 4) * 1000
+
+		b, err := cs.BytesRead(uint64(chunkIdx*4096+chunkOffset), 1)
+		if err != nil || b[0] != byte(i) {
+			t.Fatalf("i: %d, b: %v, err: %v", i, b, err)
+		}
+	}
+}
+
+func TestChunksFlush(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testChunk")
+	defer os.RemoveAll(dir)
+
+	cs := &Chunks{
+		PathPrefix:     dir + "/test",
+		FileSuffix:     ".testChunk",
+		ChunkSizeBytes: 100,
+	}
+
+	defer cs.Close()
+
+	for i := 0; i < 10; i++ {
+		if _, _, err := cs.BytesAppend([]byte(fmt.Sprintf("%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, _, err := cs.BytesAppend(make([]byte, 90)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cs.Flush(FlushSync); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, chunk := range cs.Chunks {
+		if i > 0 && chunk.dirty {
+			t.Fatalf("i: %d, expected flushed chunk", i)
+		}
+	}
+
+	// Only the overwritten chunk becomes dirty.
+	if err := cs.BytesWrite(210, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, chunk := range cs.Chunks {
+		if i > 0 && chunk.dirty != (i == 2) {
+			t.Fatalf("i: %d, unexpected dirty: %t", i, chunk.dirty)
+		}
+	}
+
+	if err := cs.Flush(FlushAsync); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.Flush(FlushSync); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(cs.ChunkPath(2))
+	if err != nil || string(b[10:15]) != "hello" {
+		t.Fatalf("expected flushed chunk file, b: %q, err: %v", b, err)
+	}
+}
+
+func TestChunksCatchFaults(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("an mmap()'ed file cannot be truncated on windows")
+	}
+
+	dir, _ := ioutil.TempDir("", "testChunk")
+	defer os.RemoveAll(dir)
+
+	cs := &Chunks{
+		PathPrefix:     dir + "/test",
+		ChunkSizeBytes: 64 * 1024,
+		CatchFaults:    true,
+	}
+
+	defer cs.Close()
+
+	buf := make([]byte, 1000)
+
+	for cs.BytesLen() < 100*1000 {
+		if _, _, err := cs.BytesAppend(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Truncating the chunk file underneath the mmap() leads to a
+	// SIGBUS on access, as would a failed write of a sparse file.
+	if err := os.Truncate(cs.ChunkPath(1), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	offset := uint64(cs.ChunkSizeBytes + 100)
+
+	if err := cs.BytesWrite(offset, []byte("hello")); err != ErrMMapFault {
+		t.Fatalf("expected ErrMMapFault on write, got: %v", err)
+	}
+
+	if _, err := cs.ReadAt(buf, int64(offset)); err != ErrMMapFault {
+		t.Fatalf("expected ErrMMapFault on read, got: %v", err)
+	}
+
+	lastChunkLen := cs.LastChunkLen
+
+	if _, _, err := cs.BytesAppend(buf); err != ErrMMapFault {
+		t.Fatalf("expected ErrMMapFault on append, got: %v", err)
+	}
+
+	if cs.LastChunkLen != lastChunkLen {
+		t.Fatalf("expected unchanged LastChunkLen, got: %d", cs.LastChunkLen)
+	}
+
+	// Other panics are not caught, including a nil pointer dereference.
+	var err error
+
+	for _, f := range []func(){
+		func() { panic("not a fault") },
+		func() {
+			var chunk *MMapRef
+			_ = chunk.Buf
+		},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil || err != nil {
+					t.Fatalf("expected a re-panic, err: %v", err)
+				}
+			}()
+
+			defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+			defer recoverFault(&err)
+
+			f()
+		}()
+	}
+}
@@ -0,0 +1,57 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+// Distinct is a DISTINCT or dedupe filter, which reports whether each
+// incoming key is being seen for the first time. It's backed by an
+// RHStoreFile with the KeysOnly slots layout, so no val bytes or val
+// offsets are stored, and its memory usage is bounded by the spilling
+// of the RHStoreFile's slots and chunks (see MemoryBudgetBytes).
+type Distinct struct {
+	Store *RHStoreFile
+}
+
+// CreateDistinct returns a ready-to-use Distinct filter, whose files
+// will be placed under the pathPrefix.
+func CreateDistinct(pathPrefix string, options RHStoreFileOptions) (
+	*Distinct, error) {
+	options.KeysOnly = true
+
+	sf, err := CreateRHStoreFile(pathPrefix, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Distinct{Store: sf}, nil
+}
+
+// Close releases the resources of the Distinct filter.
+func (d *Distinct) Close() error {
+	return d.Store.Close()
+}
+
+// Add returns true when the key is seen for the first time, where a
+// first-seen key is remembered with a single hashmap probe.
+func (d *Distinct) Add(k Key) (firstSeen bool, err error) {
+	return d.Store.Set(k, nil)
+}
+
+// Contains returns true when the key has been added before.
+func (d *Distinct) Contains(k Key) bool {
+	_, found := d.Store.Get(k)
+	return found
+}
+
+// Count returns the number of distinct keys.
+func (d *Distinct) Count() int {
+	return d.Store.Count
+}
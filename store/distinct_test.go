@@ -0,0 +1,71 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDistinct(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testDistinct")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 256
+	options.MemoryBudgetBytes = 4000
+
+	d, err := CreateDistinct(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Close()
+
+	for i := 0; i < 3000; i++ {
+		k := []byte(fmt.Sprintf("id-%d", i%1000))
+
+		firstSeen, err := d.Add(k)
+		if err != nil {
+			t.Fatalf("i: %d, err: %v", i, err)
+		}
+		if firstSeen != (i < 1000) {
+			t.Fatalf("i: %d, wrong firstSeen: %t", i, firstSeen)
+		}
+	}
+
+	if d.Count() != 1000 {
+		t.Fatalf("expected 1000 distinct, got: %d", d.Count())
+	}
+
+	if !d.Store.Spilled {
+		t.Fatalf("expected spilled")
+	}
+
+	if !d.Contains([]byte("id-999")) || d.Contains([]byte("id-1000")) {
+		t.Fatalf("wrong Contains")
+	}
+
+	// Duplicates should not grow the chunks.
+	used := d.Store.Chunks.PrevChunkLens() + d.Store.Chunks.LastChunkLen
+
+	for i := 0; i < 1000; i++ {
+		d.Add([]byte(fmt.Sprintf("id-%d", i)))
+	}
+
+	if d.Store.Chunks.PrevChunkLens()+d.Store.Chunks.LastChunkLen != used {
+		t.Fatalf("expected no chunk growth from duplicates")
+	}
+}
@@ -0,0 +1,304 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// ErrFrozenInvalid means the frozen file of an RHStoreFile is invalid.
+var ErrFrozenInvalid = errors.New("frozen invalid")
+
+// FrozenMagic identifies the frozen file of an RHStoreFile.
+var FrozenMagic = [8]byte{'r', 'h', 'f', 'r', 'o', 'z', 'e', 1}
+
+// FrozenLen is the length in bytes of the frozen file, which holds
+// little-endian uint64's of...
+//
+//	[magic][flags][size][count][generation]
+//	[chunkSizeBytes][numChunks][lastChunkLen]
+//
+// Where the flags are the same as the snapshot header flags.
+const FrozenLen = 64
+
+// Freeze completes any in-progress incremental grow and turns the
+// RHStore ReadOnly, after which concurrent Get()'s and Find()'s from
+// many goroutines are safe, as long as the HashFunc and the BytesRead
+// hook are also concurrent safe, which the defaults are.
+func (m *RHStore) Freeze() error {
+	if m.ReadOnly {
+		return nil
+	}
+
+	err := m.FinishMigration()
+	if err != nil {
+		return err
+	}
+
+	m.ReadOnly = true
+
+	return nil
+}
+
+// ---------------------------------------------
+
+// Freeze turns the RHStoreFile ReadOnly for concurrent Get()'s, like
+// RHStore.Freeze(). Additionally, any in-memory slots and chunks are
+// moved out to files, which are flushed, and a frozen file that
+// describes them is written, so that other processes can use
+// OpenFrozenRHStoreFile() to mmap() the files read-only. The files
+// are removed when this RHStoreFile is closed.
+func (sf *RHStoreFile) Freeze() error {
+	if sf.RHStore.ReadOnly {
+		return nil
+	}
+
+	if sf.ByteStore != nil {
+		return fmt.Errorf("rhstore_file: Freeze needs the default Chunks")
+	}
+
+	if sf.Chunks.Compress {
+		return fmt.Errorf("rhstore_file: Freeze does not support CompressChunks")
+	}
+
+	if sf.Chunks.Pool != nil {
+		return fmt.Errorf("rhstore_file: Freeze does not support a ChunkPool")
+	}
+
+	if sf.Chunks.SingleFile {
+		return fmt.Errorf("rhstore_file: Freeze does not support SingleChunkFile")
+	}
+
+	// The loading of chunks in the FileIO mode is not concurrent safe,
+	// unlike the concurrent Get()'s that are allowed after Freeze().
+	if sf.Chunks.FileIO {
+		return fmt.Errorf("rhstore_file: Freeze does not support FileIO")
+	}
+
+	err := sf.RHStore.FinishMigration()
+	if err != nil {
+		return err
+	}
+
+	err = sf.spillFiles(true)
+	if err != nil {
+		return err
+	}
+
+	err = sf.Chunks.Freeze()
+	if err != nil {
+		return err
+	}
+
+	// With the safe build tag, the RHStore.Slots are a copy rather
+	// than a view of the slots file, so they're copied back first.
+	slotsBytes, err := Uint64SliceToByteSlice(sf.RHStore.Slots)
+	if err != nil {
+		return err
+	}
+
+	copy(sf.Slots.Buf, slotsBytes)
+
+	err = sf.Slots.Flush(FlushSync)
+	if err != nil {
+		return err
+	}
+
+	err = sf.writeFrozen()
+	if err != nil {
+		return err
+	}
+
+	sf.RHStore.ReadOnly = true
+
+	return nil
+}
+
+// FrozenPath returns the file path of the frozen file.
+func (sf *RHStoreFile) FrozenPath() string {
+	return fmt.Sprintf("%s_frozen%s", sf.PathPrefix, sf.Options.FileSuffix)
+}
+
+// writeFrozen writes the frozen file via a rename, so that other
+// processes never see a partially written frozen file.
+func (sf *RHStoreFile) writeFrozen() error {
+	var flags uint64
+	if sf.RHStore.InlineVals {
+		flags |= SnapshotFlagInlineVals
+	}
+	if sf.RHStore.KeysOnly {
+		flags |= SnapshotFlagKeysOnly
+	}
+
+	buf := make([]byte, FrozenLen)
+
+	copy(buf, FrozenMagic[:])
+
+	for i, v := range []uint64{flags, uint64(sf.RHStore.Size),
+		uint64(sf.RHStore.Count), uint64(sf.Generation),
+		uint64(sf.Chunks.ChunkSizeBytes), uint64(len(sf.Chunks.Chunks)),
+		uint64(sf.Chunks.LastChunkLen)} {
+		binary.LittleEndian.PutUint64(buf[(i+1)*8:], v)
+	}
+
+	path := sf.FrozenPath()
+
+	err := ioutil.WriteFile(path+".tmp", buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		os.Remove(path + ".tmp")
+	}
+
+	return err
+}
+
+// ---------------------------------------------
+
+// OpenFrozenRHStoreFile opens the files of an RHStoreFile that was
+// frozen by Freeze(), possibly in another process, via read-only
+// mmap()'s. The options must have the same FileSuffix as the frozen
+// RHStoreFile, and the same HashFunc is assumed. The returned
+// RHStoreFile is ReadOnly, allows concurrent Get()'s, and its Close()
+// leaves the files in place, as they're owned by the frozen
+// RHStoreFile, which must not be closed while they're still opened.
+func OpenFrozenRHStoreFile(pathPrefix string, options RHStoreFileOptions) (
+	rv *RHStoreFile, err error) {
+	sf := &RHStoreFile{
+		PathPrefix:    pathPrefix,
+		Options:       options,
+		RHStore:       *(NewRHStore(0)),
+		ReadOnlyFiles: true,
+	}
+
+	buf, err := ioutil.ReadFile(sf.FrozenPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var magic [8]byte
+	copy(magic[:], buf)
+
+	if len(buf) != FrozenLen || magic != FrozenMagic {
+		return nil, ErrFrozenInvalid
+	}
+
+	header := func(i int) uint64 {
+		return binary.LittleEndian.Uint64(buf[i*8:])
+	}
+
+	flags, size, count := header(1), int(header(2)), int(header(3))
+	generation, chunkSizeBytes := int64(header(4)), int(header(5))
+	numChunks, lastChunkLen := int(header(6)), int(header(7))
+
+	if size <= 0 || chunkSizeBytes <= 0 {
+		return nil, ErrFrozenInvalid
+	}
+
+	if flags&SnapshotFlagKeysOnly != 0 {
+		sf.RHStore.SetKeysOnly(0)
+	}
+
+	sf.RHStore.InlineVals = flags&SnapshotFlagInlineVals != 0
+
+	sf.Options.ChunkSizeBytes = chunkSizeBytes
+	sf.Options.InlineVals = sf.RHStore.InlineVals
+	sf.Options.KeysOnly = sf.RHStore.KeysOnly
+
+	sf.Chunks = Chunks{
+		PathPrefix:     pathPrefix,
+		FileSuffix:     options.FileSuffix,
+		ChunkSizeBytes: chunkSizeBytes,
+		LastChunkLen:   lastChunkLen,
+	}
+
+	sf.Generation = generation
+
+	defer func() {
+		if err != nil {
+			sf.Close()
+		}
+	}()
+
+	sf.Slots, err = OpenFileAsMMapRef(sf.SlotsPath(generation), false)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sf.Slots.Buf) != size*8*sf.RHStore.SlotsPerItem() {
+		return nil, ErrFrozenInvalid
+	}
+
+	sf.RHStore.Slots, err = ByteSliceToUint64Slice(sf.Slots.Buf)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < numChunks; i++ {
+		path := sf.Chunks.ChunkPath(i)
+
+		if i == 0 && numChunks == 1 && lastChunkLen == 0 {
+			// An empty 0'th chunk was not moved to a file.
+			sf.Chunks.Chunks = append(sf.Chunks.Chunks, &MMapRef{Refs: 1})
+			continue
+		}
+
+		chunk, err := OpenFileAsMMapRef(path, false)
+		if err != nil {
+			return nil, err
+		}
+
+		sf.Chunks.Chunks = append(sf.Chunks.Chunks, chunk)
+	}
+
+	// Get()'s are point lookups.
+	sf.advise(AdviseRandom)
+	sf.Chunks.Advise(AdviseRandom)
+
+	sf.RHStore.Size = size
+	sf.RHStore.Count = count
+	sf.RHStore.MaxDistance = options.MaxDistance
+	sf.RHStore.ReadOnly = true
+
+	sf.RHStore.BytesRead = func(m *RHStore, offset, size uint64) (
+		[]byte, error) {
+		return sf.Chunks.BytesRead(offset, size)
+	}
+
+	sf.RHStore.BytesTruncate = func(m *RHStore, size uint64) error {
+		return ErrReadOnly
+	}
+
+	sf.RHStore.BytesAppend = func(m *RHStore, b []byte) (
+		offsetOut, sizeOut uint64, err error) {
+		return 0, 0, ErrReadOnly
+	}
+
+	sf.RHStore.BytesWrite = func(m *RHStore, offset uint64, b []byte) error {
+		return ErrReadOnly
+	}
+
+	sf.RHStore.Grow = func(m *RHStore, newSize int) error {
+		return ErrReadOnly
+	}
+
+	sf.RHStore.Close = sf.Close
+
+	return sf, nil
+}
@@ -0,0 +1,204 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestHashFNV32a(t *testing.T) {
+	h := fnv.New32a()
+
+	for _, s := range []string{"", "a", "hello", "hello world"} {
+		h.Reset()
+		h.Write([]byte(s))
+
+		if HashFNV32a([]byte(s)) != h.Sum32() {
+			t.Fatalf("mismatched hash for: %q", s)
+		}
+	}
+}
+
+func TestMMapRefConcurrentRefs(t *testing.T) {
+	r, err := CreateFileAsMMapRef("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			for j := 0; j < 1000; j++ {
+				r.AddRef()
+				r.DecRef()
+			}
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	if r.Refs != 1 || r.Buf == nil {
+		t.Fatalf("expected 1 ref, got: %d", r.Refs)
+	}
+
+	r.DecRef()
+
+	if r.Refs != 0 || r.Buf != nil {
+		t.Fatalf("expected released")
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	for _, budget := range []int{0, 1000000} {
+		for _, incremental := range []bool{false, true} {
+			testFreeze(t, budget, incremental)
+		}
+	}
+}
+
+func testFreeze(t *testing.T, budget int, incremental bool) {
+	dir, _ := ioutil.TempDir("", "testFreeze")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 256
+	options.MemoryBudgetBytes = budget
+	options.IncrementalGrow = incremental
+
+	sf, err := CreateRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	n := 1000
+
+	for i := 0; i < n; i++ {
+		_, err = sf.Set([]byte(fmt.Sprintf("k%d", i)),
+			[]byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = sf.Freeze()
+	if err != nil {
+		t.Fatalf("budget: %d, err: %v", budget, err)
+	}
+
+	if sf.RHStore.Old != nil || !sf.RHStore.ReadOnly {
+		t.Fatalf("expected frozen")
+	}
+
+	if err = sf.Freeze(); err != nil {
+		t.Fatalf("expected idempotent Freeze, err: %v", err)
+	}
+
+	if _, err = sf.Set([]byte("k0"), []byte("x")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got: %v", err)
+	}
+
+	if _, _, err = sf.Del([]byte("k0")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got: %v", err)
+	}
+
+	// The opened files stand in for another process.
+	of, err := OpenFrozenRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatalf("budget: %d, err: %v", budget, err)
+	}
+
+	if of.Count != n || of.Size != sf.Size {
+		t.Fatalf("mismatched count: %d, size: %d", of.Count, of.Size)
+	}
+
+	if err = of.Validate(); err != nil {
+		t.Fatalf("validate, err: %v", err)
+	}
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 16)
+
+	for g := 0; g < 8; g++ {
+		for _, store := range []*RHStoreFile{sf, of} {
+			wg.Add(1)
+			go func(g int, store *RHStoreFile) {
+				defer wg.Done()
+
+				for i := 0; i < n; i++ {
+					j := (i + g*100) % n
+
+					v, found := store.Get([]byte(fmt.Sprintf("k%d", j)))
+					if !found || string(v) != fmt.Sprintf("v%d", j) {
+						errs <- fmt.Errorf("k%d, got: %s, %t", j, v, found)
+						return
+					}
+				}
+			}(g, store)
+		}
+	}
+
+	wg.Wait()
+
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("budget: %d, incremental: %t, err: %v",
+			budget, incremental, err)
+	}
+
+	if _, err = of.Set([]byte("k0"), []byte("x")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got: %v", err)
+	}
+
+	of.Close()
+
+	// The frozen files are still there after the opened one is closed.
+	if _, err = os.Stat(sf.FrozenPath()); err != nil {
+		t.Fatalf("expected frozen file, err: %v", err)
+	}
+
+	if v, found := sf.Get([]byte("k1")); !found || string(v) != "v1" {
+		t.Fatalf("expected k1 after close of opened, got: %s", v)
+	}
+}
+
+func TestOpenFrozenRHStoreFileInvalid(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testFreeze")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+
+	_, err := OpenFrozenRHStoreFile(dir+"/not-there", options)
+	if err == nil {
+		t.Fatalf("expected err on missing frozen file")
+	}
+
+	ioutil.WriteFile(dir+"/bad_frozen"+options.FileSuffix,
+		make([]byte, FrozenLen), 0600)
+
+	_, err = OpenFrozenRHStoreFile(dir+"/bad", options)
+	if err != ErrFrozenInvalid {
+		t.Fatalf("expected ErrFrozenInvalid, got: %v", err)
+	}
+}
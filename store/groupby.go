@@ -0,0 +1,446 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// AggregatorKind is the kind of an Aggregator.
+type AggregatorKind int
+
+// The kinds of aggregators.
+const (
+	AggCount AggregatorKind = iota
+	AggSum
+	AggMin
+	AggMax
+	AggAvg
+	AggCountDistinct
+)
+
+// Aggregator computes an aggregate value over the rows of each group.
+type Aggregator struct {
+	Kind AggregatorKind
+
+	// Value extracts the numeric value of a row, and is used by the
+	// AggSum, AggMin, AggMax and AggAvg kinds.
+	Value func(row []byte) float64
+
+	// Distinct extracts the bytes of a row that are counted by the
+	// AggCountDistinct kind.
+	Distinct func(row []byte) []byte
+}
+
+// stateLen returns the # of bytes of the aggregator's state.
+func (a *Aggregator) stateLen() int {
+	if a.Kind == AggAvg {
+		return 16 // The sum as float64 bits and the count as uint64.
+	}
+
+	return 8
+}
+
+// ---------------------------------------------
+
+// GroupBy performs a GROUP BY aggregation, where the fixed-width
+// aggregate states of each group are encoded as the group's val in an
+// RHStoreFile and are updated in-place as rows are added.
+type GroupBy struct {
+	// Key extracts the group key of a row.
+	Key func(row []byte) []byte
+
+	Aggregators []Aggregator
+
+	// Groups maps each group key to its aggregate states.
+	Groups *RHStoreFile
+
+	// Distincts, when there are AggCountDistinct aggregators, holds
+	// the distinct (aggregator, group key, distinct bytes) entries
+	// seen so far.
+	Distincts *Distinct
+
+	// Merge combines the existing and incoming aggregate states.
+	Merge MergeFunc
+
+	// Temp is used during mutations.
+	Temp []byte
+
+	// TempDistinct is used during mutations.
+	TempDistinct []byte
+}
+
+// CreateGroupBy returns a ready-to-use GroupBy, whose files will be
+// placed under the pathPrefix.
+func CreateGroupBy(pathPrefix string, key func(row []byte) []byte,
+	aggregators []Aggregator, options RHStoreFileOptions) (*GroupBy, error) {
+	g := &GroupBy{Key: key, Aggregators: aggregators}
+
+	var err error
+
+	for i := range aggregators {
+		a := &aggregators[i]
+
+		switch a.Kind {
+		case AggCount:
+		case AggSum, AggMin, AggMax, AggAvg:
+			if a.Value == nil {
+				g.Close()
+
+				return nil, fmt.Errorf("groupby: aggregator %d needs Value", i)
+			}
+		case AggCountDistinct:
+			if a.Distinct == nil {
+				g.Close()
+
+				return nil, fmt.Errorf("groupby: aggregator %d needs Distinct", i)
+			}
+
+			if g.Distincts == nil {
+				g.Distincts, err = CreateDistinct(
+					pathPrefix+"_distinct", options)
+				if err != nil {
+					return nil, err
+				}
+			}
+		default:
+			g.Close()
+
+			return nil, fmt.Errorf("groupby: aggregator %d has unknown kind", i)
+		}
+	}
+
+	g.Groups, err = CreateRHStoreFile(pathPrefix, options)
+	if err != nil {
+		g.Close()
+
+		return nil, err
+	}
+
+	g.Merge = g.merge
+
+	return g, nil
+}
+
+// Close releases the resources of the GroupBy.
+func (g *GroupBy) Close() error {
+	if g.Groups != nil {
+		g.Groups.Close()
+		g.Groups = nil
+	}
+
+	if g.Distincts != nil {
+		g.Distincts.Close()
+		g.Distincts = nil
+	}
+
+	return nil
+}
+
+// Add aggregates a row into its group.
+func (g *GroupBy) Add(row []byte) error {
+	key := g.Key(row)
+
+	g.Temp = g.Temp[:0]
+
+	for i := range g.Aggregators {
+		a := &g.Aggregators[i]
+
+		switch a.Kind {
+		case AggCount:
+			g.Temp = AppendUint64(g.Temp, 1)
+
+		case AggSum, AggMin, AggMax:
+			g.Temp = appendFloat64(g.Temp, a.Value(row))
+
+		case AggAvg:
+			g.Temp = appendFloat64(g.Temp, a.Value(row))
+			g.Temp = AppendUint64(g.Temp, 1)
+
+		case AggCountDistinct:
+			var buf [binary.MaxVarintLen64]byte
+
+			g.TempDistinct = g.TempDistinct[:0]
+
+			n := binary.PutUvarint(buf[:], uint64(i))
+			g.TempDistinct = append(g.TempDistinct, buf[:n]...)
+
+			n = binary.PutUvarint(buf[:], uint64(len(key)))
+			g.TempDistinct = append(g.TempDistinct, buf[:n]...)
+			g.TempDistinct = append(g.TempDistinct, key...)
+			g.TempDistinct = append(g.TempDistinct, a.Distinct(row)...)
+
+			firstSeen, err := g.Distincts.Add(g.TempDistinct)
+			if err != nil {
+				return err
+			}
+
+			if firstSeen {
+				g.Temp = AppendUint64(g.Temp, 1)
+			} else {
+				g.Temp = AppendUint64(g.Temp, 0)
+			}
+		}
+	}
+
+	_, err := g.Groups.SetMerge(key, g.Temp, g.Merge)
+
+	return err
+}
+
+// merge is a MergeFunc that combines aggregate states.
+func (g *GroupBy) merge(existing, incoming Val, out []byte) []byte {
+	if existing == nil {
+		return append(out, incoming...)
+	}
+
+	pos := 0
+
+	for i := range g.Aggregators {
+		a := &g.Aggregators[i]
+
+		e, in := existing[pos:pos+8], incoming[pos:pos+8]
+
+		switch a.Kind {
+		case AggCount, AggCountDistinct:
+			out = AppendUint64(out, Uint64(e)+Uint64(in))
+
+		case AggSum:
+			out = appendFloat64(out, float64At(e)+float64At(in))
+
+		case AggMin:
+			out = appendFloat64(out, math.Min(float64At(e), float64At(in)))
+
+		case AggMax:
+			out = appendFloat64(out, math.Max(float64At(e), float64At(in)))
+
+		case AggAvg:
+			out = appendFloat64(out, float64At(e)+float64At(in))
+			out = AppendUint64(out,
+				Uint64(existing[pos+8:pos+16])+Uint64(incoming[pos+8:pos+16]))
+		}
+
+		pos += a.stateLen()
+	}
+
+	return out
+}
+
+// Vals decodes the aggregate states of a group into the aggregate
+// values, appending them to out.
+func (g *GroupBy) Vals(state []byte, out []float64) []float64 {
+	pos := 0
+
+	for i := range g.Aggregators {
+		a := &g.Aggregators[i]
+
+		switch a.Kind {
+		case AggCount, AggCountDistinct:
+			out = append(out, float64(Uint64(state[pos:pos+8])))
+
+		case AggSum, AggMin, AggMax:
+			out = append(out, float64At(state[pos:pos+8]))
+
+		case AggAvg:
+			out = append(out, float64At(state[pos:pos+8])/
+				float64(Uint64(state[pos+8:pos+16])))
+		}
+
+		pos += a.stateLen()
+	}
+
+	return out
+}
+
+func appendFloat64(out []byte, f float64) []byte {
+	return AppendUint64(out, math.Float64bits(f))
+}
+
+func float64At(b []byte) float64 {
+	return math.Float64frombits(Uint64(b))
+}
+
+// ---------------------------------------------
+
+// Results returns a streaming iterator over the groups. When sorted
+// is true, the groups are yielded in ascending group key order, by
+// first pushing them onto a Heap that can spill to files.
+func (g *GroupBy) Results(sorted bool) (*GroupByResults, error) {
+	r := &GroupByResults{g: g}
+
+	if !sorted {
+		return r, nil
+	}
+
+	r.Heap = &Heap{
+		LessFunc: func(a, b []byte) bool {
+			return bytes.Compare(resultKey(a), resultKey(b)) < 0
+		},
+		Heap: &Chunks{
+			PathPrefix:        g.Groups.PathPrefix + "_sort",
+			FileSuffix:        g.Groups.Options.FileSuffix,
+			ChunkSizeBytes:    16 * 1024,
+			Quota:             g.Groups.Options.Quota,
+			QuotaOwner:        g.Groups.Options.QuotaOwner,
+			Pool:              g.Groups.Options.ChunkPool,
+			FileIO:            g.Groups.Options.FileIO,
+			FileIOCacheChunks: g.Groups.Options.FileIOCacheChunks,
+			SingleFile:        g.Groups.Options.SingleChunkFile,
+		},
+		Data: &Chunks{
+			PathPrefix:        g.Groups.PathPrefix + "_sortData",
+			FileSuffix:        g.Groups.Options.FileSuffix,
+			ChunkSizeBytes:    g.Groups.Options.ChunkSizeBytes,
+			Quota:             g.Groups.Options.Quota,
+			QuotaOwner:        g.Groups.Options.QuotaOwner,
+			Pool:              g.Groups.Options.ChunkPool,
+			FileIO:            g.Groups.Options.FileIO,
+			FileIOCacheChunks: g.Groups.Options.FileIOCacheChunks,
+			SingleFile:        g.Groups.Options.SingleChunkFile,
+		},
+	}
+
+	var rec []byte
+
+	err := g.Groups.Visit(func(k Key, v Val) bool {
+		rec = AppendLogRecord(rec[:0], k, v)
+
+		heap.Push(r.Heap, rec)
+
+		return r.Heap.Err == nil
+	})
+	if err == nil {
+		err = r.Heap.Err
+	}
+	if err != nil {
+		r.Close()
+
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// resultKey returns the group key of a sorted results record, which
+// is a log record of the key and its aggregate states.
+func resultKey(rec []byte) []byte {
+	k, _, _ := DecodeLogRecord(rec)
+
+	return k
+}
+
+// GroupByResults is a streaming iterator over the groups of a GroupBy.
+type GroupByResults struct {
+	g *GroupBy
+
+	// Idx is the next slot to be examined when unsorted, including
+	// the Old slots of an incremental grow.
+	Idx int
+
+	// Heap holds the groups when sorted.
+	Heap *Heap
+
+	// Vals is reused across calls to Next().
+	Vals []float64
+}
+
+// Next returns the next group key and its aggregate values, in the
+// same order as the Aggregators. The returned slices are only valid
+// until the next call to Next(). A nil key means the iteration is
+// done.
+func (r *GroupByResults) Next() (Key, []float64, error) {
+	if r.Heap != nil {
+		if r.Heap.CurItems <= 0 {
+			return nil, nil, nil
+		}
+
+		rec, _ := heap.Pop(r.Heap).([]byte)
+		if r.Heap.Err != nil {
+			return nil, nil, r.Heap.Err
+		}
+
+		key := resultKey(rec)
+
+		state := rec[len(rec)-r.stateLen():]
+
+		r.Vals = r.g.Vals(state, r.Vals[:0])
+
+		return key, r.Vals, nil
+	}
+
+	m := &r.g.Groups.RHStore
+
+	for {
+		if r.Idx >= m.Size {
+			// Also visit the Old slots of an incremental grow.
+			if m.Old == nil || r.Idx >= m.Size+m.Old.Size {
+				break
+			}
+		}
+
+		item, itemStore := r.item(m)
+
+		r.Idx++
+
+		if _, kSize := item.KeyOffsetSize(); kSize == 0 {
+			continue
+		}
+
+		key, err := itemStore.ItemKey(item)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		state, err := itemStore.ItemVal(item)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		r.Vals = r.g.Vals(state, r.Vals[:0])
+
+		return key, r.Vals, nil
+	}
+
+	return nil, nil, nil
+}
+
+// item returns the Idx'th item, where the Idx continues on from the
+// Slots into the Old slots, along with the RHStore that holds it.
+func (r *GroupByResults) item(m *RHStore) (Item, *RHStore) {
+	if r.Idx < m.Size {
+		return m.Item(r.Idx), m
+	}
+
+	return m.Old.Item(r.Idx - m.Size), m.Old
+}
+
+func (r *GroupByResults) stateLen() (rv int) {
+	for i := range r.g.Aggregators {
+		rv += r.g.Aggregators[i].stateLen()
+	}
+
+	return rv
+}
+
+// Close releases the resources of the iterator.
+func (r *GroupByResults) Close() error {
+	if r.Heap != nil {
+		r.Heap.Close()
+		r.Heap = nil
+	}
+
+	return nil
+}
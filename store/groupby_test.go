@@ -0,0 +1,140 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGroupBy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testGroupBy")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 256
+
+	// Rows are CSV-like "group,value,color".
+	field := func(row []byte, i int) []byte {
+		return bytes.Split(row, []byte(","))[i]
+	}
+
+	value := func(row []byte) float64 {
+		f, _ := strconv.ParseFloat(string(field(row, 1)), 64)
+		return f
+	}
+
+	g, err := CreateGroupBy(dir+"/test",
+		func(row []byte) []byte { return field(row, 0) },
+		[]Aggregator{
+			{Kind: AggCount},
+			{Kind: AggSum, Value: value},
+			{Kind: AggMin, Value: value},
+			{Kind: AggMax, Value: value},
+			{Kind: AggAvg, Value: value},
+			{Kind: AggCountDistinct,
+				Distinct: func(row []byte) []byte { return field(row, 2) }},
+		}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer g.Close()
+
+	numGroups := 50
+
+	expected := map[string][]float64{}
+	colors := map[string]map[string]bool{}
+
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("g%02d", i%numGroups)
+		v := float64(i % 37)
+		c := fmt.Sprintf("c%d", i%3)
+
+		err = g.Add([]byte(k + "," + strconv.Itoa(i%37) + "," + c))
+		if err != nil {
+			t.Fatalf("i: %d, err: %v", i, err)
+		}
+
+		e := expected[k]
+		if e == nil {
+			e = []float64{0, 0, v, v, 0, 0}
+			expected[k] = e
+			colors[k] = map[string]bool{}
+		}
+
+		e[0]++
+		e[1] += v
+		if v < e[2] {
+			e[2] = v
+		}
+		if v > e[3] {
+			e[3] = v
+		}
+		e[4] = e[1] / e[0]
+
+		colors[k][c] = true
+		e[5] = float64(len(colors[k]))
+	}
+
+	for _, sorted := range []bool{false, true} {
+		r, err := g.Results(sorted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var prevKey string
+
+		n := 0
+
+		for {
+			k, vals, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k == nil {
+				break
+			}
+
+			n++
+
+			if sorted && strings.Compare(prevKey, string(k)) >= 0 {
+				t.Fatalf("expected sorted, prevKey: %s, k: %s", prevKey, k)
+			}
+			prevKey = string(k)
+
+			e := expected[string(k)]
+			if fmt.Sprintf("%v", vals) != fmt.Sprintf("%v", e) {
+				t.Fatalf("sorted: %t, k: %s, vals: %v, expected: %v",
+					sorted, k, vals, e)
+			}
+		}
+
+		if n != numGroups {
+			t.Fatalf("sorted: %t, n: %d, expected: %d", sorted, n, numGroups)
+		}
+
+		r.Close()
+	}
+
+	_, err = CreateGroupBy(dir+"/bad", nil,
+		[]Aggregator{{Kind: AggSum}}, options)
+	if err == nil {
+		t.Fatalf("expected err on missing Value")
+	}
+}
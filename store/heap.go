@@ -28,10 +28,11 @@ type BytesLessFunc func(a, b []byte) bool
 // Heap provides a min-heap using a given BytesLessFunc. When the
 // min-heap grows too large, it will automatically spill data to
 // temporary, mmap()'ed files based on the features from
-// rhmap/store/Chunks. The implementation is meant to be used with
-// golang's container/heap package. The implementation is not
-// concurrent safe. The implementation is designed to avoid
-// allocations and reuse existing []byte buffers when possible.
+// rhmap/store/Chunks, or to any other ByteStore. The implementation
+// is meant to be used with golang's container/heap package. The
+// implementation is not concurrent safe. The implementation is
+// designed to avoid allocations and reuse existing []byte buffers
+// when possible.
 //
 // The heap can also be used directly with the PushBytes() API without
 // using golang's container/heap package, in which case this data
@@ -47,18 +48,24 @@ type Heap struct {
 	MaxItems int64
 
 	// Heap is a min-heap of offset (uint64) and size (uint64) pairs,
-	// which refer into the Data. The Chunks of the Heap must be
+	// which refer into the Data. When the Heap is a Chunks, it must be
 	// configured with a ChunksSizeBytes that's a multiple of 16.
-	Heap *Chunks
+	Heap ByteStore
 
-	// Data represents the application data items held in chunks,
-	// where each item is prefixed by its length as a uint64.
-	Data *Chunks
+	// Data represents the application data items held in a ByteStore,
+	// such as Chunks, where each item is prefixed by its length as a
+	// uint64.
+	Data ByteStore
 
 	// Free represents unused but reusable slices in the Data. The
-	// free list is appended to as items are popped from the heap.
+	// free list is appended to as items are popped from the heap. When
+	// the Data is an Allocator, such as Chunks, the Data's own free
+	// space is used instead, and Free remains empty.
 	Free []OffsetSize
 
+	// sorting is true during Sort(), whose popped items stay in use.
+	sorting bool
+
 	// Temp is used during mutations.
 	Temp []byte
 
@@ -85,11 +92,38 @@ func (h *Heap) Reset() error {
 
 	h.Free = h.Free[:0]
 
+	// The heap is again accessed randomly by pushes and pops.
+	h.advise(AdviseRandom)
+
 	h.Err = nil
 
 	return nil
 }
 
+// Flush writes the Data to disk before the Heap, when they're
+// Flusher's, so that with FlushSync the flushed Heap never refers to
+// items that are not yet on disk.
+func (h *Heap) Flush(mode FlushMode) error {
+	for _, bs := range []ByteStore{h.Data, h.Heap} {
+		if f, ok := bs.(Flusher); ok {
+			err := f.Flush(mode)
+			if err != nil {
+				return h.Error(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// advise passes an access pattern hint to the Heap, when it's an
+// Adviser.
+func (h *Heap) advise(advice Advice) {
+	if a, ok := h.Heap.(Adviser); ok {
+		a.Advise(advice)
+	}
+}
+
 // Error records the first error encountered.
 func (h *Heap) Error(err error) error {
 	if h.Err == nil {
@@ -126,15 +160,12 @@ func (h *Heap) GetOffsetSize(i int64) ([]byte, uint64, uint64, error) {
 }
 
 func (h *Heap) SetOffsetSize(i int64, offset, size uint64) error {
-	b, err := h.Heap.BytesRead(uint64(i*16), 16)
-	if err != nil {
-		return err
-	}
+	var buf [16]byte
 
-	binary.LittleEndian.PutUint64(b[:8], offset)
-	binary.LittleEndian.PutUint64(b[8:], size)
+	binary.LittleEndian.PutUint64(buf[:8], offset)
+	binary.LittleEndian.PutUint64(buf[8:], size)
 
-	return nil
+	return h.Heap.BytesWrite(uint64(i*16), buf[:])
 }
 
 // ------------------------------------------------------
@@ -154,11 +185,19 @@ func (h *Heap) Swap(i, j int) {
 		return
 	}
 
-	var buf [16]byte
+	// The ByteStore might return copies, so swap via BytesWrite().
+	var buf [32]byte
+
+	copy(buf[:16], ibuf)
+	copy(buf[16:], jbuf)
 
-	copy(buf[:], ibuf)
-	copy(ibuf, jbuf)
-	copy(jbuf, buf[:])
+	err = h.Heap.BytesWrite(uint64(i*16), buf[16:])
+	if err == nil {
+		err = h.Heap.BytesWrite(uint64(j*16), buf[:16])
+	}
+	if err != nil {
+		h.Error(err)
+	}
 }
 
 func (h *Heap) Less(i, j int) bool {
@@ -175,8 +214,9 @@ func (h *Heap) Less(i, j int) bool {
 	return h.LessFunc(iv, jv)
 }
 
-// Push will error if the incoming "data length + 8" is greater than
-// the configured ChunkSizeBytes of the heap's data chunks.
+// Push records any error into h.Err. An incoming data item whose
+// "data length + 8" is greater than the configured ChunkSizeBytes of
+// the heap's data chunks will span multiple data chunks.
 func (h *Heap) Push(x interface{}) { h.PushBytes(x.([]byte)) }
 
 // PushBytes is more direct than Push, avoiding interface{} casting.
@@ -194,6 +234,14 @@ func (h *Heap) PushBytes(xbytes []byte) error {
 	var found bool
 	var err error
 
+	if a, ok := h.Data.(Allocator); ok {
+		size = uint64(len(h.Temp))
+
+		offset, err = a.Alloc(size)
+
+		found = err == nil
+	}
+
 	for i, offsetSize := range h.Free {
 		// NOTE: This simple, greedy approach of taking the first free
 		// entry where the incoming bytes will fit can lead to
@@ -210,21 +258,16 @@ func (h *Heap) PushBytes(xbytes []byte) error {
 	}
 
 	// Copy or append the data.
-	var b []byte
-
 	if found {
-		b, err = h.Data.BytesRead(offset, size)
-		if err == nil {
-			copy(b, h.Temp)
-		}
-	} else {
+		err = h.Data.BytesWrite(offset, h.Temp)
+	} else if err == nil {
 		offset, size, err = h.Data.BytesAppend(h.Temp)
 	}
 
 	// Push the item's offset+size into the heap.
 	if err == nil {
 		if h.CurItems < h.MaxItems {
-			h.SetOffsetSize(h.CurItems, offset, size)
+			err = h.SetOffsetSize(h.CurItems, offset, size)
 		} else {
 			binary.LittleEndian.PutUint64(buf[:8], offset)
 			binary.LittleEndian.PutUint64(buf[8:], size)
@@ -258,6 +301,19 @@ func (h *Heap) Pop() interface{} {
 	// NOTE: We immediately recycle data space used by rv, and for
 	// this to work, the application is expected to copy rv if it
 	// needs to hold onto that data before the next mutation.
+	if h.sorting {
+		return rv // The item is placed back into the heap slots.
+	}
+
+	if a, ok := h.Data.(Allocator); ok {
+		err = a.Free(offset, size)
+		if err != nil {
+			h.Error(err)
+		}
+
+		return rv
+	}
+
 	h.Free = append(h.Free, OffsetSize{offset, size})
 
 	return rv
@@ -270,7 +326,15 @@ func (h *Heap) Pop() interface{} {
 // slots. This approach does not allocate additional space. If there
 // are n items in the heap, then n-offset items will be left sorted at
 // the end of the heap slots. An offset of 0 sorts the entire heap.
+// As the sorted items are usually then read in order, the heap slots
+// are afterwards advised as sequential until the next Reset().
 func (h *Heap) Sort(offset int64) error {
+	h.sorting = true
+	defer func() { h.sorting = false }()
+
+	h.advise(AdviseRandom)
+	defer h.advise(AdviseSequential)
+
 	for i := h.CurItems - 1; i >= offset; i-- {
 		_, offset, size, err := h.GetOffsetSize(0)
 		if err != nil {
@@ -282,8 +346,6 @@ func (h *Heap) Sort(offset int64) error {
 			return h.Err
 		}
 
-		h.Free = h.Free[:0]
-
 		err = h.SetOffsetSize(i, offset, size)
 		if err != nil {
 			return h.Error(err)
@@ -32,6 +32,10 @@ func TestSize10000x1000x1000(t *testing.T) {
 	testHeap(t, 10000, 1000*16, 1000*16)
 }
 
+func TestSize100x10xSpanning(t *testing.T) {
+	testHeap(t, 100, 10*16, 5)
+}
+
 func testHeap(t *testing.T, amount,
 	heapChunkSizeBytes, dataChunkSizeBytes int) {
 	dir, _ := ioutil.TempDir("", "testHeap")
@@ -125,3 +129,38 @@ func testHeap(t *testing.T, amount,
 
 	popAll()
 }
+
+func TestHeapFlush(t *testing.T) {
+	var flushes []string
+
+	faultByteStore := func(name string) *FaultByteStore {
+		return &FaultByteStore{
+			Fault: func(op string, offset, size uint64) error {
+				if op == "Flush" {
+					flushes = append(flushes, name)
+				}
+				return nil
+			},
+		}
+	}
+
+	h := &Heap{
+		LessFunc: func(a, b []byte) bool { return bytes.Compare(a, b) < 0 },
+		Heap:     faultByteStore("heap"),
+		Data:     faultByteStore("data"),
+	}
+
+	defer h.Close()
+
+	for i := 0; i < 10; i++ {
+		heap.Push(h, []byte(fmt.Sprintf("%d", i)))
+	}
+
+	if err := h.Flush(FlushSync); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprintf("%v", flushes) != "[data heap]" {
+		t.Fatalf("expected data flushed before heap, got: %v", flushes)
+	}
+}
@@ -0,0 +1,540 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Package join provides a hash join operator that's built on the
+// spillable data structures of the rhmap/store package.
+package join
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/couchbase/rhmap/store"
+)
+
+// Source produces key/row records by invoking the callback on each
+// record, until the source is exhausted or the callback returns false.
+// The key/row slices are only valid during the callback.
+type Source func(callback func(key, row []byte) (keepGoing bool)) error
+
+// Kind is the kind of join.
+type Kind int
+
+const (
+	// Inner emits every matching pair of build and probe rows.
+	Inner Kind = iota
+
+	// LeftOuter emits every matching pair of build and probe rows,
+	// and also emits each unmatched probe row with a nil build row.
+	LeftOuter
+
+	// Semi emits each probe row that has at least one matching build
+	// row, once, with a nil build row.
+	Semi
+
+	// Anti emits each probe row that has no matching build row, with
+	// a nil build row.
+	Anti
+)
+
+// Options represents the configurable options of a join.
+type Options struct {
+	// Kind is the kind of join.
+	Kind Kind
+
+	// PathPrefix is the path prefix of any spilled files.
+	PathPrefix string
+
+	// MemoryBudgetBytes is the budget for the key/row bytes of the
+	// build side, beyond which both the build and probe sides are
+	// spilled by hash partition and joined a partition at a time.
+	MemoryBudgetBytes int
+
+	// NumPartitions is the number of hash partitions used when the
+	// join spills. A partition whose build records still exceed the
+	// MemoryBudgetBytes is repartitioned by a differently seeded hash,
+	// up to MaxRepartitions times, after which it's joined whole, as
+	// the records of a single, skewed key cannot be split apart.
+	NumPartitions int
+
+	// StoreOptions are used for the RHStoreFile of each build table.
+	StoreOptions store.RHStoreFileOptions
+}
+
+// MaxRepartitions is the max number of times that the records of a
+// partition are repartitioned. See Options.NumPartitions.
+const MaxRepartitions = 3
+
+// DefaultOptions are the default values for options.
+var DefaultOptions = Options{
+	Kind:              Inner,
+	MemoryBudgetBytes: 64 * 1024 * 1024, // 64MB.
+	NumPartitions:     16,
+	StoreOptions:      store.DefaultRHStoreFileOptions,
+}
+
+// ---------------------------------------------
+
+// Join performs a hash join, where the build source is loaded into a
+// hash table and then the probe source is streamed against it. The
+// emit callback is invoked with the join key and the build and probe
+// rows, whose slices are only valid during the callback. The emit
+// callback can return an error to stop the join early.
+func Join(build, probe Source, options Options,
+	emit func(key, buildRow, probeRow []byte) error) error {
+	j := &joiner{options: options, emit: emit}
+
+	defer j.close()
+
+	return j.run(build, probe)
+}
+
+// ---------------------------------------------
+
+type joiner struct {
+	options Options
+
+	emit func(key, buildRow, probeRow []byte) error
+
+	// table is the build table while the join has not spilled.
+	table *table
+
+	// tableBytes is the number of key/row bytes in the table.
+	tableBytes int
+
+	// buildLogs and probeLogs hold the partitioned build and probe
+	// records once the join has spilled.
+	buildLogs, probeLogs []*store.Heap
+
+	// repartitions counts the partitions that were repartitioned.
+	repartitions int
+
+	// hash returns the hash of a key, where each seed, which is the
+	// depth of repartitioning, leads to a different partitioning.
+	hash func(seed int, b []byte) uint32
+
+	temp []byte
+
+	err error
+}
+
+func (j *joiner) run(build, probe Source) (err error) {
+	if j.options.NumPartitions <= 0 {
+		return fmt.Errorf("join: NumPartitions must be > 0")
+	}
+
+	h := fnv.New32() // Not fnv.New32a(), which the tables use.
+
+	var seedBuf [1]byte
+
+	j.hash = func(seed int, b []byte) uint32 {
+		h.Reset()
+		if seed > 0 {
+			seedBuf[0] = byte(seed)
+			h.Write(seedBuf[:])
+		}
+		h.Write(b)
+		return h.Sum32()
+	}
+
+	j.table, err = j.newTable(j.options.PathPrefix + "_build")
+	if err != nil {
+		return err
+	}
+
+	err = build(func(key, row []byte) bool {
+		if j.table != nil {
+			j.err = j.table.add(key, row)
+
+			j.tableBytes += len(key) + len(row)
+			if j.err == nil && j.tableBytes > j.options.MemoryBudgetBytes {
+				j.err = j.spill()
+			}
+		} else {
+			j.err = j.appendLog(j.buildLogs, 0, key, row)
+		}
+
+		return j.err == nil
+	})
+	if err != nil || j.err != nil {
+		return firstErr(err, j.err)
+	}
+
+	if j.table != nil {
+		err = probe(func(key, row []byte) bool {
+			j.err = j.probe(j.table, key, row)
+			return j.err == nil
+		})
+
+		return firstErr(err, j.err)
+	}
+
+	err = probe(func(key, row []byte) bool {
+		j.err = j.appendLog(j.probeLogs, 0, key, row)
+		return j.err == nil
+	})
+	if err != nil || j.err != nil {
+		return firstErr(err, j.err)
+	}
+
+	return j.joinPartitions(j.options.PathPrefix,
+		j.buildLogs, j.probeLogs, 0)
+}
+
+func firstErr(a, b error) error {
+	if a != nil {
+		return a
+	}
+
+	return b
+}
+
+// probe emits the join results for a single probe record.
+func (j *joiner) probe(t *table, key, row []byte) error {
+	matched := false
+
+	err := t.visit(key, func(buildRow []byte) error {
+		matched = true
+
+		if j.options.Kind == Inner || j.options.Kind == LeftOuter {
+			return j.emit(key, buildRow, row)
+		}
+
+		return errStop
+	})
+	if err != nil && err != errStop {
+		return err
+	}
+
+	if matched && j.options.Kind == Semi {
+		return j.emit(key, nil, row)
+	}
+
+	if !matched && (j.options.Kind == LeftOuter || j.options.Kind == Anti) {
+		return j.emit(key, nil, row)
+	}
+
+	return nil
+}
+
+var errStop = errors.New("join: stop")
+
+// ---------------------------------------------
+
+// spill moves the build table's records into the partitioned build
+// logs, so that the rest of the join proceeds a partition at a time.
+func (j *joiner) spill() error {
+	j.buildLogs, j.probeLogs = j.newLogs(j.options.PathPrefix)
+
+	var err error
+
+	errVisit := j.table.index.Visit(func(k store.Key, v store.Val) bool {
+		err = j.table.visit(k, func(buildRow []byte) error {
+			return j.appendLog(j.buildLogs, 0, k, buildRow)
+		})
+
+		return err == nil
+	})
+
+	j.table.close()
+	j.table = nil
+
+	return firstErr(errVisit, err)
+}
+
+// newLogs returns the build and probe logs of NumPartitions
+// partitions.
+func (j *joiner) newLogs(pathPrefix string) (
+	buildLogs, probeLogs []*store.Heap) {
+	for i := 0; i < j.options.NumPartitions; i++ {
+		buildLogs = append(buildLogs,
+			j.newLog(fmt.Sprintf("%s_build_p%04d", pathPrefix, i)))
+		probeLogs = append(probeLogs,
+			j.newLog(fmt.Sprintf("%s_probe_p%04d", pathPrefix, i)))
+	}
+
+	return buildLogs, probeLogs
+}
+
+// joinPartitions joins the partitions a partition at a time, where
+// the depth is the number of times that the partitions were
+// repartitioned.
+func (j *joiner) joinPartitions(pathPrefix string,
+	buildLogs, probeLogs []*store.Heap, depth int) error {
+	for i := range buildLogs {
+		err := j.joinPartition(fmt.Sprintf("%s_build_p%04d", pathPrefix, i),
+			buildLogs[i], probeLogs[i], depth)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// joinPartition joins the build and probe records of a partition,
+// unless its build records exceed the MemoryBudgetBytes, in which case
+// the partition is repartitioned, up to MaxRepartitions times.
+func (j *joiner) joinPartition(pathPrefix string,
+	buildLog, probeLog *store.Heap, depth int) error {
+	t, err := j.newTable(pathPrefix + "_table")
+	if err != nil {
+		return err
+	}
+
+	tableBytes := 0
+
+	err = visitLog(buildLog, func(key, row []byte) error {
+		tableBytes += len(key) + len(row)
+		if tableBytes > j.options.MemoryBudgetBytes &&
+			depth < MaxRepartitions {
+			return errStop
+		}
+
+		return t.add(key, row)
+	})
+	if err == nil {
+		buildLog.Close()
+
+		err = visitLog(probeLog, func(key, row []byte) error {
+			return j.probe(t, key, row)
+		})
+	}
+
+	t.close()
+
+	if err == errStop {
+		return j.repartition(pathPrefix, buildLog, probeLog, depth+1)
+	}
+
+	return err
+}
+
+// repartition splits the build and probe records of a partition into
+// NumPartitions partitions, by the hash with the next depth as its
+// seed, and then joins those partitions.
+func (j *joiner) repartition(pathPrefix string,
+	buildLog, probeLog *store.Heap, depth int) error {
+	j.repartitions++
+
+	buildLogs, probeLogs := j.newLogs(pathPrefix)
+
+	defer func() {
+		for i := range buildLogs {
+			buildLogs[i].Close()
+			probeLogs[i].Close()
+		}
+	}()
+
+	err := visitLog(buildLog, func(key, row []byte) error {
+		return j.appendLog(buildLogs, depth, key, row)
+	})
+	if err != nil {
+		return err
+	}
+
+	buildLog.Close()
+
+	err = visitLog(probeLog, func(key, row []byte) error {
+		return j.appendLog(probeLogs, depth, key, row)
+	})
+	if err != nil {
+		return err
+	}
+
+	probeLog.Close()
+
+	return j.joinPartitions(pathPrefix, buildLogs, probeLogs, depth)
+}
+
+func (j *joiner) close() {
+	if j.table != nil {
+		j.table.close()
+	}
+
+	for _, log := range j.buildLogs {
+		log.Close()
+	}
+
+	for _, log := range j.probeLogs {
+		log.Close()
+	}
+}
+
+// ---------------------------------------------
+
+func (j *joiner) newLog(pathPrefix string) *store.Heap {
+	options := &j.options.StoreOptions
+
+	return &store.Heap{
+		Heap: &store.Chunks{
+			PathPrefix:        pathPrefix,
+			FileSuffix:        options.FileSuffix,
+			ChunkSizeBytes:    16 * 1024,
+			Quota:             options.Quota,
+			QuotaOwner:        options.QuotaOwner,
+			Pool:              options.ChunkPool,
+			FileIO:            options.FileIO,
+			FileIOCacheChunks: options.FileIOCacheChunks,
+			SingleFile:        options.SingleChunkFile,
+		},
+		Data: &store.Chunks{
+			PathPrefix:        pathPrefix + "_data",
+			FileSuffix:        options.FileSuffix,
+			ChunkSizeBytes:    options.ChunkSizeBytes,
+			Quota:             options.Quota,
+			QuotaOwner:        options.QuotaOwner,
+			Pool:              options.ChunkPool,
+			FileIO:            options.FileIO,
+			FileIOCacheChunks: options.FileIOCacheChunks,
+			SingleFile:        options.SingleChunkFile,
+		},
+	}
+}
+
+// appendLog appends a record to the log of the key's partition, where
+// the record is a log record of the key/row. See AppendLogRecord().
+func (j *joiner) appendLog(logs []*store.Heap, seed int,
+	key, row []byte) error {
+	j.temp = store.AppendLogRecord(j.temp[:0], key, row)
+
+	return logs[j.hash(seed, key)%uint32(len(logs))].PushBytes(j.temp)
+}
+
+// visitLog invokes the callback on each record of a log.
+func visitLog(log *store.Heap, callback func(key, row []byte) error) error {
+	for i := int64(0); i < log.CurItems; i++ {
+		rec, err := log.Get(i)
+		if err != nil {
+			return err
+		}
+
+		key, row, err := store.DecodeLogRecord(rec)
+		if err != nil {
+			return err
+		}
+
+		err = callback(key, row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------
+
+// table is a multimap from a key to its build rows, where the rows
+// are appended to a heap used as a sequence, with each row record
+// prefixed by the 1-based position of the previous row of the same
+// key. The index maps each key to the 1-based position of its latest
+// row, as an inlined val.
+type table struct {
+	index *store.RHStoreFile
+
+	rows *store.Heap
+
+	temp []byte
+}
+
+func (j *joiner) newTable(pathPrefix string) (*table, error) {
+	options := j.options.StoreOptions
+	options.InlineVals = true
+
+	index, err := store.CreateRHStoreFile(pathPrefix, options)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := j.newLog(pathPrefix + "_rows")
+
+	// The rows are kept in memory within the MemoryBudgetBytes, as
+	// the build side only spills to files beyond the budget.
+	heapChunks := rows.Heap.(*store.Chunks)
+	dataChunks := rows.Data.(*store.Chunks)
+
+	useMemory := func(size int) (bool, error) {
+		used := heapChunks.MemoryBytes() + dataChunks.MemoryBytes()
+
+		return used+size <= j.options.MemoryBudgetBytes, nil
+	}
+
+	heapChunks.UseMemory = useMemory
+	dataChunks.UseMemory = useMemory
+
+	return &table{index: index, rows: rows}, nil
+}
+
+func (t *table) close() {
+	t.index.Close()
+	t.rows.Close()
+}
+
+func (t *table) add(key, row []byte) error {
+	e, err := t.index.Find(key)
+	if err != nil {
+		return err
+	}
+
+	var prev uint64
+	if e != nil {
+		v, err := t.index.ItemVal(e)
+		if err != nil {
+			return err
+		}
+
+		prev = store.Uint64(v)
+	}
+
+	t.temp = store.AppendUint64(t.temp[:0], prev)
+	t.temp = append(t.temp, row...)
+
+	err = t.rows.PushBytes(t.temp)
+	if err != nil {
+		return err
+	}
+
+	t.temp = store.AppendUint64(t.temp[:0], uint64(t.rows.CurItems))
+
+	if e != nil {
+		return t.index.SetItemVal(e, t.temp)
+	}
+
+	_, err = t.index.Set(key, t.temp)
+
+	return err
+}
+
+// visit invokes the callback on each build row of a key.
+func (t *table) visit(key []byte, callback func(row []byte) error) error {
+	v, found := t.index.Get(key)
+	if !found {
+		return nil
+	}
+
+	for pos := store.Uint64(v); pos > 0; {
+		rec, err := t.rows.Get(int64(pos - 1))
+		if err != nil {
+			return err
+		}
+
+		pos = store.Uint64(rec[:8])
+
+		err = callback(rec[8:])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package join
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/couchbase/rhmap/store"
+)
+
+type record struct {
+	key, row string
+}
+
+func sliceSource(records []record) Source {
+	return func(callback func(key, row []byte) bool) error {
+		for _, r := range records {
+			if !callback([]byte(r.key), []byte(r.row)) {
+				break
+			}
+		}
+		return nil
+	}
+}
+
+// nestedLoopJoin is the expected results of a join, computed naively.
+func nestedLoopJoin(kind Kind, build, probe []record) (rv []string) {
+	for _, p := range probe {
+		matched := false
+
+		for _, b := range build {
+			if b.key == p.key {
+				if kind == Inner || kind == LeftOuter {
+					rv = append(rv, p.key+"|"+b.row+"|"+p.row)
+				}
+				matched = true
+			}
+		}
+
+		if (matched && kind == Semi) ||
+			(!matched && (kind == LeftOuter || kind == Anti)) {
+			rv = append(rv, p.key+"||"+p.row)
+		}
+	}
+
+	sort.Strings(rv)
+
+	return rv
+}
+
+func testRecords(n, numKeys int, prefix string) (rv []record) {
+	for i := 0; i < n; i++ {
+		rv = append(rv, record{
+			key: fmt.Sprintf("k%d", (i*7)%numKeys),
+			row: fmt.Sprintf("%s%d", prefix, i),
+		})
+	}
+	return rv
+}
+
+func TestJoin(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testJoin")
+	defer os.RemoveAll(dir)
+
+	build := testRecords(300, 100, "b")
+	probe := testRecords(200, 150, "p")
+
+	for _, budget := range []int{1000000, 500, 0} {
+		for _, kind := range []Kind{Inner, LeftOuter, Semi, Anti} {
+			options := DefaultOptions
+			options.Kind = kind
+			options.PathPrefix = fmt.Sprintf("%s/j_%d_%d", dir, budget, kind)
+			options.MemoryBudgetBytes = budget
+			options.NumPartitions = 4
+			options.StoreOptions.StartSize = 10
+			options.StoreOptions.ChunkSizeBytes = 256
+
+			var got []string
+
+			err := Join(sliceSource(build), sliceSource(probe), options,
+				func(key, buildRow, probeRow []byte) error {
+					got = append(got,
+						string(key)+"|"+string(buildRow)+"|"+string(probeRow))
+					return nil
+				})
+			if err != nil {
+				t.Fatalf("budget: %d, kind: %d, err: %v", budget, kind, err)
+			}
+
+			sort.Strings(got)
+
+			expected := nestedLoopJoin(kind, build, probe)
+			if len(expected) == 0 {
+				t.Fatalf("kind: %d, expected some results", kind)
+			}
+
+			if len(got) != len(expected) {
+				t.Fatalf("budget: %d, kind: %d, got: %d, expected: %d",
+					budget, kind, len(got), len(expected))
+			}
+
+			for i := range got {
+				if got[i] != expected[i] {
+					t.Fatalf("budget: %d, kind: %d, i: %d, got: %s, expected: %s",
+						budget, kind, i, got[i], expected[i])
+				}
+			}
+		}
+	}
+}
+
+func TestJoinEmitError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testJoin")
+	defer os.RemoveAll(dir)
+
+	options := DefaultOptions
+	options.PathPrefix = dir + "/j"
+
+	errStopped := errors.New("stopped")
+
+	n := 0
+
+	err := Join(sliceSource(testRecords(10, 5, "b")),
+		sliceSource(testRecords(10, 5, "p")), options,
+		func(key, buildRow, probeRow []byte) error {
+			n++
+			return errStopped
+		})
+	if err != errStopped || n != 1 {
+		t.Fatalf("expected errStopped after 1 emit, got: %v, %d", err, n)
+	}
+
+	options.NumPartitions = 0
+
+	err = Join(sliceSource(nil), sliceSource(nil), options,
+		func(key, buildRow, probeRow []byte) error { return nil })
+	if err == nil {
+		t.Fatalf("expected err on 0 NumPartitions")
+	}
+}
+
+func TestJoinStoreOptions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testJoin")
+	defer os.RemoveAll(dir)
+
+	build := testRecords(300, 100, "b")
+	probe := testRecords(200, 150, "p")
+
+	expected := nestedLoopJoin(Inner, build, probe)
+
+	for _, fileIO := range []bool{false, true} {
+		pool := store.NewChunkPool(fmt.Sprintf("%s/pool_%t", dir, fileIO), "", 4)
+
+		options := DefaultOptions
+		options.PathPrefix = fmt.Sprintf("%s/j_%t", dir, fileIO)
+		options.MemoryBudgetBytes = 0
+		options.NumPartitions = 4
+		options.StoreOptions.StartSize = 10
+		options.StoreOptions.ChunkSizeBytes = 256
+		options.StoreOptions.ChunkPool = pool
+		options.StoreOptions.FileIO = fileIO
+
+		// The tables stay in memory, so only the logs and rows of the
+		// spilled join use chunk files.
+		options.StoreOptions.MemoryBudgetBytes = 1000000
+
+		var got []string
+
+		err := Join(sliceSource(build), sliceSource(probe), options,
+			func(key, buildRow, probeRow []byte) error {
+				got = append(got,
+					string(key)+"|"+string(buildRow)+"|"+string(probeRow))
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("fileIO: %t, err: %v", fileIO, err)
+		}
+
+		sort.Strings(got)
+
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("fileIO: %t, got: %v, expected: %v", fileIO, got, expected)
+		}
+
+		// The logs use the ChunkPool, except in the FileIO mode, whose
+		// chunk files are never mmap()'ed.
+		created := pool.Stats().Created
+		if (fileIO && created != 0) || (!fileIO && created == 0) {
+			t.Fatalf("fileIO: %t, pool created: %d", fileIO, created)
+		}
+
+		pool.Close()
+	}
+}
+
+func TestJoinRepartition(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testJoin")
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		about        string
+		build        []record
+		repartitions int
+	}{
+		// Too few partitions for the data, which repartitioning fixes.
+		{"few partitions", testRecords(300, 100, "b"), 2},
+
+		// A single, skewed key, which repartitioning cannot split, so
+		// it's repartitioned MaxRepartitions times and joined whole.
+		{"skewed key", testRecords(300, 1, "b"), MaxRepartitions},
+	}
+
+	for ti, test := range tests {
+		probe := testRecords(200, 150, "p")
+
+		options := DefaultOptions
+		options.PathPrefix = fmt.Sprintf("%s/j_%d", dir, ti)
+		options.MemoryBudgetBytes = 600
+		options.NumPartitions = 2
+		options.StoreOptions.StartSize = 10
+		options.StoreOptions.ChunkSizeBytes = 256
+
+		var got []string
+
+		j := &joiner{options: options,
+			emit: func(key, buildRow, probeRow []byte) error {
+				got = append(got,
+					string(key)+"|"+string(buildRow)+"|"+string(probeRow))
+				return nil
+			}}
+
+		err := j.run(sliceSource(test.build), sliceSource(probe))
+		j.close()
+		if err != nil {
+			t.Fatalf("%s, err: %v", test.about, err)
+		}
+
+		sort.Strings(got)
+
+		expected := nestedLoopJoin(Inner, test.build, probe)
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("%s, got: %d, expected: %d",
+				test.about, len(got), len(expected))
+		}
+
+		if j.repartitions < test.repartitions {
+			t.Fatalf("%s, expected repartitions >= %d, got: %d",
+				test.about, test.repartitions, j.repartitions)
+		}
+
+		files, _ := filepath.Glob(options.PathPrefix + "*")
+		if len(files) != 0 {
+			t.Fatalf("%s, expected no files, got: %v", test.about, files)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// +build !windows
+
+package store
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// LockFile acquires an exclusive, advisory lock on the file without
+// blocking, returning ErrLocked if the lock is held by another owner.
+// The lock is released by the operating system when the owning
+// process exits.
+func LockFile(f *os.File) error {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		return ErrLocked
+	}
+
+	return err
+}
+
+// UnlockFile releases a lock acquired by LockFile().
+func UnlockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
+
+// createLockFile creates a file to be locked by LockFile(), which can
+// be renamed while it's open.
+func createLockFile(path string) (*os.File, error) {
+	return os.Create(path)
+}
@@ -0,0 +1,48 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrLogRecordCorrupt is returned when a log record cannot be decoded.
+var ErrLogRecordCorrupt = errors.New("log record corrupt")
+
+// AppendLogRecord appends a key/val record to out, which is encoded as
+// [uvarint len(key)][key][val]. The records are meant to be pushed
+// onto a Heap that's used as an append-only log, such as the logs of a
+// cold partition or of a spilled join.
+func AppendLogRecord(out []byte, k Key, v Val) []byte {
+	var buf [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(buf[:], uint64(len(k)))
+
+	out = append(out, buf[:n]...)
+	out = append(out, k...)
+
+	return append(out, v...)
+}
+
+// DecodeLogRecord returns the key and val of a record that was encoded
+// by AppendLogRecord(), as slices into the record.
+func DecodeLogRecord(rec []byte) (Key, Val, error) {
+	kLen, n := binary.Uvarint(rec)
+	if n <= 0 || kLen > uint64(len(rec)-n) {
+		return nil, nil, ErrLogRecordCorrupt
+	}
+
+	kEnd := n + int(kLen)
+
+	return rec[n:kEnd], rec[kEnd:], nil
+}
@@ -0,0 +1,43 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"testing"
+)
+
+func TestLogRecord(t *testing.T) {
+	for _, kv := range [][2]string{
+		{"k", "v"},
+		{"key", ""},
+		{"", "val"},
+		{string(make([]byte, 300)), "v"}, // Multi-byte uvarint.
+	} {
+		rec := AppendLogRecord([]byte("prefix"), Key(kv[0]), Val(kv[1]))
+
+		k, v, err := DecodeLogRecord(rec[len("prefix"):])
+		if err != nil || string(k) != kv[0] || string(v) != kv[1] {
+			t.Fatalf("kv: %q, got: %q, %q, err: %v", kv, k, v, err)
+		}
+	}
+
+	for _, rec := range [][]byte{
+		nil,
+		{0x80},   // Truncated uvarint.
+		{5, 'k'}, // Key beyond the record.
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+	} {
+		if _, _, err := DecodeLogRecord(rec); err != ErrLogRecordCorrupt {
+			t.Fatalf("rec: %v, expected ErrLogRecordCorrupt, got: %v", rec, err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// MappedFile maps fixed-size windows of one large file on demand, via
+// MMapFileRegion(), so that the data of many chunks can be held in a
+// single file rather than in a file per chunk. The i'th window covers
+// the WindowSize bytes starting at offset i*WindowSize. A MappedFile
+// is concurrent safe.
+//
+// The windows are ref-counted MMapRef's, where the MappedFile holds a
+// ref on each window that it has mapped, and each Window() call adds
+// a ref for the caller, who must DecRef() the window when done. A
+// window is unmapped once the MappedFile releases it, such as via
+// Release(), MaxWindows or Close(), and its last caller DecRef()'s it.
+type MappedFile struct {
+	// Path is the path of the file.
+	Path string
+
+	// File is the file, which is shared by all the windows.
+	File *os.File
+
+	// WindowSize is the size in bytes of each window.
+	WindowSize int
+
+	// MaxWindows, when > 0, is the max number of windows that the
+	// MappedFile keeps mapped, where the least recently used windows
+	// beyond MaxWindows are released.
+	MaxWindows int
+
+	// ReadOnly is true when the windows are mapped read-only, so the
+	// file is not grown.
+	ReadOnly bool
+
+	m sync.Mutex
+
+	windows map[int]*MMapRef // Keyed by window index.
+
+	lru []int // Window indexes, most recently used first.
+
+	size int64 // The file size.
+}
+
+// CreateMappedFile creates a new, empty file whose windows of the
+// given size in bytes are mapped read-write, growing the file as
+// windows beyond its end are requested.
+func CreateMappedFile(path string, windowSize int) (*MappedFile, error) {
+	if windowSize <= 0 {
+		return nil, fmt.Errorf("mmap: MappedFile invalid windowSize: %d",
+			windowSize)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MappedFile{
+		Path:       path,
+		File:       file,
+		WindowSize: windowSize,
+		windows:    map[int]*MMapRef{},
+	}, nil
+}
+
+// OpenMappedFile opens an existing file whose windows of the given size
+// in bytes are mapped on demand, where a read-only MappedFile allows
+// the file to be shared with other processes. The last window might be
+// shorter than the windowSize.
+func OpenMappedFile(path string, windowSize int, readWrite bool) (
+	*MappedFile, error) {
+	if windowSize <= 0 {
+		return nil, fmt.Errorf("mmap: MappedFile invalid windowSize: %d",
+			windowSize)
+	}
+
+	flag := os.O_RDONLY
+	if readWrite {
+		flag = os.O_RDWR
+	}
+
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fstats, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &MappedFile{
+		Path:       path,
+		File:       file,
+		WindowSize: windowSize,
+		ReadOnly:   !readWrite,
+		windows:    map[int]*MMapRef{},
+		size:       fstats.Size(),
+	}, nil
+}
+
+// Size returns the size in bytes of the file.
+func (f *MappedFile) Size() int64 {
+	f.m.Lock()
+	rv := f.size
+	f.m.Unlock()
+
+	return rv
+}
+
+// NumWindows returns the number of windows that the file holds,
+// including a shorter, last window.
+func (f *MappedFile) NumWindows() int {
+	f.m.Lock()
+	rv := int((f.size + int64(f.WindowSize) - 1) / int64(f.WindowSize))
+	f.m.Unlock()
+
+	return rv
+}
+
+// Window returns the i'th window with an added ref, which the caller
+// must DecRef() when done. A read-write MappedFile grows the file, with
+// its disk blocks reserved, when the window is beyond the end of the
+// file.
+func (f *MappedFile) Window(i int) (*MMapRef, error) {
+	if i < 0 {
+		return nil, fmt.Errorf("mmap: MappedFile invalid window: %d", i)
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.File == nil {
+		return nil, fmt.Errorf("mmap: MappedFile Window after Close")
+	}
+
+	if r := f.windows[i]; r != nil {
+		f.touch(i)
+
+		return r.AddRef(), nil
+	}
+
+	offset := int64(i) * int64(f.WindowSize)
+	end := offset + int64(f.WindowSize)
+
+	if end > f.size {
+		if f.ReadOnly {
+			if offset >= f.size {
+				return nil, fmt.Errorf("mmap: MappedFile window: %d"+
+					" beyond file size: %d", i, f.size)
+			}
+
+			end = f.size
+		} else {
+			err := preallocate(f.File, f.size, end-f.size)
+			if err != nil {
+				return nil, err
+			}
+
+			f.size = end
+		}
+	}
+
+	r, err := MMapFileRegion(f.Path, f.File, offset, end-offset, !f.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	// The file is owned by the MappedFile rather than by its windows.
+	r.File = nil
+	r.mappedFile = f
+	r.window = i
+
+	f.windows[i] = r
+
+	f.touch(i)
+
+	return r.AddRef(), nil
+}
+
+// Release drops the MappedFile's ref on the i'th window, which is
+// unmapped once its callers have also DecRef()'ed it. A later Window()
+// maps the window again.
+func (f *MappedFile) Release(i int) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.release(i)
+}
+
+// touch moves the i'th window to the front of the lru, releasing the
+// least recently used windows beyond the MaxWindows, and must be
+// invoked with the mutex held.
+func (f *MappedFile) touch(i int) {
+	if len(f.lru) > 0 && f.lru[0] == i {
+		return
+	}
+
+	f.unlru(i)
+
+	f.lru = append(f.lru, 0)
+	copy(f.lru[1:], f.lru)
+	f.lru[0] = i
+
+	for f.MaxWindows > 0 && len(f.lru) > f.MaxWindows {
+		f.release(f.lru[len(f.lru)-1])
+	}
+}
+
+// release must be invoked with the mutex held.
+func (f *MappedFile) release(i int) {
+	if r := f.windows[i]; r != nil {
+		delete(f.windows, i)
+
+		f.unlru(i)
+
+		r.DecRef()
+	}
+}
+
+// unlru must be invoked with the mutex held.
+func (f *MappedFile) unlru(i int) {
+	for j, x := range f.lru {
+		if x == i {
+			f.lru = append(f.lru[:j], f.lru[j+1:]...)
+			return
+		}
+	}
+}
+
+// Flush writes the modified bytes of the mapped windows to disk,
+// where a FlushSync also waits for the file metadata via fsync().
+func (f *MappedFile) Flush(mode FlushMode) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	for _, r := range f.windows {
+		err := r.Flush(mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.File != nil && mode == FlushSync {
+		return f.File.Sync()
+	}
+
+	return nil
+}
+
+// Close releases all the windows and closes the file, where windows
+// that are still in use remain mapped until they're DecRef()'ed.
+func (f *MappedFile) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	for i := range f.windows {
+		f.release(i)
+	}
+
+	if f.File == nil {
+		return nil
+	}
+
+	err := f.File.Close()
+
+	f.File = nil
+
+	return err
+}
+
+// Remove should be called only on a closed MappedFile.
+func (f *MappedFile) Remove() error {
+	return os.Remove(f.Path)
+}
@@ -0,0 +1,365 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMappedFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testMappedFile")
+	defer os.RemoveAll(dir)
+
+	path := dir + "/test"
+
+	// The window size need not be a multiple of the page size.
+	f, err := CreateMappedFile(path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		w, err := f.Window(i)
+		if err != nil || len(w.Buf) != 1000 {
+			t.Fatalf("i: %d, window, err: %v", i, err)
+		}
+
+		copy(w.Buf, fmt.Sprintf("window-%d", i))
+
+		w.DecRef()
+	}
+
+	if f.Size() != 5000 || f.NumWindows() != 5 {
+		t.Fatalf("expected grown file, size: %d", f.Size())
+	}
+
+	// A window is shared while it's mapped.
+	w2, _ := f.Window(2)
+	w2again, _ := f.Window(2)
+	if w2 != w2again || w2.Refs != 3 {
+		t.Fatalf("expected a shared window, refs: %d", w2.Refs)
+	}
+
+	w2again.DecRef()
+
+	// A released window remains usable until its last DecRef().
+	f.Release(2)
+
+	if w2.Refs != 1 || string(w2.Buf[:8]) != "window-2" {
+		t.Fatalf("expected a released window to be in use, refs: %d", w2.Refs)
+	}
+
+	w2.DecRef()
+
+	if w2.Buf != nil {
+		t.Fatalf("expected an unmapped window")
+	}
+
+	if err = f.Flush(FlushSync); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil || len(b) != 5000 || string(b[3000:3008]) != "window-3" {
+		t.Fatalf("expected flushed windows, err: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Window(0); err == nil {
+		t.Fatalf("expected err on window after close")
+	}
+
+	// The windows are not removed individually.
+	w, _ := OpenMappedFile(path, 1000, true)
+	ww, _ := w.Window(1)
+	ww.Close()
+	ww.Remove()
+	w.Close()
+
+	ro, err := OpenMappedFile(path, 3000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ro.Close()
+
+	ro.MaxWindows = 1
+
+	r0, err := ro.Window(0)
+	if err != nil || len(r0.Buf) != 3000 || string(r0.Buf[2000:2008]) != "window-2" {
+		t.Fatalf("expected read-only window, err: %v", err)
+	}
+
+	// The last window of an existing file might be shorter.
+	r1, err := ro.Window(1)
+	if err != nil || len(r1.Buf) != 2000 || string(r1.Buf[1000:1008]) != "window-4" {
+		t.Fatalf("expected short last window, err: %v", err)
+	}
+
+	// The MaxWindows released the least recently used window.
+	if r0.Refs != 1 || r1.Refs != 2 {
+		t.Fatalf("expected MaxWindows, refs: %d, %d", r0.Refs, r1.Refs)
+	}
+
+	r0.DecRef()
+	r1.DecRef()
+
+	if _, err = ro.Window(2); err == nil {
+		t.Fatalf("expected err on read-only window beyond the file")
+	}
+}
+
+func TestChunksSingleFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testMappedFile")
+	defer os.RemoveAll(dir)
+
+	quota := NewDiskQuota(0)
+
+	cs := &Chunks{
+		PathPrefix:     dir + "/test",
+		FileSuffix:     ".rhstore",
+		ChunkSizeBytes: 1000,
+		SingleFile:     true,
+		Quota:          quota,
+	}
+
+	var expected []byte
+
+	for i := 0; i < 1000; i++ {
+		b := []byte(fmt.Sprintf("item-%04d|", i))
+
+		if _, err := cs.Write(b); err != nil {
+			t.Fatal(err)
+		}
+
+		expected = append(expected, b...)
+	}
+
+	got := make([]byte, len(expected))
+	if _, err := cs.ReadAt(got, 0); err != nil || !bytes.Equal(got, expected) {
+		t.Fatalf("mismatched bytes, err: %v", err)
+	}
+
+	files, _ := filepath.Glob(dir + "/*")
+	if len(files) != 1 || files[0] != cs.SingleFilePath() {
+		t.Fatalf("expected a single file, got: %v", files)
+	}
+
+	if err := cs.Flush(FlushSync); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(cs.SingleFilePath())
+	if err != nil || !bytes.Equal(b, expected[1000:]) {
+		t.Fatalf("expected the chunks in the single file, err: %v", err)
+	}
+
+	// The recycled windows are reused, so the file does not grow.
+	if err = cs.BytesTruncate(1500); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = cs.Write(bytes.Repeat([]byte("z"), 5000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if cs.file.Size() != 9000 || quota.UsedBytes() != 9000 {
+		t.Fatalf("expected reused windows, size: %d, used: %d",
+			cs.file.Size(), quota.UsedBytes())
+	}
+
+	if err = cs.Freeze(); err == nil {
+		t.Fatalf("expected Freeze err with SingleFile")
+	}
+
+	cs.Close()
+
+	files, _ = filepath.Glob(dir + "/*")
+	if len(files) != 0 || quota.UsedBytes() != 0 {
+		t.Fatalf("expected no files, got: %v, used: %d", files, quota.UsedBytes())
+	}
+}
+
+func TestRHStoreFileSingleChunkFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testMappedFile")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 100
+	options.ChunkSizeBytes = 1024
+	options.SingleChunkFile = true
+	options.Quota = NewDiskQuota(0)
+
+	sf, err := CreateRHStoreFile(dir+"/sf", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2000; i++ {
+		_, err = sf.Set([]byte(fmt.Sprintf("key-%d", i)),
+			[]byte(fmt.Sprintf("val-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2000; i++ {
+		v, found := sf.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if !found || string(v) != fmt.Sprintf("val-%d", i) {
+			t.Fatalf("i: %d, v: %s", i, v)
+		}
+	}
+
+	chunkFiles, _ := filepath.Glob(dir + "/sf_chunk*")
+	if len(chunkFiles) != 1 || len(sf.Chunks.Chunks) < 10 {
+		t.Fatalf("expected a single chunks file, got: %v", chunkFiles)
+	}
+
+	// The file holds a window for each chunk, other than the 0'th.
+	size := sf.Chunks.file.Size()
+	if size != int64(len(sf.Chunks.Chunks)-1)*1024 ||
+		options.Quota.UsedBytes() < size {
+		t.Fatalf("expected a window per chunk, size: %d, used: %d",
+			size, options.Quota.UsedBytes())
+	}
+
+	if err = sf.Freeze(); err == nil {
+		t.Fatalf("expected Freeze err with SingleChunkFile")
+	}
+
+	h := &Heap{
+		LessFunc: func(a, b []byte) bool { return bytes.Compare(a, b) < 0 },
+		Heap: &Chunks{
+			PathPrefix:     dir + "/heap",
+			ChunkSizeBytes: 1024,
+			SingleFile:     true,
+		},
+		Data: &Chunks{
+			PathPrefix:     dir + "/data",
+			ChunkSizeBytes: 1024,
+			SingleFile:     true,
+		},
+	}
+
+	for i := 0; i < 500; i++ {
+		heap.Push(h, []byte(fmt.Sprintf("%05d", (i*37)%500)))
+	}
+
+	for i := 0; i < 500; i++ {
+		x := heap.Pop(h).([]byte)
+		if string(x) != fmt.Sprintf("%05d", i) {
+			t.Fatalf("i: %d, x: %s", i, x)
+		}
+	}
+
+	h.Close()
+	sf.Close()
+
+	files, _ := filepath.Glob(dir + "/*")
+	if len(files) != 0 || options.Quota.UsedBytes() != 0 {
+		t.Fatalf("expected no files, got: %v, used: %d",
+			files, options.Quota.UsedBytes())
+	}
+}
+
+func TestChunksSingleFileRemovedWindows(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testMappedFile")
+	defer os.RemoveAll(dir)
+
+	quota := NewDiskQuota(0)
+
+	// The Compress option removes the window of each sealed chunk.
+	cs := &Chunks{
+		PathPrefix:     dir + "/test",
+		FileSuffix:     ".rhstore",
+		ChunkSizeBytes: 1000,
+		SingleFile:     true,
+		Compress:       true,
+		Quota:          quota,
+	}
+
+	checkQuota := func(msg string, expectedSize int64) {
+		if cs.file.Size() != expectedSize {
+			t.Fatalf("%s, expected file size: %d, got: %d",
+				msg, expectedSize, cs.file.Size())
+		}
+
+		// The quota holds the whole file, including its removed
+		// windows, along with the sealed chunk files.
+		expectedUsed := cs.file.Size() + cs.Stats().CompressedBytes
+		if quota.UsedBytes() != expectedUsed {
+			t.Fatalf("%s, expected used: %d, got: %d",
+				msg, expectedUsed, quota.UsedBytes())
+		}
+	}
+
+	expected := bytes.Repeat([]byte("a"), 10000)
+
+	if _, err := cs.Write(expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if cs.Stats().SealedChunks != 8 {
+		t.Fatalf("expected sealed chunks, stats: %+v", cs.Stats())
+	}
+
+	// Only the raw chunk being sealed and the last chunk need windows,
+	// as the windows of the sealed chunks are reused.
+	checkQuota("sealed", 2000)
+
+	if len(cs.freeWindows) != 1 {
+		t.Fatalf("expected a removed window, got: %v", cs.freeWindows)
+	}
+
+	// Writing a sealed chunk unseals it into the removed window.
+	if err := cs.BytesWrite(3000, []byte("bbb")); err != nil {
+		t.Fatal(err)
+	}
+
+	copy(expected[3000:], "bbb")
+
+	checkQuota("unsealed", 2000)
+
+	if len(cs.freeWindows) != 0 {
+		t.Fatalf("expected a reused window, got: %v", cs.freeWindows)
+	}
+
+	// Another window grows the file and the quota.
+	if err := cs.BytesWrite(5000, []byte("ccc")); err != nil {
+		t.Fatal(err)
+	}
+
+	copy(expected[5000:], "ccc")
+
+	checkQuota("grown", 3000)
+
+	b, err := cs.BytesRead(0, uint64(len(expected)))
+	if err != nil || !bytes.Equal(b, expected) {
+		t.Fatalf("expected the written bytes, err: %v", err)
+	}
+
+	cs.Close()
+
+	files, _ := filepath.Glob(dir + "/*")
+	if len(files) != 0 || quota.UsedBytes() != 0 {
+		t.Fatalf("expected no files, got: %v, used: %d", files, quota.UsedBytes())
+	}
+}
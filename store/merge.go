@@ -0,0 +1,107 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// The ready-made merge funcs below are meant to be used with
+// RHStore.SetMerge(). The numeric merge funcs treat vals as
+// little-endian encoded uint64's, and always produce 8 byte results,
+// so that their merged vals can be updated in-place.
+
+// MergeSumUint64 sums the existing and incoming vals.
+func MergeSumUint64(existing, incoming Val, out []byte) []byte {
+	return AppendUint64(out, Uint64(existing)+Uint64(incoming))
+}
+
+// MergeCount counts the number of merges for a key, ignoring the
+// incoming val, so the first insert of a key has a count of 1.
+func MergeCount(existing, incoming Val, out []byte) []byte {
+	return AppendUint64(out, Uint64(existing)+1)
+}
+
+// MergeMinUint64 keeps the smaller of the existing and incoming vals.
+func MergeMinUint64(existing, incoming Val, out []byte) []byte {
+	if existing != nil && Uint64(existing) <= Uint64(incoming) {
+		return AppendUint64(out, Uint64(existing))
+	}
+
+	return AppendUint64(out, Uint64(incoming))
+}
+
+// MergeMaxUint64 keeps the larger of the existing and incoming vals.
+func MergeMaxUint64(existing, incoming Val, out []byte) []byte {
+	if existing != nil && Uint64(existing) >= Uint64(incoming) {
+		return AppendUint64(out, Uint64(existing))
+	}
+
+	return AppendUint64(out, Uint64(incoming))
+}
+
+// MergeMinBytes keeps the lexicographically smaller of the existing
+// and incoming vals.
+func MergeMinBytes(existing, incoming Val, out []byte) []byte {
+	if existing != nil && bytes.Compare(existing, incoming) <= 0 {
+		return append(out, existing...)
+	}
+
+	return append(out, incoming...)
+}
+
+// MergeMaxBytes keeps the lexicographically larger of the existing
+// and incoming vals.
+func MergeMaxBytes(existing, incoming Val, out []byte) []byte {
+	if existing != nil && bytes.Compare(existing, incoming) >= 0 {
+		return append(out, existing...)
+	}
+
+	return append(out, incoming...)
+}
+
+// MergeFirst keeps the first val that was seen for a key.
+func MergeFirst(existing, incoming Val, out []byte) []byte {
+	if existing != nil {
+		return append(out, existing...)
+	}
+
+	return append(out, incoming...)
+}
+
+// MergeLast keeps the last val that was seen for a key.
+func MergeLast(existing, incoming Val, out []byte) []byte {
+	return append(out, incoming...)
+}
+
+// ---------------------------------------------
+
+// Uint64 decodes a little-endian uint64 from up to 8 bytes of b.
+func Uint64(b []byte) uint64 {
+	if len(b) >= 8 {
+		return binary.LittleEndian.Uint64(b)
+	}
+
+	var buf [8]byte
+	copy(buf[:], b)
+
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// AppendUint64 appends the 8 byte, little-endian encoding of v to out.
+func AppendUint64(out []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+
+	return append(out, buf[:]...)
+}
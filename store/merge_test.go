@@ -0,0 +1,169 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSetMerge(t *testing.T) {
+	testSetMerge(t, NewRHStore(10))
+}
+
+func TestRHStoreFileSetMerge(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testRHStoreFile")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 2
+	options.ChunkSizeBytes = 64
+
+	sf, err := CreateRHStoreFile(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	testSetMerge(t, &sf.RHStore)
+}
+
+func testSetMerge(t *testing.T, r *RHStore) {
+	u := func(v uint64) []byte { return AppendUint64(nil, v) }
+
+	tests := []struct {
+		merge    MergeFunc
+		incoming [][]byte
+		expected []byte
+	}{
+		{MergeSumUint64, [][]byte{u(1), u(2), u(3)}, u(6)},
+		{MergeCount, [][]byte{u(10), nil, u(30)}, u(3)},
+		{MergeMinUint64, [][]byte{u(5), u(2), u(9)}, u(2)},
+		{MergeMaxUint64, [][]byte{u(5), u(20), u(9)}, u(20)},
+		{MergeMinBytes, [][]byte{[]byte("b"), []byte("a"), []byte("c")}, []byte("a")},
+		{MergeMaxBytes, [][]byte{[]byte("b"), []byte("cc"), []byte("a")}, []byte("cc")},
+		{MergeFirst, [][]byte{[]byte("x"), []byte("yy"), []byte("z")}, []byte("x")},
+		{MergeLast, [][]byte{[]byte("x"), []byte("yy"), []byte("zzz")}, []byte("zzz")},
+	}
+
+	for testi, test := range tests {
+		k := []byte{'k', byte('a' + testi)}
+
+		for i, incoming := range test.incoming {
+			wasNew, err := r.SetMerge(k, incoming, test.merge)
+			if err != nil {
+				t.Fatalf("testi: %d, i: %d, err: %v", testi, i, err)
+			}
+			if wasNew != (i == 0) {
+				t.Fatalf("testi: %d, i: %d, wrong wasNew", testi, i)
+			}
+		}
+
+		v, found := r.Get(k)
+		if !found || string(v) != string(test.expected) {
+			t.Fatalf("testi: %d, got: %v, %t, expected: %v",
+				testi, v, found, test.expected)
+		}
+	}
+
+	if r.Count != len(tests) {
+		t.Fatalf("wrong count: %d", r.Count)
+	}
+
+	// Merges of fixed-width vals should not grow the backing bytes.
+	k := []byte("sum")
+	r.SetMerge(k, u(1), MergeSumUint64)
+
+	e, err := r.Find(k)
+	if err != nil || e == nil {
+		t.Fatalf("expected find, err: %v", err)
+	}
+
+	vOffset, _ := e.ValOffsetSize()
+
+	for i := 0; i < 100; i++ {
+		r.SetMerge(k, u(1), MergeSumUint64)
+
+		e, err := r.Find(k)
+		if err != nil || e == nil {
+			t.Fatalf("expected find, err: %v", err)
+		}
+		if eValOffset, _ := e.ValOffsetSize(); eValOffset != vOffset {
+			t.Fatalf("expected in-place val update")
+		}
+	}
+
+	v, _ := r.Get(k)
+	if Uint64(v) != 101 {
+		t.Fatalf("expected 101, got: %d", Uint64(v))
+	}
+
+	_, err = r.SetMerge(nil, u(1), MergeSumUint64)
+	if err != ErrKeyZeroLen {
+		t.Fatalf("expected ErrKeyZeroLen, got: %v", err)
+	}
+}
+
+func TestSetMergeGrow(t *testing.T) {
+	testSetMergeGrow(t, NewRHStore(2))
+
+	r := NewRHStore(2)
+	r.Grow = GrowIncremental
+	r.MigrateStep = 1
+
+	testSetMergeGrow(t, r)
+}
+
+func testSetMergeGrow(t *testing.T, r *RHStore) {
+	u := func(v uint64) []byte { return AppendUint64(nil, v) }
+
+	// New keys are inserted from where their probe missed, which is
+	// checked across grows and the migrations of an incremental grow.
+	for i := 0; i < 5000; i++ {
+		k := []byte(fmt.Sprintf("k%d", i%503))
+
+		wasNew, err := r.SetMerge(k, u(1), MergeSumUint64)
+		if err != nil {
+			t.Fatalf("i: %d, err: %v", i, err)
+		}
+		if wasNew != (i < 503) {
+			t.Fatalf("i: %d, wrong wasNew", i)
+		}
+
+		if i%250 == 0 {
+			if err := r.Validate(); err != nil {
+				t.Fatalf("i: %d, validate err: %v", i, err)
+			}
+		}
+	}
+
+	if r.Count != 503 {
+		t.Fatalf("wrong count: %d", r.Count)
+	}
+
+	for i := 0; i < 503; i++ {
+		v, found := r.Get([]byte(fmt.Sprintf("k%d", i)))
+
+		expected := uint64(5000 / 503)
+		if i < 5000%503 {
+			expected++
+		}
+
+		if !found || Uint64(v) != expected {
+			t.Fatalf("i: %d, got: %v, %t, expected: %d",
+				i, v, found, expected)
+		}
+	}
+}
@@ -12,8 +12,11 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"runtime"
+	"sync/atomic"
 
 	"github.com/edsrzf/mmap-go"
 )
@@ -21,48 +24,105 @@ import (
 // MMapPageSize is the default page size in bytes used by rhstore.
 var MMapPageSize = int64(4096)
 
+// ErrMMapFault means a memory fault, such as a SIGBUS, occurred while
+// accessing mmap()'ed bytes, and was caught. See Chunks.CatchFaults.
+var ErrMMapFault = errors.New("mmap fault")
+
 // CreateFileAsMMapRef creates a new, empty file of the given size in
 // bytes and mmap()'s it.  If the path is "", then an in-memory-only
 // MMapRef is returned, which is an MMapRef that really isn't
-// mmap()'ing an actual file.
+// mmap()'ing an actual file. The disk blocks of the file are reserved
+// up front, so that a full disk is an error here, rather than a SIGBUS
+// on a later write into the mmap()'ed bytes of a sparse file.
 func CreateFileAsMMapRef(path string, size int) (*MMapRef, error) {
 	if path == "" {
 		return &MMapRef{Buf: make([]byte, size), Refs: 1}, nil
 	}
 
-	file, err := os.Create(path)
+	file, err := createPreallocatedFile(path, size)
 	if err != nil {
 		return nil, err
 	}
 
-	// Write 0 at the last byte to grow its size.
-	_, err = file.WriteAt([]byte{0}, int64(size-1))
+	mmapRef, err := MMapFileRegion(path, file, 0, int64(size), true)
 	if err != nil {
 		file.Close()
 		os.Remove(path)
 		return nil, err
 	}
 
-	mmapRef, err := MMapFileRegion(path, file, 0, int64(size), true)
+	return mmapRef, err
+}
+
+// CreateFileAsFileRef is like CreateFileAsMMapRef(), but the returned
+// MMapRef does not mmap() the file, and instead holds the bytes of the
+// file in its Buf, which starts as zeros. The Buf is written to the
+// file by Flush() or Unload(), and is read back by Load(), so a file
+// ref works when mmap()'s are limited, such as by vm.max_map_count.
+func CreateFileAsFileRef(path string, size int) (*MMapRef, error) {
+	if path == "" {
+		return &MMapRef{Buf: make([]byte, size), Refs: 1}, nil
+	}
+
+	file, err := createPreallocatedFile(path, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MMapRef{Path: path, File: file, Buf: make([]byte, size),
+		Refs: 1, size: size}, nil
+}
+
+// createPreallocatedFile creates a new file, whose disk blocks are
+// reserved for the given size in bytes.
+func createPreallocatedFile(path string, size int) (*os.File, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = preallocate(file, 0, int64(size))
 	if err != nil {
 		file.Close()
 		os.Remove(path)
 		return nil, err
 	}
 
-	return mmapRef, err
+	return file, nil
 }
 
 // ----------------------------------------------------------
 
 // MMapRef provides a ref-counting wrapper around a mmap handle. The
+// ref-counting is concurrent safe, so readers of a frozen RHStoreFile
+// can AddRef() and DecRef() from many goroutines, but the rest of the
 // implementation is not concurrent safe.
 type MMapRef struct {
 	Path string
 	File *os.File
 	MMap mmap.MMap
 	Buf  []byte
-	Refs int
+
+	// Refs is accessed atomically.
+	Refs int32
+
+	// dirty is true when Chunks has modified the Buf since the last
+	// Flush().
+	dirty bool
+
+	// pool is the ChunkPool that lent this MMapRef, if any.
+	pool *ChunkPool
+
+	// size is the file size of a file ref, whose Buf might be
+	// unloaded. See CreateFileAsFileRef().
+	size int
+
+	// mappedFile is the MappedFile that this MMapRef is a window of,
+	// if any, which owns the file.
+	mappedFile *MappedFile
+
+	// window is the index of the window in the mappedFile.
+	window int
 }
 
 func (r *MMapRef) AddRef() *MMapRef {
@@ -70,7 +130,7 @@ func (r *MMapRef) AddRef() *MMapRef {
 		return nil
 	}
 
-	r.Refs++
+	atomic.AddInt32(&r.Refs, 1)
 
 	return r
 }
@@ -80,8 +140,7 @@ func (r *MMapRef) DecRef() error {
 		return nil
 	}
 
-	r.Refs--
-	if r.Refs <= 0 {
+	if atomic.AddInt32(&r.Refs, -1) == 0 {
 		r.Buf = nil
 
 		if r.MMap != nil {
@@ -102,11 +161,265 @@ func (r *MMapRef) DecRef() error {
 // io.Closer interface.
 func (r *MMapRef) Close() error { return r.DecRef() }
 
+// preallocateWrite reserves the disk blocks of the size bytes of a
+// file starting at the offset by writing zeros.
+func preallocateWrite(file *os.File, offset, size int64) error {
+	if size <= 0 {
+		return fmt.Errorf("mmap: preallocate invalid size: %d", size)
+	}
+
+	buf := make([]byte, 64*1024)
+
+	for pos := int64(0); pos < size; pos += int64(len(buf)) {
+		if size-pos < int64(len(buf)) {
+			buf = buf[:size-pos]
+		}
+
+		_, err := file.WriteAt(buf, offset+pos)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recoverFault turns a panic from a memory fault into ErrMMapFault,
+// re-panicking on any other panic. It's meant to be deferred directly,
+// after a deferred debug.SetPanicOnFault(debug.SetPanicOnFault(true)),
+// as otherwise a memory fault crashes the process instead of panicking.
+func recoverFault(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	// With SetPanicOnFault, the runtime reports a fault as an error
+	// that has the faulting address, unlike a nil pointer dereference,
+	// which has the same message, but no address, and is re-panicked.
+	if _, ok := r.(runtime.Error); ok {
+		if _, ok := r.(interface{ Addr() uintptr }); ok {
+			*err = ErrMMapFault
+			return
+		}
+	}
+
+	panic(r)
+}
+
+// ----------------------------------------------------------
+
+// OpenFileAsMMapRef opens an existing file and mmap()'s all of it,
+// where a read-only mmap() allows the file to be shared with other
+// processes.
+func OpenFileAsMMapRef(path string, readWrite bool) (*MMapRef, error) {
+	flag := os.O_RDONLY
+	if readWrite {
+		flag = os.O_RDWR
+	}
+
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fstats, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	mmapRef, err := MMapFileRegion(path, file, 0, fstats.Size(), readWrite)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return mmapRef, nil
+}
+
+// Advice is an access pattern hint for the bytes of an MMapRef.
+type Advice int
+
+const (
+	// AdviseNormal is the default access pattern.
+	AdviseNormal Advice = iota
+
+	// AdviseSequential hints that the bytes will be read in order, so
+	// the kernel can read ahead aggressively.
+	AdviseSequential
+
+	// AdviseRandom hints that the bytes will be accessed in a random
+	// order, such as by point lookups, so read ahead is wasteful.
+	AdviseRandom
+
+	// AdviseWillNeed hints that the bytes will be accessed soon.
+	AdviseWillNeed
+
+	// AdviseDontNeed hints that the bytes won't be accessed soon, so
+	// the kernel can release their pages. The bytes of a file-backed
+	// MMapRef are not lost, and are paged back in on the next access.
+	AdviseDontNeed
+)
+
+// Adviser is implemented by a ByteStore that can accept access
+// pattern hints, such as Chunks. As advice is only a hint, callers
+// may ignore the errors of Advise().
+type Adviser interface {
+	Advise(advice Advice) error
+}
+
+// Advise passes an access pattern hint for a file-backed MMapRef to
+// the kernel via madvise(), and is a no-op for an in-memory-only
+// MMapRef and on windows.
+func (r *MMapRef) Advise(advice Advice) error {
+	if r == nil || r.MMap == nil {
+		return nil
+	}
+
+	return madvise(r.MMap, advice)
+}
+
+// FlushMode controls whether a Flush() waits for the modified bytes
+// to be written to disk.
+type FlushMode int
+
+const (
+	// FlushSync waits until the modified bytes and the file metadata
+	// are written to disk, via msync() and fsync().
+	FlushSync FlushMode = iota
+
+	// FlushAsync schedules the modified bytes to be written to disk
+	// without waiting. On windows, FlushAsync is the same as FlushSync.
+	FlushAsync
+)
+
+// Flusher is implemented by a ByteStore that can write its modified
+// bytes to disk, such as Chunks.
+type Flusher interface {
+	Flush(mode FlushMode) error
+}
+
+// Flush writes any modified bytes of a file-backed MMapRef to its
+// file, and is a no-op for an in-memory-only MMapRef. A file ref
+// writes its whole Buf, if loaded.
+func (r *MMapRef) Flush(mode FlushMode) error {
+	if r.IsFileRef() {
+		err := r.writeBack()
+		if err == nil && mode == FlushSync {
+			err = r.File.Sync()
+		}
+
+		return err
+	}
+
+	if r == nil || r.MMap == nil {
+		return nil
+	}
+
+	var err error
+	if mode == FlushAsync {
+		err = msyncAsync(r.MMap)
+	} else {
+		err = r.MMap.Flush()
+		if err == nil && r.File != nil {
+			err = r.File.Sync()
+		}
+	}
+
+	if err == nil {
+		r.dirty = false
+	}
+
+	return err
+}
+
+// ----------------------------------------------------------
+
+// IsFileRef returns true for an MMapRef from CreateFileAsFileRef(),
+// which accesses its file without mmap().
+func (r *MMapRef) IsFileRef() bool {
+	return r != nil && r.MMap == nil && r.File != nil
+}
+
+// Len returns the size of the bytes of the MMapRef, which for a file
+// ref is the file size, even when its Buf is unloaded.
+func (r *MMapRef) Len() int {
+	if r.IsFileRef() {
+		return r.size
+	}
+
+	return len(r.Buf)
+}
+
+// Load reads the bytes of an unloaded file ref into a newly allocated
+// Buf, and is a no-op for any other MMapRef. A new Buf is allocated,
+// as slices of an earlier Buf might still be in use.
+func (r *MMapRef) Load() error {
+	if !r.IsFileRef() || r.Buf != nil {
+		return nil
+	}
+
+	buf := make([]byte, r.size)
+
+	_, err := r.File.ReadAt(buf, 0)
+	if err != nil {
+		return fmt.Errorf("mmap: Load, path: %s, err: %v", r.Path, err)
+	}
+
+	r.Buf = buf
+
+	return nil
+}
+
+// Unload writes the Buf of a file ref to its file and releases the
+// Buf, so that a later Load() is needed, and is a no-op for any other
+// MMapRef.
+func (r *MMapRef) Unload() error {
+	return r.unload(true)
+}
+
+// unload is like Unload(), but unless force is true, a Buf is only
+// written to the file when Chunks has modified it.
+func (r *MMapRef) unload(force bool) error {
+	if !r.IsFileRef() {
+		return nil
+	}
+
+	if force || r.dirty {
+		err := r.writeBack()
+		if err != nil {
+			return err
+		}
+	}
+
+	r.Buf = nil
+
+	return nil
+}
+
+// writeBack writes the loaded Buf of a file ref to its file.
+func (r *MMapRef) writeBack() error {
+	if r.Buf == nil {
+		return nil
+	}
+
+	_, err := r.File.WriteAt(r.Buf, 0)
+	if err != nil {
+		return fmt.Errorf("mmap: write back, path: %s, err: %v", r.Path, err)
+	}
+
+	r.dirty = false
+
+	return nil
+}
+
 // ----------------------------------------------------------
 
-// Remove should be called only on a closed MMapRef.
+// Remove should be called only on a closed MMapRef, and is a no-op for
+// a window of a MappedFile, as the file is removed by the MappedFile.
 func (r *MMapRef) Remove() error {
-	if r.Path != "" {
+	if r.Path != "" && r.mappedFile == nil {
 		return os.Remove(r.Path)
 	}
 
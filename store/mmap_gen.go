@@ -13,7 +13,45 @@
 
 package store
 
+import (
+	"fmt"
+
+	"github.com/edsrzf/mmap-go"
+	"golang.org/x/sys/unix"
+)
+
 // MMapPageGranularity defines the granularity of mmap'ed region.
 // Some operating systems require mmap to occur on particular
 // boundaries that are not equal to a page size.
 var MMapPageGranularity = MMapPageSize
+
+// madvise passes an access pattern hint for the mmap()'ed bytes.
+func madvise(b []byte, advice Advice) error {
+	var flag int
+
+	switch advice {
+	case AdviseNormal:
+		flag = unix.MADV_NORMAL
+	case AdviseSequential:
+		flag = unix.MADV_SEQUENTIAL
+	case AdviseRandom:
+		flag = unix.MADV_RANDOM
+	case AdviseWillNeed:
+		flag = unix.MADV_WILLNEED
+	case AdviseDontNeed:
+		flag = unix.MADV_DONTNEED
+	default:
+		return fmt.Errorf("mmap: unknown advice: %d", advice)
+	}
+
+	if len(b) <= 0 {
+		return nil
+	}
+
+	return unix.Madvise(b, flag)
+}
+
+// msyncAsync schedules the modified mmap()'ed bytes to be written.
+func msyncAsync(m mmap.MMap) error {
+	return unix.Msync(m, unix.MS_ASYNC)
+}
@@ -12,6 +12,7 @@
 package store
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -65,3 +66,135 @@ func TestMultipleMMapsOnSameFile(t *testing.T) {
 
 	f.Close()
 }
+
+func TestMMapRefAdvise(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "storeMMap")
+	defer os.RemoveAll(tmpDir)
+
+	r, err := CreateFileAsMMapRef(tmpDir+"/test.file", 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	copy(r.Buf[1000:], "hello")
+
+	for _, advice := range []Advice{AdviseSequential, AdviseRandom,
+		AdviseWillNeed, AdviseDontNeed, AdviseNormal} {
+		if err = r.Advise(advice); err != nil {
+			t.Fatalf("advice: %d, err: %v", advice, err)
+		}
+	}
+
+	// The bytes of a file-backed MMapRef survive AdviseDontNeed.
+	if string(r.Buf[1000:1005]) != "hello" {
+		t.Fatalf("expected hello, got: %q", r.Buf[1000:1005])
+	}
+
+	inMemory, _ := CreateFileAsMMapRef("", 100)
+	if err = inMemory.Advise(AdviseDontNeed); err != nil {
+		t.Fatalf("expected in-memory advise no-op, err: %v", err)
+	}
+
+	var nilRef *MMapRef
+	if err = nilRef.Advise(AdviseRandom); err != nil {
+		t.Fatalf("expected nil advise no-op, err: %v", err)
+	}
+}
+
+func TestMMapRefFlush(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "storeMMap")
+	defer os.RemoveAll(tmpDir)
+
+	path := tmpDir + "/test.file"
+
+	r, err := CreateFileAsMMapRef(path, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	for _, mode := range []FlushMode{FlushAsync, FlushSync} {
+		copy(r.Buf[100:], fmt.Sprintf("hello-%d", mode))
+
+		r.dirty = true
+
+		if err = r.Flush(mode); err != nil {
+			t.Fatalf("mode: %d, flush, err: %v", mode, err)
+		}
+
+		if r.dirty {
+			t.Fatalf("mode: %d, expected not dirty after flush", mode)
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil || string(b[100:107]) != "hello-0" {
+		t.Fatalf("expected flushed file, b: %q, err: %v", b[100:107], err)
+	}
+
+	inMemory, _ := CreateFileAsMMapRef("", 100)
+	if err = inMemory.Flush(FlushSync); err != nil {
+		t.Fatalf("expected in-memory flush no-op, err: %v", err)
+	}
+}
+
+func TestMMapRefFileRef(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "storeMMap")
+	defer os.RemoveAll(tmpDir)
+
+	path := tmpDir + "/test.file"
+
+	r, err := CreateFileAsFileRef(path, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	if !r.IsFileRef() || r.MMap != nil || len(r.Buf) != 4096 || r.Len() != 4096 {
+		t.Fatalf("expected a loaded file ref")
+	}
+
+	copy(r.Buf[100:], "hello")
+
+	if err = r.Flush(FlushSync); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil || len(b) != 4096 || string(b[100:105]) != "hello" {
+		t.Fatalf("expected flushed file, err: %v", err)
+	}
+
+	copy(r.Buf[200:], "world")
+
+	if err = r.Unload(); err != nil || r.Buf != nil || r.Len() != 4096 {
+		t.Fatalf("expected unloaded, err: %v", err)
+	}
+
+	if err = r.Load(); err != nil || len(r.Buf) != 4096 ||
+		string(r.Buf[100:105]) != "hello" || string(r.Buf[200:205]) != "world" {
+		t.Fatalf("expected loaded bytes, err: %v", err)
+	}
+
+	// Without a modification by Chunks, unload skips the write back.
+	copy(r.Buf[300:], "lost")
+
+	if err = r.unload(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.Load(); err != nil || string(r.Buf[300:304]) == "lost" {
+		t.Fatalf("expected no write back, err: %v", err)
+	}
+
+	inMemory, _ := CreateFileAsFileRef("", 100)
+	if inMemory.IsFileRef() || len(inMemory.Buf) != 100 ||
+		inMemory.Load() != nil || inMemory.Unload() != nil ||
+		len(inMemory.Buf) != 100 {
+		t.Fatalf("expected in-memory ref unaffected by Load/Unload")
+	}
+}
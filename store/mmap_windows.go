@@ -13,6 +13,10 @@
 
 package store
 
+import (
+	"github.com/edsrzf/mmap-go"
+)
+
 // Windows MapViewOfFile() API (rough equivalent of mmap()), requires
 // region offsets to be multiples of an "allocation granularity",
 // which is up to 64kiB (or, larger than the usual 4KB page size).
@@ -20,3 +24,14 @@ package store
 // See: https://social.msdn.microsoft.com/Forums/vstudio/en-US/972f36a4-26c9-466b-861a-5f40fa4cf4e7/about-the-dwallocationgranularity?forum=vclanguage
 //
 var MMapPageGranularity = int64(65536) // 64kiB.
+
+// madvise is a no-op, as windows does not have madvise().
+func madvise(b []byte, advice Advice) error {
+	return nil
+}
+
+// msyncAsync is the same as a synchronous flush, as the mmap package
+// only provides FlushViewOfFile() together with FlushFileBuffers().
+func msyncAsync(m mmap.MMap) error {
+	return m.Flush()
+}
@@ -0,0 +1,25 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// +build !linux
+
+package store
+
+import (
+	"os"
+)
+
+// preallocate reserves the disk blocks of the size bytes of a file
+// starting at the offset, growing the file as needed, by writing
+// zeros, as there's no portable equivalent of fallocate().
+func preallocate(file *os.File, offset, size int64) error {
+	return preallocateWrite(file, offset, size)
+}
@@ -0,0 +1,32 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// +build linux
+
+package store
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves the disk blocks of the size bytes of a file
+// starting at the offset, growing the file as needed, via fallocate(),
+// falling back to writing zeros on file systems without fallocate().
+func preallocate(file *os.File, offset, size int64) error {
+	err := unix.Fallocate(int(file.Fd()), 0, offset, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return preallocateWrite(file, offset, size)
+	}
+
+	return err
+}
@@ -0,0 +1,75 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// +build linux
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testPreallocate")
+	defer os.RemoveAll(dir)
+
+	size := 1024 * 1024
+
+	r, err := CreateFileAsMMapRef(dir+"/test", size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	fi, err := os.Stat(dir + "/test")
+	if err != nil || fi.Size() != int64(size) {
+		t.Fatalf("expected file size: %d, fi: %+v, err: %v", size, fi, err)
+	}
+
+	// The blocks of a sparse file would not be allocated.
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok &&
+		st.Blocks*512 < int64(size) {
+		t.Fatalf("expected allocated blocks, got: %d", st.Blocks)
+	}
+
+	f, err := os.Create(dir + "/test2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if err = preallocateWrite(f, 0, 100000); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, _ = f.Stat(); fi.Size() != 100000 {
+		t.Fatalf("expected preallocateWrite size, got: %d", fi.Size())
+	}
+
+	if _, err = f.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later region is reserved without overwriting earlier bytes.
+	if err = preallocate(f, 100000, 50000); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(dir + "/test2")
+	if err != nil || len(b) != 150000 || string(b[:5]) != "hello" {
+		t.Fatalf("expected grown file, len: %d, err: %v", len(b), err)
+	}
+}
@@ -0,0 +1,105 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrDiskQuotaExceeded means that creating a file would exceed the
+// limit of a DiskQuota.
+var ErrDiskQuotaExceeded = errors.New("disk quota exceeded")
+
+// DiskQuota limits the total bytes of the files that are created by
+// Chunks, RHStoreFile's and Heap's, which can share a single DiskQuota
+// across owners, like the concurrent queries of a process. A DiskQuota
+// is concurrent safe.
+type DiskQuota struct {
+	// LimitBytes is the max total bytes of files, where a LimitBytes
+	// of 0 means unlimited, so only the usage is tracked.
+	LimitBytes int64
+
+	m sync.Mutex
+
+	usedBytes int64
+
+	ownerBytes map[string]int64
+}
+
+// NewDiskQuota returns a ready-to-use DiskQuota.
+func NewDiskQuota(limitBytes int64) *DiskQuota {
+	return &DiskQuota{
+		LimitBytes: limitBytes,
+		ownerBytes: map[string]int64{},
+	}
+}
+
+// Acquire reserves size bytes for the owner, or returns
+// ErrDiskQuotaExceeded if that would exceed the LimitBytes.
+func (q *DiskQuota) Acquire(owner string, size int64) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if q.LimitBytes > 0 && q.usedBytes+size > q.LimitBytes {
+		return ErrDiskQuotaExceeded
+	}
+
+	q.usedBytes += size
+
+	if q.ownerBytes == nil {
+		q.ownerBytes = map[string]int64{}
+	}
+
+	q.ownerBytes[owner] += size
+
+	return nil
+}
+
+// Release returns size bytes that were previously acquired by the
+// owner.
+func (q *DiskQuota) Release(owner string, size int64) {
+	q.m.Lock()
+
+	q.usedBytes -= size
+
+	q.ownerBytes[owner] -= size
+	if q.ownerBytes[owner] <= 0 {
+		delete(q.ownerBytes, owner)
+	}
+
+	q.m.Unlock()
+}
+
+// UsedBytes returns the total bytes that are currently acquired.
+func (q *DiskQuota) UsedBytes() int64 {
+	q.m.Lock()
+	rv := q.usedBytes
+	q.m.Unlock()
+
+	return rv
+}
+
+// OwnerBytes returns a copy of the bytes that are currently acquired
+// by each owner.
+func (q *DiskQuota) OwnerBytes() map[string]int64 {
+	q.m.Lock()
+
+	rv := make(map[string]int64, len(q.ownerBytes))
+	for owner, size := range q.ownerBytes {
+		rv[owner] = size
+	}
+
+	q.m.Unlock()
+
+	return rv
+}
@@ -0,0 +1,210 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDiskQuota(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testDiskQuota")
+	defer os.RemoveAll(dir)
+
+	q := NewDiskQuota(20000)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 1024
+	options.Quota = q
+
+	sf, err := CreateRHStoreFile(dir+"/a", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var i int
+
+	for i = 0; i < 100000; i++ {
+		_, err = sf.Set([]byte(fmt.Sprintf("k%d", i)), []byte("val"))
+		if err != nil {
+			break
+		}
+	}
+
+	if err != ErrDiskQuotaExceeded {
+		t.Fatalf("expected ErrDiskQuotaExceeded, got: %v, i: %d", err, i)
+	}
+
+	if q.UsedBytes() <= 0 || q.UsedBytes() > q.LimitBytes {
+		t.Fatalf("wrong used bytes: %d", q.UsedBytes())
+	}
+
+	if q.OwnerBytes()[dir+"/a"] != q.UsedBytes() {
+		t.Fatalf("wrong owner bytes: %v", q.OwnerBytes())
+	}
+
+	// The items before the failure are still there.
+	if err = sf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for j := 0; j < i; j++ {
+		if _, found := sf.Get([]byte(fmt.Sprintf("k%d", j))); !found {
+			t.Fatalf("expected found, j: %d", j)
+		}
+	}
+
+	// A heap sharing the quota is refused, too.
+	h := &Heap{
+		LessFunc: func(a, b []byte) bool { return string(a) < string(b) },
+		Heap: &Chunks{
+			PathPrefix:     dir + "/h",
+			ChunkSizeBytes: 16 * 1024,
+			Quota:          q,
+		},
+		Data: &Chunks{
+			PathPrefix:     dir + "/hData",
+			ChunkSizeBytes: 16 * 1024,
+			Quota:          q,
+			QuotaOwner:     "heap",
+		},
+	}
+
+	for j := 0; j < 100000 && h.Err == nil; j++ {
+		heap.Push(h, []byte(fmt.Sprintf("%d", j)))
+	}
+
+	if h.Err != ErrDiskQuotaExceeded {
+		t.Fatalf("expected heap ErrDiskQuotaExceeded, got: %v", h.Err)
+	}
+
+	h.Close()
+
+	if q.OwnerBytes()["heap"] != 0 {
+		t.Fatalf("expected heap bytes released, got: %v", q.OwnerBytes())
+	}
+
+	sf.Close()
+
+	if q.UsedBytes() != 0 || len(q.OwnerBytes()) != 0 {
+		t.Fatalf("expected all bytes released, got: %d, %v",
+			q.UsedBytes(), q.OwnerBytes())
+	}
+}
+
+func TestDiskQuotaGrowKeepsItems(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testDiskQuota")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 100
+	options.Quota = NewDiskQuota(5000)
+
+	sf, err := CreateRHStoreFile(dir+"/a", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	// With only two hash values, the robin-hood walk of a new key
+	// soon needs a grow, where the quota allows the 1st grow, but not
+	// the 2nd grow that the same Set then needs.
+	sf.HashFunc = func(k Key) uint32 { return uint32(k[len(k)-1] % 2) }
+
+	var i int
+
+	for i = 0; i < 100; i++ {
+		_, err = sf.Set([]byte(fmt.Sprintf("k%d", i)), []byte("val"))
+		if err != nil {
+			break
+		}
+	}
+
+	if err != ErrDiskQuotaExceeded {
+		t.Fatalf("expected ErrDiskQuotaExceeded, got: %v, i: %d", err, i)
+	}
+
+	// No existing item was lost by the failed grow.
+	if sf.Count != i {
+		t.Fatalf("expected count: %d, got: %d", i, sf.Count)
+	}
+
+	if err = sf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for j := 0; j < i; j++ {
+		v, found := sf.Get([]byte(fmt.Sprintf("k%d", j)))
+		if !found || string(v) != "val" {
+			t.Fatalf("expected found, j: %d", j)
+		}
+	}
+
+	if _, found := sf.Get([]byte(fmt.Sprintf("k%d", i))); found {
+		t.Fatalf("expected the failed key to be missing")
+	}
+}
+
+func TestDiskQuotaMigrateKeepsItems(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testDiskQuota")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 100
+	options.IncrementalGrow = true
+	options.Quota = NewDiskQuota(5000)
+
+	sf, err := CreateRHStoreFile(dir+"/a", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	// With only two hash values, the migration soon needs a grow of
+	// the new slots, which the quota does not allow.
+	sf.HashFunc = func(k Key) uint32 { return uint32(k[len(k)-1] % 2) }
+
+	n := 0
+	for ; n < 100 && sf.Old == nil; n++ {
+		_, err = sf.Set([]byte(fmt.Sprintf("k%d", n)), []byte("val"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sf.Old == nil {
+		t.Fatalf("expected an incremental migration")
+	}
+
+	err = sf.FinishMigration()
+	if err != ErrDiskQuotaExceeded {
+		t.Fatalf("expected ErrDiskQuotaExceeded, got: %v", err)
+	}
+
+	// No item was lost by the failed migration.
+	if sf.Count != n {
+		t.Fatalf("expected count: %d, got: %d", n, sf.Count)
+	}
+
+	for j := 0; j < n; j++ {
+		v, found := sf.Get([]byte(fmt.Sprintf("k%d", j)))
+		if !found || string(v) != "val" {
+			t.Fatalf("expected found, j: %d", j)
+		}
+	}
+}
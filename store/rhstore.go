@@ -15,25 +15,41 @@ package store
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
-	"hash/fnv"
+	"fmt"
 )
 
 // ErrKeyZeroLen means a key was nil.
 var ErrKeyZeroLen = errors.New("key zero len")
 
-// ErrKeyTooBig means a key was too large.
+// ErrKeyTooBig means a key was too large. Since keys larger than
+// MaxKeyLen are supported via SizeOverflow, it is no longer returned.
 var ErrKeyTooBig = errors.New("key too big")
 
-// ErrValTooBig means a val was too large.
+// ErrValTooBig means a val was too large, or was not empty when the
+// RHStore is configured with KeysOnly.
 var ErrValTooBig = errors.New("val too big")
 
+// ErrReadOnly means a mutation was attempted on a read-only RHStore.
+var ErrReadOnly = errors.New("read only")
+
+// ErrDistanceOverflow means an item's distance from its best position
+// became too large to be encoded, and growing was not possible, or
+// that growing did not help, such as when many keys have the same
+// hash.
+var ErrDistanceOverflow = errors.New("distance overflow")
+
+// maxGrowsPerSet is the max number of grows for inserting a single new
+// item, beyond which growing is not helping, such as when many keys
+// have the same hash, and ErrDistanceOverflow is returned rather than
+// growing until memory or disk space runs out.
+const maxGrowsPerSet = 4
+
 // Key is the type for a key. A key with len() of 0 is invalid.
-// Key max length is 2^25-1 (~33MB).
 type Key []byte
 
 // Val is the type for a val. A nil val is valid.
-// Val max length is 2^25-1 (~33MB).
 type Val []byte
 
 // -------------------------------------------------------------------
@@ -55,7 +71,7 @@ type RHStore struct {
 	Slots []uint64
 
 	// Size is the max number of items this hashmap can hold.
-	// Size * 3 == len(Slots).
+	// Size * SlotsPerItem() == len(Slots).
 	Size int
 
 	// Bytes is the backing slice for key/val data that's used by the
@@ -65,7 +81,25 @@ type RHStore struct {
 	// Number of items in the RHStore.
 	Count int
 
-	// Overridable hash func. Defaults to hash/fnv.New32a().
+	// When InlineVals is true, vals are not kept in the backing bytes,
+	// but are instead kept directly in each item's metadata slots,
+	// where vals must be no larger than MaxInlineValLen. This avoids
+	// an extra indirection for applications with small, fixed-width
+	// vals, like counters. See Add() and Incr().
+	InlineVals bool
+
+	// When KeysOnly is true, each item uses only KeysOnlyItemLen
+	// slots, with no valOffset, so vals must be empty. This is useful
+	// for sets, like distinct or dedupe filters. See Distinct and
+	// NewRHStoreKeysOnly().
+	KeysOnly bool
+
+	// When ReadOnly is true, mutations return ErrReadOnly. See
+	// OpenSnapshot().
+	ReadOnly bool
+
+	// Overridable hash func. Defaults to HashFNV32a(), which has no
+	// state and is concurrent safe. See Freeze().
 	HashFunc func(Key) uint32
 
 	// When any item's distance gets too large, grow the RHStore.
@@ -79,6 +113,25 @@ type RHStore struct {
 	// Overridable func to grow the RHStore.
 	Grow func(m *RHStore, newSize int) error
 
+	// Old, when non-nil, is the RHStore from before an incremental
+	// grow, whose items are migrated into the Slots a few at a time by
+	// each mutation, and which lookups also consult until the migration
+	// is done. The Old RHStore shares the backing bytes.
+	// See GrowIncremental().
+	Old *RHStore
+
+	// MigrateIdx is the next slot of the Old RHStore to be migrated.
+	MigrateIdx int
+
+	// MigrateStep is the max number of Old item slots that are
+	// migrated by each mutation. Defaults to 8.
+	MigrateStep int
+
+	// MigrationDone is an optional callback that's invoked when all
+	// the items of the Old RHStore have been migrated, so that the
+	// Old slots can be released.
+	MigrationDone func(m *RHStore)
+
 	// Overridable func to truncate the backing bytes.
 	BytesTruncate func(m *RHStore, n uint64) error
 
@@ -88,6 +141,21 @@ type RHStore struct {
 	// Overridable func to read data from the backing bytes.
 	BytesRead func(m *RHStore, offset, size uint64) ([]byte, error)
 
+	// Overridable func to overwrite data in-place in the backing
+	// bytes, which is used by SetMerge().
+	BytesWrite func(m *RHStore, offset uint64, b []byte) error
+
+	// Optional func to place data into previously freed space of the
+	// backing bytes, if possible, otherwise appending it, which is
+	// used for vals. Defaults to nil, which means BytesAppend.
+	BytesAlloc func(m *RHStore, b []byte) (offset, size uint64, err error)
+
+	// Optional func that's invoked with the backing bytes of vals
+	// that were overwritten and of keys/vals that were deleted, so
+	// that their space can be reused by BytesAlloc. Defaults to nil,
+	// which means dead bytes are never reused.
+	BytesFree func(m *RHStore, offset, size uint64) error
+
 	// Extra is for optional data that the application wants to
 	// associate with the RHStore instance.
 	Extra interface{}
@@ -96,6 +164,13 @@ type RHStore struct {
 
 	// Temp is used during mutations to avoid memory allocations.
 	Temp Item
+
+	// MergeBuf is used by SetMerge() to avoid memory allocations.
+	MergeBuf []byte
+
+	// TempVal holds the previous val returned by Del() when
+	// InlineVals is true, as the item's slots are cleared.
+	TempVal [MaxInlineValLen]byte
 }
 
 // -------------------------------------------------------------------
@@ -109,16 +184,41 @@ type RHStore struct {
 // uint64 2: [14-bits distance] | [25 bits valSize] | [25 bits keySize]
 //
 // The len(Item) == 3 (i.e., 3 uint64's).  The key/val offsets are
-// into the RHStore's backing bytes.
+// into the RHStore's backing bytes. When the RHStore is configured
+// with InlineVals, uint64 1 instead holds the val bytes directly.
+//
+// When the RHStore is configured with KeysOnly, uint64 1 is omitted,
+// so the len(Item) == 2 and the valSize is always 0.
+//
+// A key or val that's larger than MaxKeyLen or MaxValLen has its size
+// encoded as SizeOverflow, where its offset then refers to a 16 byte
+// overflow descriptor in the backing bytes, holding the little-endian
+// offset and size (uint64's) of the actual key or val bytes.
 type Item []uint64
 
 const ItemLen = 3 // Number of uint64's needed for item metadata.
 
-// MaxKeyLen is representable by 25 bit number, or ~33MB.
-const MaxKeyLen = (1 << 25) - 1
+// KeysOnlyItemLen is the number of uint64's needed for item metadata
+// when the RHStore is configured with KeysOnly.
+const KeysOnlyItemLen = 2
+
+// MaxKeyLen is the largest key length that's directly representable
+// by the 25 bit keySize, or ~33MB. Larger keys use SizeOverflow.
+const MaxKeyLen = (1 << 25) - 2
 
-// MaxKeyLen is representable by 25 bit number, or ~33MB.
-const MaxValLen = (1 << 25) - 1
+// MaxValLen is the largest val length that's directly representable
+// by the 25 bit valSize, or ~33MB. Larger vals use SizeOverflow.
+const MaxValLen = (1 << 25) - 2
+
+// SizeOverflow is the special keySize or valSize for a key or val
+// whose actual offset and size are held in an overflow descriptor.
+const SizeOverflow = (1 << 25) - 1
+
+// OverflowDescLen is the length in bytes of an overflow descriptor.
+const OverflowDescLen = 16
+
+// MaxInlineValLen is the max val length when InlineVals is enabled.
+const MaxInlineValLen = 8
 
 const ShiftValSize = 25  // # of bits to left-shift a 25-bit ValSize.
 const ShiftDistance = 50 // # of bits to left-shift a 14-bit Distance.
@@ -127,28 +227,44 @@ const MaskKeySize = uint64(0x0000000001FFFFFF)  // 25 bits.
 const MaskValSize = uint64(0x0003FFFFFE000000)  // 25 bits << ShiftValSize.
 const MaskDistance = uint64(0xFFFC000000000000) // 14 bits << ShiftDistance.
 
+// MaxItemDistance is the largest distance that's representable by the
+// 14 bit distance of an item. An RHStore will grow, regardless of its
+// MaxDistance config, rather than let a distance become larger.
+const MaxItemDistance = (1 << 14) - 1
+
+// NOTE: The sizes and distance are always in the last uint64 of an
+// item, so that the same methods work for the KeysOnly layout.
+
 func (item Item) KeyOffsetSize() (uint64, uint64) {
-	return item[0], (item[2] & MaskKeySize)
+	return item[0], (item[len(item)-1] & MaskKeySize)
 }
 
 func (item Item) ValOffsetSize() (uint64, uint64) {
-	return item[1], (item[2] & MaskValSize) >> ShiftValSize
+	meta := item[len(item)-1]
+	if len(item) < ItemLen {
+		return 0, (meta & MaskValSize) >> ShiftValSize
+	}
+
+	return item[1], (meta & MaskValSize) >> ShiftValSize
 }
 
 func (item Item) Distance() uint64 {
-	return (item[2] & MaskDistance) >> ShiftDistance
+	return (item[len(item)-1] & MaskDistance) >> ShiftDistance
 }
 
 func (item Item) DistanceAdd(x int) {
-	item[2] = (item[2] & (MaskValSize | MaskKeySize)) |
+	meta := &item[len(item)-1]
+	*meta = (*meta & (MaskValSize | MaskKeySize)) |
 		(MaskDistance & (uint64(int(item.Distance())+x) << ShiftDistance))
 }
 
 func (item Item) Encode(
 	keyOffset, keySize, valOffset, valSize, distance uint64) {
 	item[0] = keyOffset
-	item[1] = valOffset
-	item[2] = (MaskDistance & (distance << ShiftDistance)) |
+	if len(item) >= ItemLen {
+		item[1] = valOffset
+	}
+	item[len(item)-1] = (MaskDistance & (distance << ShiftDistance)) |
 		(MaskValSize & (valSize << ShiftValSize)) |
 		(MaskKeySize & keySize)
 }
@@ -157,26 +273,22 @@ func (item Item) Encode(
 
 // NewRHStore returns a ready-to-use RHStore.
 func NewRHStore(size int) *RHStore {
-	h := fnv.New32a()
-
 	return &RHStore{
 		Slots: make([]uint64, size*ItemLen),
 
 		Size: size,
 
-		HashFunc: func(k Key) uint32 {
-			h.Reset()
-			h.Write(k)
-			return h.Sum32()
-		},
+		HashFunc: HashFNV32a,
 
 		MaxDistance: 10,
 		Growth:      func(m *RHStore) float64 { return 2.0 },
 		Grow:        Grow,
+		MigrateStep: 8,
 
 		BytesTruncate: BytesTruncate,
 		BytesAppend:   BytesAppend,
 		BytesRead:     BytesRead,
+		BytesWrite:    BytesWrite,
 
 		Close: func() error { return nil },
 
@@ -184,27 +296,191 @@ func NewRHStore(size int) *RHStore {
 	}
 }
 
+// HashFNV32a returns the same hash as hash/fnv.New32a(), but as a
+// stateless func that's concurrent safe and doesn't allocate.
+func HashFNV32a(k Key) uint32 {
+	h := uint32(fnvOffset32)
+	for _, c := range k {
+		h ^= uint32(c)
+		h *= fnvPrime32
+	}
+
+	return h
+}
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// NewRHStoreKeysOnly returns a ready-to-use RHStore that's configured
+// with KeysOnly.
+func NewRHStoreKeysOnly(size int) *RHStore {
+	m := NewRHStore(0)
+	m.SetKeysOnly(size)
+
+	return m
+}
+
+// SetKeysOnly configures the RHStore with KeysOnly, which must happen
+// before any items are set, and resizes its slots to hold size items.
+func (m *RHStore) SetKeysOnly(size int) {
+	m.KeysOnly = true
+	m.InlineVals = false
+	m.Slots = make([]uint64, size*KeysOnlyItemLen)
+	m.Size = size
+	m.Temp = m.Temp[:KeysOnlyItemLen]
+}
+
 // -------------------------------------------------------------------
 
+// SlotsPerItem returns the number of uint64 slots used by each item.
+func (m *RHStore) SlotsPerItem() int {
+	if m.KeysOnly {
+		return KeysOnlyItemLen
+	}
+
+	return ItemLen
+}
+
 func (m *RHStore) Item(idx int) Item {
-	pos := idx * ItemLen
-	return m.Slots[pos : pos+ItemLen]
+	n := m.SlotsPerItem()
+	pos := idx * n
+	return m.Slots[pos : pos+n]
 }
 
 func (m *RHStore) ItemKey(item Item) (Key, error) {
 	offset, size := item.KeyOffsetSize()
-	return m.BytesRead(m, offset, size)
+	return m.ReadBytes(offset, size)
 }
 
 func (m *RHStore) ItemVal(item Item) (Val, error) {
+	if m.KeysOnly {
+		return Val(nil), nil
+	}
+
 	offset, size := item.ValOffsetSize()
+	if m.InlineVals {
+		return inlineValBytes(item)[:size], nil
+	}
+
+	return m.ReadBytes(offset, size)
+}
+
+// -------------------------------------------------------------------
+
+// AppendBytes appends a key or val to the backing bytes, returning the
+// offset and size to be encoded into an item, along with the start
+// offset of all the backing bytes that were appended. A key or val
+// that's too large to have its size directly encoded in an item is
+// appended along with an overflow descriptor.
+func (m *RHStore) AppendBytes(b []byte) (
+	offset, size, start uint64, err error) {
+	return m.appendBytes(b, m.BytesAppend)
+}
+
+// allocBytes is like AppendBytes(), but uses the BytesAlloc func, if
+// any, so that the bytes might reuse previously freed space.
+func (m *RHStore) allocBytes(b []byte) (
+	offset, size, start uint64, err error) {
+	if m.BytesAlloc != nil {
+		return m.appendBytes(b, m.BytesAlloc)
+	}
+
+	return m.appendBytes(b, m.BytesAppend)
+}
+
+func (m *RHStore) appendBytes(b []byte,
+	bytesAppend func(m *RHStore, b []byte) (uint64, uint64, error)) (
+	offset, size, start uint64, err error) {
+	offset, size, err = bytesAppend(m, b)
+	if err != nil || len(b) <= MaxKeyLen {
+		return offset, size, offset, err
+	}
+
+	var desc [OverflowDescLen]byte
+	binary.LittleEndian.PutUint64(desc[:8], offset)
+	binary.LittleEndian.PutUint64(desc[8:], size)
+
+	descOffset, _, err := bytesAppend(m, desc[:])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return descOffset, SizeOverflow, offset, nil
+}
+
+// freeBytes passes the backing bytes of a key or val, given the offset
+// and size that were encoded into an item, along with any overflow
+// descriptor, to the BytesFree func, if any.
+func (m *RHStore) freeBytes(offset, size uint64) error {
+	if m.BytesFree == nil {
+		return nil
+	}
+
+	if size == SizeOverflow {
+		dataOffset, dataSize, err := m.ResolveOverflow(offset)
+		if err != nil {
+			return err
+		}
+
+		err = m.BytesFree(m, dataOffset, dataSize)
+		if err != nil {
+			return err
+		}
+
+		size = OverflowDescLen
+	}
+
+	return m.BytesFree(m, offset, size)
+}
+
+// freeRange passes a range of the backing bytes to the BytesFree func,
+// if any, where unlike freeBytes(), the size is never an overflow.
+func (m *RHStore) freeRange(offset, size uint64) error {
+	if m.BytesFree == nil || size == 0 {
+		return nil
+	}
+
+	return m.BytesFree(m, offset, size)
+}
+
+// ReadBytes reads a key or val from the backing bytes, given the
+// offset and size that were encoded into an item.
+func (m *RHStore) ReadBytes(offset, size uint64) ([]byte, error) {
+	if size == SizeOverflow {
+		var err error
+
+		offset, size, err = m.ResolveOverflow(offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return m.BytesRead(m, offset, size)
 }
 
+// ResolveOverflow returns the actual offset and size of a key or val
+// from its overflow descriptor.
+func (m *RHStore) ResolveOverflow(descOffset uint64) (
+	offset, size uint64, err error) {
+	desc, err := m.BytesRead(m, descOffset, OverflowDescLen)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return binary.LittleEndian.Uint64(desc[:8]),
+		binary.LittleEndian.Uint64(desc[8:]), nil
+}
+
 // -------------------------------------------------------------------
 
 // Reset clears RHStore, where already allocated memory will be reused.
 func (m *RHStore) Reset() error {
+	if m.ReadOnly {
+		return ErrReadOnly
+	}
+
 	slots := m.Slots
 	for i := 0; i < len(slots); i++ {
 		slots[i] = 0
@@ -212,6 +488,15 @@ func (m *RHStore) Reset() error {
 
 	m.Count = 0
 
+	if m.Old != nil {
+		m.Old = nil
+		m.MigrateIdx = 0
+
+		if m.MigrationDone != nil {
+			m.MigrationDone(m)
+		}
+	}
+
 	return m.BytesTruncate(m, 0)
 }
 
@@ -226,33 +511,88 @@ func (m *RHStore) Get(k Key) (v Val, found bool) {
 		return Val(nil), false
 	}
 
-	idx := int(m.HashFunc(k) % uint32(m.Size))
-	idxStart := idx
+	e, err := m.Find(k)
+	if err != nil || e == nil {
+		return Val(nil), false
+	}
+
+	itemVal, err := m.ItemVal(e)
+	if err != nil {
+		return Val(nil), false
+	}
+
+	return itemVal, true
+}
+
+// Find returns the item metadata slots for a given key, or nil if the
+// key was not found. The returned item is a slice into the RHStore's
+// Slots, or into the Old RHStore's Slots during an incremental grow,
+// and is only valid until the next mutation. Find does not migrate
+// items, so lookups are safe during a Visit().
+func (m *RHStore) Find(k Key) (Item, error) {
+	idx, err := m.FindIdx(k)
+	if err != nil {
+		return nil, err
+	}
+
+	if idx >= 0 {
+		return m.Item(idx), nil
+	}
+
+	if m.Old != nil {
+		return m.Old.Find(k)
+	}
+
+	return nil, nil
+}
+
+// FindIdx returns the slot index of the item for a given key, or -1
+// if the key was not found. Only the Slots are searched, not the Old
+// RHStore of an incremental grow.
+func (m *RHStore) FindIdx(k Key) (int, error) {
+	idx, _, found, err := m.probe(k)
+	if err != nil || !found {
+		return -1, err
+	}
+
+	return idx, nil
+}
+
+// probe looks for a key in the Slots, returning the slot index of its
+// item when found. Otherwise, the returned slot index and distance are
+// where the robin-hood walk to insert the key starts, which is the
+// first slot that's empty or that holds an item that's closer to its
+// best slot, as the key would have been placed before such an item.
+func (m *RHStore) probe(k Key) (
+	idx int, distance uint64, found bool, err error) {
+	idx = int(m.HashFunc(k) % uint32(m.Size))
 
 	for {
 		e := m.Item(idx)
 
+		if _, kSize := e.KeyOffsetSize(); kSize == 0 ||
+			e.Distance() < distance {
+			return idx, distance, false, nil
+		}
+
 		itemKey, err := m.ItemKey(e)
-		if err != nil || len(itemKey) == 0 {
-			return Val(nil), false
+		if err != nil {
+			return -1, 0, false, err
 		}
 
 		if bytes.Equal(itemKey, k) {
-			itemVal, err := m.ItemVal(e)
-			if err != nil {
-				return Val(nil), false
-			}
-
-			return itemVal, true
+			return idx, distance, true, nil
 		}
 
+		distance++
+
 		idx++
 		if idx >= m.Size {
 			idx = 0
 		}
 
-		if idx == idxStart { // Went all the way around.
-			return Val(nil), false
+		if distance >= uint64(m.Size) { // Went all the way around.
+			return idx, distance, false, nil
 		}
 	}
 }
@@ -267,88 +607,179 @@ func (m *RHStore) Get(k Key) (v Val, found bool) {
 // NOTE: RHStore appends or copies the incoming key/val into its
 // backing bytes. Multiple updates to the same key will continue to
 // grow the backing bytes -- i.e., the backing bytes are not reused or
-// recycled during a Set(). Applications that need to really remove
-// deleted bytes may instead use CopyTo() to copy live key/val data to
-// another RHStore. Applications might also mutate val bytes in-place
-// as another way to save allocations.
+// recycled during a Set(), unless the BytesAlloc and BytesFree funcs
+// are provided, as with an RHStoreFile. Applications that need to
+// really remove deleted bytes may instead use CopyTo() to copy live
+// key/val data to another RHStore. Applications might also mutate val
+// bytes in-place as another way to save allocations.
 func (m *RHStore) Set(k Key, v Val) (wasNew bool, err error) {
 	if len(k) == 0 {
 		return false, ErrKeyZeroLen
 	}
 
-	if len(k) > MaxKeyLen {
-		return false, ErrKeyTooBig
-	}
-
-	if len(v) > MaxValLen {
-		return false, ErrValTooBig
+	if m.ReadOnly {
+		return false, ErrReadOnly
 	}
 
-	// NOTE: BytesAppend() on v before k since an update to an
-	// existing item will clip away the unused BytesAppend(k).
-	vOffset, vSize, err := m.BytesAppend(m, v)
+	e, idx, distance, err := m.lookup(k)
 	if err != nil {
 		return false, err
 	}
 
-	kOffset, kSize, err := m.BytesAppend(m, k)
+	if e == nil {
+		err = m.insertNew(k, v, idx, distance)
+
+		return err == nil, err
+	}
+
+	vOffset, vSize, err := m.valBytes(v)
 	if err != nil {
 		return false, err
 	}
 
-	wasNew, err = m.SetOffsets(kOffset, kSize, vOffset, vSize)
-	if err == nil && wasNew == false {
-		// Truncate off the earlier BytesAppend(k) since updates will
-		// reuse the existing key.
-		err = m.BytesTruncate(m, kOffset)
+	// NOTE: We keep the same key during an update to avoid a
+	// duplicate key allocation.
+	return false, m.updateItem(e, vOffset, vSize)
+}
+
+func (m *RHStore) SetOffsets(kOffset, kSize, vOffset, vSize uint64) (
+	wasNew bool, err error) {
+	if m.ReadOnly {
+		return false, ErrReadOnly
+	}
+
+	if m.Old != nil {
+		// An update of an item that's still in the Old RHStore is
+		// done in-place, keeping its existing key, and the item is
+		// later migrated as usual.
+		k, err := m.ReadBytes(kOffset, kSize)
+		if err != nil {
+			return false, err
+		}
+
+		idx, err := m.Old.FindIdx(k)
+		if err != nil {
+			return false, err
+		}
+
+		if idx >= 0 {
+			return false, m.updateItem(m.Old.Item(idx), vOffset, vSize)
+		}
 	}
 
-	return wasNew, err
+	return m.setOffsets(kOffset, kSize, vOffset, vSize)
 }
 
-func (m *RHStore) SetOffsets(kOffset, kSize, vOffset, vSize uint64) (
+func (m *RHStore) setOffsets(kOffset, kSize, vOffset, vSize uint64) (
 	wasNew bool, err error) {
+	k, err := m.ReadBytes(kOffset, kSize)
+	if err != nil {
+		return false, err
+	}
+
+	idx, distance, found, err := m.probe(k)
+	if err != nil {
+		return false, err
+	}
+
+	if found {
+		// NOTE: We keep the same key during an update to avoid
+		// a duplicate key allocation.
+		return false, m.updateItem(m.Item(idx), vOffset, vSize)
+	}
+
+	if ok, _ := m.fits(idx, distance); ok {
+		m.insertAt(idx, distance, kOffset, kSize, vOffset, vSize)
+
+		return true, nil
+	}
+
+	// The RHStore is grown before any existing item is displaced, so
+	// a failed grow loses no item. As a grow might move the backing
+	// bytes, the item is then set again from a copy of its key/val.
 	incoming := m.Temp
 	incoming.Encode(kOffset, kSize, vOffset, vSize, 0)
 
-	incomingItemKey, err := m.ItemKey(incoming)
+	v, err := m.ItemVal(incoming)
 	if err != nil {
 		return false, err
 	}
 
-	idx := int(m.HashFunc(incomingItemKey) % uint32(m.Size))
-	idxStart := idx
+	kCopy := append([]byte(nil), k...)
+	vCopy := append([]byte(nil), v...)
 
-	for {
-		e := m.Item(idx)
+	err = m.Grow(m, int(float64(m.Size)*m.Growth(m)))
+	if err != nil {
+		return false, err
+	}
 
-		itemKey, err := m.ItemKey(e)
-		if err != nil {
-			return false, err
+	return m.Set(kCopy, vCopy)
+}
+
+// updateItem replaces the val of an existing item, keeping its key,
+// and frees the backing bytes of the replaced val.
+func (m *RHStore) updateItem(e Item, vOffset, vSize uint64) error {
+	eKeyOffset, eKeySize := e.KeyOffsetSize()
+	eValOffset, eValSize := e.ValOffsetSize()
+
+	e.Encode(eKeyOffset, eKeySize, vOffset, vSize, e.Distance())
+
+	return m.freeVal(eValOffset, eValSize)
+}
+
+// fits returns true when a new item can be inserted by insertAt(),
+// starting from the slot index and distance that were returned by
+// probe(), without exceeding the MaxDistance or the encoding of a
+// distance, and without going all the way around the Slots. The
+// robin-hood walk is simulated, so that no existing item is displaced
+// when the RHStore instead needs to grow. The returned overflow is
+// true when a distance would not fit its encoding.
+func (m *RHStore) fits(idx int, distance uint64) (ok, overflow bool) {
+	for walked := int(distance); ; walked++ {
+		if distance >= MaxItemDistance {
+			return false, true
 		}
 
-		if len(itemKey) == 0 {
-			copy(e, incoming)
-			m.Count++
-			return true, nil
+		if int(distance) > m.MaxDistance || walked >= m.Size {
+			return false, false
 		}
 
-		itemKeyIncoming, err := m.ItemKey(incoming)
-		if err != nil {
-			return false, err
+		e := m.Item(idx)
+
+		if _, eKeySize := e.KeyOffsetSize(); eKeySize == 0 {
+			return true, false
 		}
 
-		if bytes.Equal(itemKey, itemKeyIncoming) {
-			// NOTE: We keep the same key during an update to avoid
-			// a duplicate key allocation.
-			eKeyOffset, eKeySize := e.KeyOffsetSize()
+		// A swap means the walk continues with the displaced item.
+		if e.Distance() < distance {
+			distance = e.Distance()
+		}
+
+		distance++
+
+		idx++
+		if idx >= m.Size {
+			idx = 0
+		}
+	}
+}
 
-			iValOffset, iValSize := incoming.ValOffsetSize()
+// insertAt inserts a new item for a key that's known to be missing,
+// starting the robin-hood walk from the slot index and distance that
+// were returned by probe(), so the walk does not compare keys. The
+// caller must first check that the item fits().
+func (m *RHStore) insertAt(idx int, distance uint64,
+	kOffset, kSize, vOffset, vSize uint64) {
+	incoming := m.Temp
+	incoming.Encode(kOffset, kSize, vOffset, vSize, distance)
 
-			e.Encode(eKeyOffset, eKeySize, iValOffset, iValSize,
-				incoming.Distance())
+	for {
+		e := m.Item(idx)
 
-			return false, nil
+		if _, eKeySize := e.KeyOffsetSize(); eKeySize == 0 {
+			copy(e, incoming)
+			m.Count++
+			return
 		}
 
 		// Swap if the incoming item is further from its best idx,
@@ -366,30 +797,270 @@ func (m *RHStore) SetOffsets(kOffset, kSize, vOffset, vSize uint64) (
 		if idx >= m.Size {
 			idx = 0
 		}
+	}
+}
 
-		// Grow if distances become big or we went all the way around.
-		if int(incoming.Distance()) > m.MaxDistance || idx == idxStart {
-			k, err := m.ItemKey(incoming)
-			if err != nil {
-				return false, err
-			}
+// -------------------------------------------------------------------
 
-			v, err := m.ItemVal(incoming)
-			if err != nil {
-				return false, err
-			}
+// MergeFunc combines the existing val of an item with an incoming
+// val, appending the merged result to out and returning it. The
+// existing val is nil when the key is being newly inserted. See
+// MergeSumUint64(), MergeCount(), etc, for ready-made merge funcs.
+type MergeFunc func(existing, incoming Val, out []byte) []byte
+
+// SetMerge inserts or updates a key/val into the RHStore, where the
+// val that's actually stored is the result of the merge func, which
+// is useful for aggregations. The key is looked up with a single
+// probe, where a new key is inserted starting from where the probe
+// missed. An existing key's merged val is written in-place into the
+// backing bytes when it fits within the existing val's size,
+// otherwise the merged val is appended to the backing bytes.
+func (m *RHStore) SetMerge(k Key, v Val, merge MergeFunc) (
+	wasNew bool, err error) {
+	if len(k) == 0 {
+		return false, ErrKeyZeroLen
+	}
 
-			kCopy := append([]byte(nil), k...)
-			vCopy := append([]byte(nil), v...)
+	if m.ReadOnly {
+		return false, ErrReadOnly
+	}
 
-			err = m.Grow(m, int(float64(m.Size)*m.Growth(m)))
-			if err != nil {
-				return false, err
-			}
+	e, idx, distance, err := m.lookup(k)
+	if err != nil {
+		return false, err
+	}
+
+	if e == nil {
+		m.MergeBuf = merge(nil, v, m.MergeBuf[:0])
+
+		err = m.insertNew(k, m.MergeBuf, idx, distance)
+
+		return err == nil, err
+	}
+
+	existing, err := m.ItemVal(e)
+	if err != nil {
+		return false, err
+	}
+
+	m.MergeBuf = merge(existing, v, m.MergeBuf[:0])
+
+	return false, m.SetItemVal(e, m.MergeBuf)
+}
+
+// SetItemVal updates the val of an existing item, overwriting the
+// item's val bytes in-place when the new val fits, otherwise the new
+// val is appended to the backing bytes.
+func (m *RHStore) SetItemVal(e Item, v Val) error {
+	if m.ReadOnly {
+		return ErrReadOnly
+	}
+
+	kOffset, kSize := e.KeyOffsetSize()
 
-			return m.Set(kCopy, vCopy)
+	if m.InlineVals || m.KeysOnly {
+		if len(v) > MaxInlineValLen || (m.KeysOnly && len(v) > 0) {
+			return ErrValTooBig
+		}
+
+		e.Encode(kOffset, kSize, inlineValWord(v), uint64(len(v)),
+			e.Distance())
+
+		return nil
+	}
+
+	vOffset, vSize := e.ValOffsetSize()
+	if vSize == SizeOverflow {
+		var err error
+
+		vOffset, vSize, err = m.ResolveOverflow(vOffset)
+		if err != nil {
+			return err
 		}
 	}
+
+	if uint64(len(v)) > vSize {
+		eValOffset, eValSize := e.ValOffsetSize()
+
+		vOffset, vSize, _, err := m.allocBytes(v)
+		if err != nil {
+			return err
+		}
+
+		e.Encode(kOffset, kSize, vOffset, vSize, e.Distance())
+
+		return m.freeVal(eValOffset, eValSize)
+	}
+
+	err := m.BytesWrite(m, vOffset, v)
+	if err != nil {
+		return err
+	}
+
+	// Free the tail of the val's bytes that the shrunk val no longer
+	// uses.
+	err = m.freeRange(vOffset+uint64(len(v)), vSize-uint64(len(v)))
+	if err != nil {
+		return err
+	}
+
+	if len(v) <= MaxValLen {
+		descOffset, descSize := e.ValOffsetSize()
+
+		e.Encode(kOffset, kSize, vOffset, uint64(len(v)), e.Distance())
+
+		if descSize == SizeOverflow {
+			// The overflow descriptor is no longer used.
+			return m.freeRange(descOffset, OverflowDescLen)
+		}
+
+		return nil
+	}
+
+	// The shrunk val still needs an overflow descriptor.
+	var desc [OverflowDescLen]byte
+	binary.LittleEndian.PutUint64(desc[:8], vOffset)
+	binary.LittleEndian.PutUint64(desc[8:], uint64(len(v)))
+
+	descOffset, _ := e.ValOffsetSize()
+
+	return m.BytesWrite(m, descOffset, desc[:])
+}
+
+// -------------------------------------------------------------------
+
+// Add treats the val of a key as a little-endian encoded uint64 and
+// adds delta to it, returning the resulting sum. A key that does not
+// exist yet is inserted with a val of delta. Add is not atomic, but
+// is efficient when used with InlineVals.
+func (m *RHStore) Add(k Key, delta uint64) (uint64, error) {
+	if len(k) == 0 {
+		return 0, ErrKeyZeroLen
+	}
+
+	if m.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	e, idx, distance, err := m.lookup(k)
+	if err != nil {
+		return 0, err
+	}
+
+	if e == nil {
+		m.MergeBuf = AppendUint64(m.MergeBuf[:0], delta)
+
+		return delta, m.insertNew(k, m.MergeBuf, idx, distance)
+	}
+
+	v, err := m.ItemVal(e)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := Uint64(v) + delta
+
+	m.MergeBuf = AppendUint64(m.MergeBuf[:0], sum)
+
+	return sum, m.SetItemVal(e, m.MergeBuf)
+}
+
+// lookup is like Find(), but is used by mutations, so it first takes
+// a migration step of an incremental grow. When the key is not found,
+// the returned slot index and distance are where the probe of the
+// Slots missed, for a later insertNew().
+func (m *RHStore) lookup(k Key) (
+	e Item, idx int, distance uint64, err error) {
+	if m.Old != nil {
+		err = m.Migrate(m.MigrateStep)
+		if err != nil {
+			return nil, -1, 0, err
+		}
+	}
+
+	idx, distance, found, err := m.probe(k)
+	if err != nil {
+		return nil, -1, 0, err
+	}
+
+	if found {
+		return m.Item(idx), idx, distance, nil
+	}
+
+	if m.Old != nil {
+		e, err = m.Old.Find(k)
+		if err != nil {
+			return nil, -1, 0, err
+		}
+	}
+
+	return e, idx, distance, nil
+}
+
+// insertNew inserts a key/val for a key that lookup() did not find,
+// starting from the slot index and distance where lookup() missed.
+// The RHStore is grown first if the item does not fit, before the
+// key/val is placed into the backing bytes, as a grow might move the
+// backing bytes. Growing stops with ErrDistanceOverflow after the
+// maxGrowsPerSet, or when a distance still overflows after a grow.
+func (m *RHStore) insertNew(k Key, v Val, idx int, distance uint64) error {
+	for grows := 0; ; grows++ {
+		ok, overflow := m.fits(idx, distance)
+		if ok {
+			break
+		}
+
+		if (overflow && grows > 0) || grows >= maxGrowsPerSet {
+			return ErrDistanceOverflow
+		}
+
+		err := m.Grow(m, int(float64(m.Size)*m.Growth(m)))
+		if err != nil {
+			return err
+		}
+
+		// The key is still missing, from both the grown Slots and
+		// any Old RHStore of an incremental grow.
+		idx, distance, _, err = m.probe(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	vOffset, vSize, err := m.valBytes(v)
+	if err != nil {
+		return err
+	}
+
+	kOffset, kSize, _, err := m.AppendBytes(k)
+	if err != nil {
+		return err
+	}
+
+	m.insertAt(idx, distance, kOffset, kSize, vOffset, vSize)
+
+	return nil
+}
+
+// valBytes places a val into the backing bytes, unless the val is
+// inlined, returning the offset and size to be encoded into an item.
+func (m *RHStore) valBytes(v Val) (offset, size uint64, err error) {
+	if m.InlineVals || m.KeysOnly {
+		if len(v) > MaxInlineValLen || (m.KeysOnly && len(v) > 0) {
+			return 0, 0, ErrValTooBig
+		}
+
+		return inlineValWord(v), uint64(len(v)), nil
+	}
+
+	offset, size, _, err = m.allocBytes(v)
+
+	return offset, size, err
+}
+
+// Incr is Add() with a delta of 1.
+func (m *RHStore) Incr(k Key) (uint64, error) {
+	return m.Add(k, 1)
 }
 
 // -------------------------------------------------------------------
@@ -398,44 +1069,81 @@ func (m *RHStore) SetOffsets(kOffset, kSize, vOffset, vSize uint64) (
 // existed, is returned.
 //
 // NOTE: RHStore does not remove key/val data from its backing bytes,
-// so deletes of items will not reduce memory usage. Applications may
-// instead use CopyTo() to copy any remaining live key/val data to
-// another, potentially smaller RHStore.
+// so deletes of items will not reduce memory usage, although with a
+// BytesFree func, the deleted bytes may be reused by later mutations,
+// so the returned prev val is only valid until the next mutation.
+// Applications may instead use CopyTo() to copy any remaining live
+// key/val data to another, potentially smaller RHStore.
 func (m *RHStore) Del(k Key) (prev Val, existed bool, err error) {
 	if len(k) == 0 {
 		return Val(nil), false, ErrKeyZeroLen
 	}
 
-	idx := int(m.HashFunc(k) % uint32(m.Size))
-	idxStart := idx
-
-	for {
-		e := m.Item(idx)
+	if m.ReadOnly {
+		return Val(nil), false, ErrReadOnly
+	}
 
-		itemKey, err := m.ItemKey(e)
-		if err != nil || len(itemKey) == 0 {
+	if m.Old != nil {
+		err = m.Migrate(m.MigrateStep)
+		if err != nil {
 			return Val(nil), false, err
 		}
+	}
 
-		if bytes.Equal(itemKey, k) {
-			prev, err = m.ItemVal(e)
-			if err != nil {
-				return Val(nil), false, err
-			}
+	idx, err := m.FindIdx(k)
+	if err != nil {
+		return Val(nil), false, err
+	}
 
-			break // Found the item.
+	if idx < 0 {
+		if m.Old != nil {
+			prev, existed, err = m.Old.Del(k)
+			if existed {
+				m.Count--
+			}
 		}
 
-		idx++
-		if idx >= m.Size {
-			idx = 0
-		}
+		return prev, existed, err
+	}
 
-		if idx == idxStart {
-			return Val(nil), false, nil
-		}
+	prev, err = m.ItemVal(m.Item(idx))
+	if err != nil {
+		return Val(nil), false, err
+	}
+
+	if m.InlineVals {
+		// The item's slots are about to be overwritten.
+		prev = m.TempVal[:copy(m.TempVal[:], prev)]
+	}
+
+	e := m.Item(idx)
+
+	kOffset, kSize := e.KeyOffsetSize()
+	vOffset, vSize := e.ValOffsetSize()
+
+	m.delIdx(idx)
+
+	// The freed bytes of prev are only reused by a later mutation.
+	err = m.freeBytes(kOffset, kSize)
+	if err == nil {
+		err = m.freeVal(vOffset, vSize)
+	}
+
+	return prev, true, err
+}
+
+// freeVal is like freeBytes(), but for a val, which has no backing
+// bytes when the InlineVals or KeysOnly features are used.
+func (m *RHStore) freeVal(offset, size uint64) error {
+	if m.InlineVals || m.KeysOnly {
+		return nil
 	}
 
+	return m.freeBytes(offset, size)
+}
+
+// delIdx removes the item at a slot index of the Slots.
+func (m *RHStore) delIdx(idx int) {
 	// Left-shift succeeding items in the linear chain.
 	for {
 		next := idx + 1
@@ -449,12 +1157,9 @@ func (m *RHStore) Del(k Key) (prev Val, existed bool, err error) {
 
 		maybeShift := m.Item(next)
 
-		maybeShiftKey, err := m.ItemKey(maybeShift)
-		if err != nil {
-			return Val(nil), false, err
-		}
+		_, maybeShiftKeySize := maybeShift.KeyOffsetSize()
 
-		if len(maybeShiftKey) == 0 || maybeShift.Distance() <= 0 {
+		if maybeShiftKeySize == 0 || maybeShift.Distance() <= 0 {
 			break // The next item is non-shiftable.
 		}
 
@@ -471,8 +1176,6 @@ func (m *RHStore) Del(k Key) (prev Val, existed bool, err error) {
 	}
 
 	m.Count--
-
-	return prev, true, nil
 }
 
 // -------------------------------------------------------------------
@@ -491,6 +1194,10 @@ func (m *RHStore) Visit(
 	for i := 0; i < m.Size; i++ {
 		e := m.Item(i)
 
+		if _, kSize := e.KeyOffsetSize(); kSize == 0 {
+			continue
+		}
+
 		itemKey, err := m.ItemKey(e)
 		if err != nil {
 			return err
@@ -508,6 +1215,10 @@ func (m *RHStore) Visit(
 		}
 	}
 
+	if m.Old != nil {
+		return m.Old.Visit(callback)
+	}
+
 	return nil
 }
 
@@ -520,7 +1231,7 @@ func (m *RHStore) VisitOffsets(
 		e := m.Item(i)
 
 		kOffset, kSize := e.KeyOffsetSize()
-		if kOffset != 0 && kSize != 0 {
+		if kSize != 0 {
 			vOffset, vSize := e.ValOffsetSize()
 
 			if !callback(kOffset, kSize, vOffset, vSize) {
@@ -529,6 +1240,64 @@ func (m *RHStore) VisitOffsets(
 		}
 	}
 
+	if m.Old != nil {
+		return m.Old.VisitOffsets(callback)
+	}
+
+	return nil
+}
+
+// -------------------------------------------------------------------
+
+// Validate checks the item metadata slots of the RHStore, where every
+// item's distance must match the actual distance of the item from its
+// best or home position, and the number of items must match Count.
+// The Old RHStore of an incremental grow is also checked.
+func (m *RHStore) Validate() error {
+	count := 0
+
+	for i := 0; i < m.Size; i++ {
+		e := m.Item(i)
+
+		if _, kSize := e.KeyOffsetSize(); kSize == 0 {
+			continue
+		}
+
+		itemKey, err := m.ItemKey(e)
+		if err != nil {
+			return err
+		}
+
+		home := int(m.HashFunc(itemKey) % uint32(m.Size))
+
+		distance := i - home
+		if distance < 0 {
+			distance += m.Size
+		}
+
+		if uint64(distance) != e.Distance() {
+			return fmt.Errorf("rhstore: Validate idx: %d, home: %d,"+
+				" distance: %d, expected distance: %d",
+				i, home, e.Distance(), distance)
+		}
+
+		count++
+	}
+
+	if m.Old != nil {
+		err := m.Old.Validate()
+		if err != nil {
+			return err
+		}
+
+		count += m.Old.Count
+	}
+
+	if count != m.Count {
+		return fmt.Errorf("rhstore: Validate count: %d, expected: %d",
+			m.Count, count)
+	}
+
 	return nil
 }
 
@@ -537,19 +1306,141 @@ func (m *RHStore) VisitOffsets(
 // Grow is the default implementation to grow a RHStore.
 func Grow(m *RHStore, newSize int) error {
 	grow := NewRHStore(newSize)
+	if m.KeysOnly {
+		grow.SetKeysOnly(newSize)
+	}
 	grow.HashFunc = m.HashFunc
+	grow.InlineVals = m.InlineVals
 	grow.MaxDistance = m.MaxDistance
 	grow.Growth = m.Growth
 	grow.Grow = m.Grow
 	grow.BytesTruncate = m.BytesTruncate
 	grow.BytesAppend = m.BytesAppend
 	grow.BytesRead = m.BytesRead
+	grow.BytesWrite = m.BytesWrite
+	grow.BytesAlloc = m.BytesAlloc
+	grow.BytesFree = m.BytesFree
 	grow.Extra = m.Extra
+	grow.MigrateStep = m.MigrateStep
+	grow.MigrationDone = m.MigrationDone
+
+	hadOld := m.Old != nil
 
 	m.CopyTo(grow)
 
 	*m = *grow
 
+	if hadOld && m.MigrationDone != nil {
+		m.MigrationDone(m)
+	}
+
+	return nil
+}
+
+// GrowIncremental is an alternative implementation to grow a RHStore,
+// which avoids a long pause by keeping the existing items as the Old
+// RHStore, to be migrated a few at a time by later mutations. If
+// a migration is still in progress, the RHStore is grown by Grow().
+func GrowIncremental(m *RHStore, newSize int) error {
+	if m.Old != nil {
+		return Grow(m, newSize)
+	}
+
+	m.StartMigration(make([]uint64, newSize*m.SlotsPerItem()), newSize)
+
+	return nil
+}
+
+// StartMigration moves the current items into a new Old RHStore, and
+// continues with the given, empty slots, which hold size items. This
+// is meant to be used by incremental grow implementations.
+func (m *RHStore) StartMigration(slots []uint64, size int) {
+	old := &RHStore{}
+	*old = *m
+
+	// The Old RHStore reads the backing bytes through this RHStore,
+	// as the default backing bytes are a slice that keeps growing.
+	old.BytesTruncate = func(_ *RHStore, n uint64) error {
+		return m.BytesTruncate(m, n)
+	}
+	old.BytesAppend = func(_ *RHStore, b []byte) (uint64, uint64, error) {
+		return m.BytesAppend(m, b)
+	}
+	old.BytesRead = func(_ *RHStore, offset, size uint64) ([]byte, error) {
+		return m.BytesRead(m, offset, size)
+	}
+	old.BytesWrite = func(_ *RHStore, offset uint64, b []byte) error {
+		return m.BytesWrite(m, offset, b)
+	}
+	if m.BytesFree != nil {
+		old.BytesFree = func(_ *RHStore, offset, size uint64) error {
+			return m.BytesFree(m, offset, size)
+		}
+	}
+
+	m.Slots = slots
+	m.Size = size
+	m.Old = old
+	m.MigrateIdx = 0
+}
+
+// Migrate moves the items of up to n Old item slots into the Slots.
+// When all the Old items have been migrated, the Old RHStore is
+// dropped and the MigrationDone callback is invoked.
+func (m *RHStore) Migrate(n int) error {
+	for ; n > 0 && m.Old != nil; n-- {
+		if m.MigrateIdx >= m.Old.Size || m.Old.Count <= 0 {
+			m.Old = nil
+			m.MigrateIdx = 0
+
+			if m.MigrationDone != nil {
+				m.MigrationDone(m)
+			}
+
+			break
+		}
+
+		e := m.Old.Item(m.MigrateIdx)
+
+		kOffset, kSize := e.KeyOffsetSize()
+		if kSize == 0 {
+			m.MigrateIdx++
+			continue
+		}
+
+		vOffset, vSize := e.ValOffsetSize()
+
+		// The item is set before it's deleted from the Old items, so
+		// a failed set, such as a failed grow, loses no item.
+		_, err := m.setOffsets(kOffset, kSize, vOffset, vSize)
+		if err != nil {
+			return err
+		}
+
+		// A grow during the set copies all the Old items, which
+		// completes the migration.
+		if m.Old == nil {
+			break
+		}
+
+		// The del left-shifts the succeeding items, so the slot at
+		// the MigrateIdx is revisited until it's empty.
+		m.Old.delIdx(m.MigrateIdx)
+		m.Count--
+	}
+
+	return nil
+}
+
+// FinishMigration migrates all of the remaining Old items.
+func (m *RHStore) FinishMigration() error {
+	for m.Old != nil {
+		err := m.Migrate(m.Old.Size + 1)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -575,3 +1466,10 @@ func BytesAppend(m *RHStore, b []byte) (offset, size uint64, err error) {
 func BytesRead(m *RHStore, offset, size uint64) ([]byte, error) {
 	return m.Bytes[offset : offset+size], nil
 }
+
+// BytesWrite is the default implementation to overwrite data in-place
+// in the backing bytes of an RHStore.
+func BytesWrite(m *RHStore, offset uint64, b []byte) error {
+	copy(m.Bytes[offset:offset+uint64(len(b))], b)
+	return nil
+}
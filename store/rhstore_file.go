@@ -20,7 +20,8 @@ import (
 // hashmap based on the robin-hood algorithm, and which will also
 // spill out to mmap()'ed files if the hashmap becomes too big. The
 // returned RHStoreFile is not concurrent safe. Providing a pathPrefix
-// that's already in-use has undefined behavior.
+// that's already in-use has undefined behavior, so see SpillDir for
+// handing out unique path prefixes.
 func CreateRHStoreFile(pathPrefix string, options RHStoreFileOptions) (
 	rv *RHStoreFile, err error) {
 	sf := &RHStoreFile{
@@ -28,13 +29,35 @@ func CreateRHStoreFile(pathPrefix string, options RHStoreFileOptions) (
 		Options:    options,
 		RHStore:    *(NewRHStore(0)),
 		Chunks: Chunks{
-			PathPrefix:     pathPrefix,
-			FileSuffix:     options.FileSuffix,
-			ChunkSizeBytes: options.ChunkSizeBytes,
+			PathPrefix:        pathPrefix,
+			FileSuffix:        options.FileSuffix,
+			ChunkSizeBytes:    options.ChunkSizeBytes,
+			Quota:             options.Quota,
+			QuotaOwner:        options.QuotaOwner,
+			Compress:          options.CompressChunks,
+			CacheChunks:       options.CompressCacheChunks,
+			Pool:              options.ChunkPool,
+			CatchFaults:       options.CatchFaults,
+			FileIO:            options.FileIO,
+			FileIOCacheChunks: options.FileIOCacheChunks,
+			SingleFile:        options.SingleChunkFile,
+			Advice:            AdviseRandom, // For point lookups.
 		},
 	}
 
-	slots, err := CreateFileAsMMapRef("", options.StartSize*8*ItemLen)
+	// A chunk is allocated while a mutation might hold an item, so
+	// only the chunks are spilled then, and the in-memory slots are
+	// replaced by a slots file at the next Grow().
+	sf.Chunks.UseMemory = func(size int) (bool, error) {
+		return sf.UseMemory(size, false)
+	}
+
+	if options.KeysOnly {
+		sf.RHStore.SetKeysOnly(0)
+	}
+
+	slots, err := CreateFileAsMMapRef("",
+		options.StartSize*8*sf.RHStore.SlotsPerItem())
 	if err != nil {
 		return nil, err
 	}
@@ -50,22 +73,29 @@ func CreateRHStoreFile(pathPrefix string, options RHStoreFileOptions) (
 
 	sf.RHStore.MaxDistance = options.MaxDistance
 
+	sf.RHStore.InlineVals = options.InlineVals && !options.KeysOnly
+
 	sf.RHStore.Grow = func(m *RHStore, newSize int) error {
 		return sf.Grow(newSize)
 	}
 
-	sf.RHStore.BytesTruncate = func(m *RHStore, size uint64) error {
-		return sf.Chunks.BytesTruncate(size)
-	}
+	// The Chunks are also an Allocator, so the bytes of overwritten
+	// vals and of deleted items are reused.
+	sf.RHStore.UseByteStore(&sf.Chunks)
+
+	if options.NewByteStore != nil {
+		sf.ByteStore, err = options.NewByteStore(pathPrefix)
+		if err != nil {
+			sf.Close()
+
+			return nil, err
+		}
 
-	sf.RHStore.BytesAppend = func(m *RHStore, b []byte) (
-		offsetOut, sizeOut uint64, err error) {
-		return sf.Chunks.BytesAppend(b)
+		sf.RHStore.UseByteStore(sf.ByteStore)
 	}
 
-	sf.RHStore.BytesRead = func(m *RHStore, offset, size uint64) (
-		[]byte, error) {
-		return sf.Chunks.BytesRead(offset, size)
+	sf.RHStore.MigrationDone = func(m *RHStore) {
+		sf.removeOldSlots()
 	}
 
 	sf.RHStore.Close = sf.Close
@@ -76,10 +106,12 @@ func CreateRHStoreFile(pathPrefix string, options RHStoreFileOptions) (
 // ---------------------------------------------
 
 // RHStoreFile represents a persisted hashmap. Its implementation is
-// not concurrent safe.
+// not concurrent safe, except after Freeze(), when concurrent Get()'s
+// are allowed.
 //
-// Unlike an RHMap or RHStore, the key's and val's in an RHStoreFile
-// may not be larger than the Options.ChunkSizeBytes.
+// The key's and val's in an RHStoreFile that are larger than the
+// Options.ChunkSizeBytes are stored across multiple chunk files, and
+// reading such a key or val returns a copy of its bytes.
 //
 // The design point is to support applications that need to process or
 // analyze ephemeral data which becomes large enough to not fit
@@ -111,9 +143,27 @@ type RHStoreFile struct {
 	// reference key/val byte slices in the chunks.
 	Slots *MMapRef
 
+	// OldSlots holds the item metadata slots of the RHStore.Old
+	// during an incremental grow.
+	OldSlots *MMapRef
+
 	// Chunks is a sequence of append-only chunk files which hold the
-	// underlying key/val bytes for the hashmap.
+	// underlying key/val bytes for the hashmap, unless there's a
+	// ByteStore.
 	Chunks
+
+	// ByteStore, when non-nil, holds the underlying key/val bytes
+	// instead of the Chunks. See Options.NewByteStore.
+	ByteStore ByteStore
+
+	// Spilled is true once the in-memory chunks have been moved out to
+	// files due to the Options.MemoryBudgetBytes, after which the
+	// slots are also kept in files.
+	Spilled bool
+
+	// ReadOnlyFiles is true when the RHStoreFile was opened by
+	// OpenFrozenRHStoreFile(), so Close() leaves the files in place.
+	ReadOnlyFiles bool
 }
 
 // ---------------------------------------------
@@ -132,13 +182,90 @@ type RHStoreFileOptions struct {
 	MaxDistance int
 
 	// ChunkSizeBytes is the size of each chunk file in bytes.
-	// No key or val can be larger than ChunkSizeBytes.
+	// A key or val larger than ChunkSizeBytes spans multiple chunks.
 	// ChunkSizeBytes must be > 0.
 	ChunkSizeBytes int
 
 	// FileSuffix is the file suffix used for all the files that were
 	// created or managed by an RHStoreFile.
 	FileSuffix string
+
+	// InlineVals configures the RHStore.InlineVals feature, where
+	// small, fixed-width vals are kept directly in the metadata slots.
+	InlineVals bool
+
+	// IncrementalGrow, when true, avoids long pauses when growing the
+	// slots, by migrating items from the old slots to the new slots a
+	// few at a time, during later mutations. See RHStore.Old.
+	IncrementalGrow bool
+
+	// KeysOnly configures the RHStore.KeysOnly feature, where items
+	// have no valOffset and vals must be empty, for a smaller slots
+	// footprint. KeysOnly takes precedence over InlineVals.
+	KeysOnly bool
+
+	// MemoryBudgetBytes, when > 0, allows grown slots and additional
+	// chunks to be kept in anonymous memory until their total size
+	// would exceed MemoryBudgetBytes, and only then are the slots and
+	// chunks spilled to files, where slots that are in memory when a
+	// new chunk exceeds the budget are moved to a file by the next
+	// Grow(). When 0, only the initial slots and the 0'th chunk are
+	// kept in memory.
+	MemoryBudgetBytes int
+
+	// Quota, when non-nil, limits the bytes of the slots and chunk
+	// files, where a Grow() or a new chunk that would exceed the
+	// quota fails with ErrDiskQuotaExceeded. A Quota can be shared
+	// by many RHStoreFile's, Chunks and Heap's.
+	Quota *DiskQuota
+
+	// QuotaOwner is the owner name that's used with the Quota, and
+	// defaults to the path prefix.
+	QuotaOwner string
+
+	// CompressChunks, when true, compresses each full chunk of
+	// key/val bytes once appends move past it. See Chunks.Compress.
+	CompressChunks bool
+
+	// CompressCacheChunks is the max number of decompressed chunks
+	// that are cached for reads. See Chunks.CacheChunks.
+	CompressCacheChunks int
+
+	// CatchFaults, when true, returns memory faults while copying
+	// key/val bytes into and out of the chunk files as ErrMMapFault,
+	// instead of crashing the process. See Chunks.CatchFaults.
+	CatchFaults bool
+
+	// FileIO, when true, reads and writes the chunk files with file
+	// I/O instead of mmap(), for when mmap()'s are limited, where at
+	// most FileIOCacheChunks chunk files are kept in memory. A slots
+	// file is still mmap()'ed, as a single mapping, so the slots can
+	// spill and need not fit in memory. See Chunks.FileIO.
+	FileIO bool
+
+	// FileIOCacheChunks is the max number of chunk files that are kept
+	// in memory in the FileIO mode. See Chunks.FileIOCacheChunks.
+	FileIOCacheChunks int
+
+	// SingleChunkFile, when true, holds the chunks in the windows of a
+	// single file, instead of in a file per chunk. See
+	// Chunks.SingleFile.
+	SingleChunkFile bool
+
+	// ChunkPool, when non-nil, lends the chunk files, and can be shared
+	// by many RHStoreFile's, Chunks and Heap's. See Chunks.Pool.
+	ChunkPool *ChunkPool
+
+	// NewByteStore, when non-nil, is invoked with the path prefix to
+	// create the ByteStore that holds the key/val bytes, instead of
+	// the default Chunks. The ByteStore is closed with the
+	// RHStoreFile. A ByteStore's bytes are not part of the
+	// MemoryBudgetBytes or the Quota.
+	NewByteStore func(pathPrefix string) (ByteStore, error)
+
+	// OnSpill is an optional callback that's invoked when the slots
+	// and chunks are spilled to files due to the MemoryBudgetBytes.
+	OnSpill func(sf *RHStoreFile)
 }
 
 // DefaultRHStoreFileOptions are the default values for options.
@@ -157,42 +284,96 @@ func (sf *RHStoreFile) Close() error {
 
 	sf.Generation = math.MaxInt64
 
-	if sf.Slots != nil {
+	if sf.ReadOnlyFiles {
 		sf.Slots.Close()
-		sf.Slots.Remove()
+		sf.Slots = nil
+
+		for _, chunk := range sf.Chunks.Chunks {
+			chunk.Close()
+		}
+		sf.Chunks.Chunks = nil
+
+		return nil
+	}
+
+	if sf.Slots != nil {
+		sf.Chunks.removeFile(sf.Slots)
 		sf.Slots = nil
 	}
 
+	sf.removeOldSlots()
+
 	sf.Chunks.Close()
 
+	if sf.ByteStore != nil {
+		sf.ByteStore.Close()
+		sf.ByteStore = nil
+	}
+
 	return nil
 }
 
 // ---------------------------------------------
 
 // Grow creates a new slots file and copies over existing metadata
-// items from RHStore.Slots, if any.
+// items from RHStore.Slots, if any. With the Options.IncrementalGrow,
+// the existing slots are instead kept as the RHStore.Old, and are
+// migrated to the new slots a few items at a time.
 func (sf *RHStoreFile) Grow(nextSize int) error {
 	nextGeneration := sf.Generation + 1
 
-	nextSlotsPath := fmt.Sprintf("%s_slots_%09d%s",
-		sf.PathPrefix, nextGeneration, sf.Options.FileSuffix)
+	nextSlotsPath := sf.SlotsPath(nextGeneration)
+
+	nextSlotsSize := nextSize * 8 * sf.RHStore.SlotsPerItem()
+
+	// The existing slots are replaced by the next slots, so they do
+	// not need to be spilled.
+	useMemory, err := sf.UseMemory(nextSlotsSize, false)
+	if err != nil {
+		return err
+	}
+
+	if useMemory {
+		nextSlotsPath = ""
+	}
 
-	nextSlots, err :=
-		CreateFileAsMMapRef(nextSlotsPath, nextSize*8*ItemLen)
+	nextSlots, err := sf.Chunks.createMappedFile(nextSlotsPath, nextSlotsSize)
 	if err != nil {
 		return err
 	}
 
 	cleanup := func(err error) error {
-		nextSlots.Close()
-		nextSlots.Remove()
+		sf.Chunks.removeFile(nextSlots)
+
+		sf.Slots.Advise(AdviseRandom)
 
 		return err
 	}
 
+	nextSlots.Advise(AdviseRandom)
+
+	if sf.Options.IncrementalGrow && sf.RHStore.Old == nil {
+		slots, err := ByteSliceToUint64Slice(nextSlots.Buf)
+		if err != nil {
+			return cleanup(err)
+		}
+
+		sf.RHStore.StartMigration(slots, nextSize)
+
+		sf.Generation = nextGeneration
+
+		sf.OldSlots = sf.Slots
+		sf.Slots = nextSlots
+
+		return nil
+	}
+
 	var nextRHStore RHStore = sf.RHStore // Copy existing RHStore.
 
+	// Any in-progress migration is completed by the copying.
+	nextRHStore.Old = nil
+	nextRHStore.MigrateIdx = 0
+
 	nextRHStore.Slots, err = ByteSliceToUint64Slice(nextSlots.Buf)
 	if err != nil {
 		return cleanup(err)
@@ -203,32 +384,215 @@ func (sf *RHStoreFile) Grow(nextSize int) error {
 	nextRHStore.Count = 0
 
 	// While copying, we temporarily max out the MaxDistance, to avoid
-	// a recursion of growing while we're growing.
+	// a recursion of growing while we're growing. A distance that
+	// would still overflow its encoding is instead an error.
 	origRHStoreMaxDistance := nextRHStore.MaxDistance
 	nextRHStore.MaxDistance = math.MaxInt32
 
-	// Copy the existing key/val offset/size metadata to nextRHStore.
+	origRHStoreGrow := nextRHStore.Grow
+	nextRHStore.Grow = func(m *RHStore, newSize int) error {
+		return ErrDistanceOverflow
+	}
+
+	// The copying only places the existing offsets into the next
+	// slots, so it must never allocate or free the shared key/val
+	// bytes, which are still in use by the existing slots.
+	origRHStoreBytesAlloc := nextRHStore.BytesAlloc
+	origRHStoreBytesFree := nextRHStore.BytesFree
+	nextRHStore.BytesAlloc = nil
+	nextRHStore.BytesFree = nil
+
+	// Copy the existing key/val offset/size metadata to nextRHStore,
+	// which scans the existing slots in order.
+	sf.Slots.Advise(AdviseSequential)
+
+	var errSet error
+
 	err = sf.RHStore.VisitOffsets(
 		func(kOffset, kSize, vOffset, vSize uint64) bool {
-			nextRHStore.SetOffsets(kOffset, kSize, vOffset, vSize)
-			return true
+			_, errSet = nextRHStore.SetOffsets(kOffset, kSize, vOffset, vSize)
+			return errSet == nil
 		})
+	if err == nil {
+		err = errSet
+	}
 	if err != nil {
 		return cleanup(err)
 	}
 
 	nextRHStore.MaxDistance = origRHStoreMaxDistance
 
+	nextRHStore.Grow = origRHStoreGrow
+
+	nextRHStore.BytesAlloc = origRHStoreBytesAlloc
+	nextRHStore.BytesFree = origRHStoreBytesFree
+
 	sf.RHStore = nextRHStore
 
 	sf.Generation = nextGeneration
 
 	if sf.Slots != nil {
-		sf.Slots.Close()
-		sf.Slots.Remove()
+		sf.Chunks.removeFile(sf.Slots)
 	}
 
 	sf.Slots = nextSlots
 
+	sf.removeOldSlots()
+
+	return nil
+}
+
+// removeOldSlots releases the slots of the RHStore.Old, if any.
+func (sf *RHStoreFile) removeOldSlots() {
+	if sf.OldSlots != nil {
+		sf.Chunks.removeFile(sf.OldSlots)
+		sf.OldSlots = nil
+	}
+}
+
+// ---------------------------------------------
+
+// SlotsPath returns the file path of the slots for a generation.
+func (sf *RHStoreFile) SlotsPath(generation int64) string {
+	return fmt.Sprintf("%s_slots_%09d%s",
+		sf.PathPrefix, generation, sf.Options.FileSuffix)
+}
+
+// MemoryBytes returns the number of bytes of slots and chunks that
+// are held in memory rather than in files.
+func (sf *RHStoreFile) MemoryBytes() int {
+	rv := sf.Chunks.MemoryBytes()
+
+	if sf.Slots != nil && sf.Slots.Path == "" {
+		rv += len(sf.Slots.Buf)
+	}
+
+	if sf.OldSlots != nil && sf.OldSlots.Path == "" {
+		rv += len(sf.OldSlots.Buf)
+	}
+
+	return rv
+}
+
+// UseMemory returns true when an additional size bytes may be kept
+// in memory within the Options.MemoryBudgetBytes. Otherwise, the
+// in-memory chunks, and optionally the in-memory slots, are spilled.
+func (sf *RHStoreFile) UseMemory(size int, spillSlots bool) (
+	bool, error) {
+	if sf.Options.MemoryBudgetBytes <= 0 || sf.Spilled {
+		return false, nil
+	}
+
+	if sf.MemoryBytes()+size <= sf.Options.MemoryBudgetBytes {
+		return true, nil
+	}
+
+	return false, sf.spill(spillSlots)
+}
+
+// Spill moves the in-memory slots and chunks, other than the 0'th
+// chunk, out to files.
+func (sf *RHStoreFile) Spill() error {
+	return sf.spill(true)
+}
+
+func (sf *RHStoreFile) spill(spillSlots bool) error {
+	err := sf.spillFiles(spillSlots)
+	if err != nil {
+		return err
+	}
+
+	sf.Spilled = true
+
+	if sf.Options.OnSpill != nil {
+		sf.Options.OnSpill(sf)
+	}
+
 	return nil
 }
+
+// spillFiles moves the in-memory chunks, other than the 0'th chunk,
+// and optionally the in-memory slots, out to files.
+func (sf *RHStoreFile) spillFiles(spillSlots bool) error {
+	err := sf.Chunks.SpillToFiles()
+	if err != nil {
+		return err
+	}
+
+	if spillSlots && sf.Slots != nil && sf.Slots.Path == "" {
+		slots, err := sf.Chunks.createMappedFile(
+			sf.SlotsPath(sf.Generation), len(sf.Slots.Buf))
+		if err != nil {
+			return err
+		}
+
+		// Copy from RHStore.Slots, which works for the safe build tag.
+		slotsBytes, err := Uint64SliceToByteSlice(sf.RHStore.Slots)
+		if err == nil {
+			copy(slots.Buf, slotsBytes)
+
+			sf.RHStore.Slots, err = ByteSliceToUint64Slice(slots.Buf)
+		}
+		if err != nil {
+			sf.Chunks.removeFile(slots)
+
+			return err
+		}
+
+		sf.Slots.Close()
+
+		sf.Slots = slots
+
+		sf.Slots.Advise(AdviseRandom)
+	}
+
+	return nil
+}
+
+// ---------------------------------------------
+
+// Flush writes the modified chunk files, or the ByteStore when it's a
+// Flusher, to disk before the slots files, so that with FlushSync the
+// flushed slots never refer to key/val bytes that are not yet on disk.
+// The in-memory slots and chunks are not flushed, so see Spill() or
+// Freeze() for moving them into files first.
+func (sf *RHStoreFile) Flush(mode FlushMode) error {
+	var err error
+
+	if sf.ByteStore != nil {
+		if f, ok := sf.ByteStore.(Flusher); ok {
+			err = f.Flush(mode)
+		}
+	} else {
+		err = sf.Chunks.Flush(mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = sf.OldSlots.Flush(mode)
+	if err != nil {
+		return err
+	}
+
+	return sf.Slots.Flush(mode)
+}
+
+// ---------------------------------------------
+
+// Visit invokes the callback on each key/val, like RHStore.Visit(),
+// while hinting that the slots are scanned sequentially.
+func (sf *RHStoreFile) Visit(
+	callback func(k Key, v Val) (keepGoing bool)) error {
+	sf.advise(AdviseSequential)
+
+	defer sf.advise(AdviseRandom)
+
+	return sf.RHStore.Visit(callback)
+}
+
+// advise passes an access pattern hint for the slots.
+func (sf *RHStoreFile) advise(advice Advice) {
+	sf.Slots.Advise(advice)
+	sf.OldSlots.Advise(advice)
+}
@@ -0,0 +1,483 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// CreatePartitionedRHStoreFile starts a brand new
+// PartitionedRHStoreFile, which splits its keys by hash into
+// partitions, where each partition is either a resident RHStoreFile
+// or, once memory runs out, an append-only log of mutations held in
+// chunk files -- the classic "grace hash" approach. The returned
+// PartitionedRHStoreFile is not concurrent safe.
+func CreatePartitionedRHStoreFile(pathPrefix string,
+	options PartitionedRHStoreFileOptions) (
+	*PartitionedRHStoreFile, error) {
+	if options.NumPartitions <= 0 {
+		return nil, fmt.Errorf("partitioned: NumPartitions must be > 0")
+	}
+
+	h := fnv.New32() // Not fnv.New32a(), which the partitions use.
+
+	return &PartitionedRHStoreFile{
+		PathPrefix: pathPrefix,
+		Options:    options,
+		Partitions: make([]Partition, options.NumPartitions),
+		HashFunc: func(k Key) uint32 {
+			h.Reset()
+			h.Write(k)
+			return h.Sum32()
+		},
+	}, nil
+}
+
+// ---------------------------------------------
+
+// PartitionedRHStoreFile is a hashmap that's split by key hash into a
+// fixed number of partitions. Recently accessed partitions are kept
+// resident as RHStoreFile's, and when the memory used by the resident
+// partitions exceeds the Options.MemoryBudgetBytes, the least recently
+// accessed partitions become cold, where a cold partition's data and
+// any further mutations are only appended to a log in chunk files.
+// A cold partition is rebuilt from its log when it's needed again,
+// such as for a Get() or, temporarily, during a Visit().
+type PartitionedRHStoreFile struct {
+	// PathPrefix is the path prefix of any persisted files.
+	PathPrefix string
+
+	// Options configured for this PartitionedRHStoreFile instance.
+	Options PartitionedRHStoreFileOptions
+
+	// Partitions holds the hash partitions.
+	Partitions []Partition
+
+	// Overridable hash func that assigns keys to partitions. Defaults
+	// to hash/fnv.New32(), as the partitions use hash/fnv.New32a().
+	HashFunc func(Key) uint32
+
+	// Clock is incremented on every access to a partition.
+	Clock uint64
+
+	// Temp is used to encode log records.
+	Temp []byte
+}
+
+// Partition represents a single hash partition.
+type Partition struct {
+	// Store is the resident hashmap of the partition, or is nil when
+	// the partition is cold.
+	Store *RHStoreFile
+
+	// Log holds the append-only records of a cold partition.
+	Log *Heap
+
+	// LastAccess is the Clock of the latest access to the partition.
+	LastAccess uint64
+}
+
+// PartitionedRHStoreFileOptions represents creation-time configurable
+// options for a PartitionedRHStoreFile.
+type PartitionedRHStoreFileOptions struct {
+	// NumPartitions is the number of hash partitions, and must be > 0.
+	NumPartitions int
+
+	// MemoryBudgetBytes is the budget for the memory used by all the
+	// resident partitions, beyond which partitions become cold.
+	MemoryBudgetBytes int
+
+	// PartitionOptions are the options for the RHStoreFile of each
+	// resident partition. The ChunkSizeBytes and FileSuffix are also
+	// used for the logs of cold partitions.
+	PartitionOptions RHStoreFileOptions
+}
+
+// DefaultPartitionedRHStoreFileOptions are the default values for
+// options, where each resident partition may use memory up to the
+// entire MemoryBudgetBytes before it spills by itself.
+var DefaultPartitionedRHStoreFileOptions = PartitionedRHStoreFileOptions{
+	NumPartitions:     16,
+	MemoryBudgetBytes: 64 * 1024 * 1024, // 64MB.
+	PartitionOptions: RHStoreFileOptions{
+		StartSize:         5303,
+		ChunkSizeBytes:    4 * 1024 * 1024, // 4MB.
+		MaxDistance:       10,
+		FileSuffix:        ".rhstore",
+		MemoryBudgetBytes: 64 * 1024 * 1024,
+	},
+}
+
+// Log record ops.
+const (
+	partitionLogSet = 's'
+	partitionLogDel = 'd'
+)
+
+// ---------------------------------------------
+
+// Close releases resources used by the PartitionedRHStoreFile.
+func (sp *PartitionedRHStoreFile) Close() error {
+	for i := range sp.Partitions {
+		p := &sp.Partitions[i]
+
+		if p.Store != nil {
+			p.Store.Close()
+			p.Store = nil
+		}
+
+		if p.Log != nil {
+			p.Log.Close()
+			p.Log = nil
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------
+
+// Get retrieves the val for a given key, making the key's partition
+// resident if it was cold. The returned val is only valid until the
+// next mutation of the PartitionedRHStoreFile.
+func (sp *PartitionedRHStoreFile) Get(k Key) (Val, bool, error) {
+	if len(k) == 0 {
+		return Val(nil), false, nil
+	}
+
+	p, err := sp.Resident(sp.PartitionIdx(k))
+	if err != nil {
+		return Val(nil), false, err
+	}
+
+	v, found := p.Store.Get(k)
+
+	return v, found, nil
+}
+
+// Set inserts or updates a key/val. A resident partition is updated
+// directly, while a set on a cold partition is appended to its log.
+func (sp *PartitionedRHStoreFile) Set(k Key, v Val) error {
+	return sp.mutate(partitionLogSet, k, v)
+}
+
+// Del removes a key/val. A resident partition is updated directly,
+// while a del on a cold partition is appended to its log.
+func (sp *PartitionedRHStoreFile) Del(k Key) error {
+	return sp.mutate(partitionLogDel, k, nil)
+}
+
+func (sp *PartitionedRHStoreFile) mutate(op byte, k Key, v Val) error {
+	if len(k) == 0 {
+		return ErrKeyZeroLen
+	}
+
+	idx := sp.PartitionIdx(k)
+
+	p := sp.access(idx)
+	if p.Log != nil {
+		return sp.appendLog(p, op, k, v)
+	}
+
+	if p.Store == nil {
+		store, err := sp.createStore(idx)
+		if err != nil {
+			return err
+		}
+
+		p.Store = store
+	}
+
+	// Only check the memory budget when the partition's memory might
+	// have changed, which is when its slots or chunks were added.
+	before := p.Store.Generation + int64(len(p.Store.Chunks.Chunks))
+
+	var err error
+	if op == partitionLogSet {
+		_, err = p.Store.Set(k, v)
+	} else {
+		_, _, err = p.Store.Del(k)
+	}
+	if err != nil {
+		return err
+	}
+
+	if before != p.Store.Generation+int64(len(p.Store.Chunks.Chunks)) {
+		return sp.CheckMemoryBudget()
+	}
+
+	return nil
+}
+
+// ---------------------------------------------
+
+// Visit invokes the callback on each key/val, processing the
+// partitions one at a time, where a cold partition is temporarily
+// rebuilt from its log. The callback can return false to stop the
+// visitation early.
+func (sp *PartitionedRHStoreFile) Visit(
+	callback func(k Key, v Val) (keepGoing bool)) error {
+	keepGoing := true
+
+	visitor := func(k Key, v Val) bool {
+		keepGoing = callback(k, v)
+		return keepGoing
+	}
+
+	for idx := range sp.Partitions {
+		p := &sp.Partitions[idx]
+
+		if p.Store != nil {
+			err := p.Store.Visit(visitor)
+			if err != nil {
+				return err
+			}
+		} else if p.Log != nil {
+			store, err := sp.replayLog(idx)
+			if err != nil {
+				return err
+			}
+
+			err = store.Visit(visitor)
+
+			store.Close()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if !keepGoing {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------
+
+// PartitionIdx returns the partition index for a key.
+func (sp *PartitionedRHStoreFile) PartitionIdx(k Key) int {
+	return int(sp.HashFunc(k) % uint32(len(sp.Partitions)))
+}
+
+// MemoryBytes returns the memory used by the resident partitions.
+func (sp *PartitionedRHStoreFile) MemoryBytes() (rv int) {
+	for i := range sp.Partitions {
+		if sp.Partitions[i].Store != nil {
+			rv += sp.Partitions[i].Store.MemoryBytes()
+		}
+	}
+
+	return rv
+}
+
+// Resident returns the partition for a given index, making the
+// partition resident by rebuilding it from its log if it was cold.
+func (sp *PartitionedRHStoreFile) Resident(idx int) (*Partition, error) {
+	p := sp.access(idx)
+
+	if p.Store == nil {
+		var store *RHStoreFile
+		var err error
+
+		if p.Log != nil {
+			store, err = sp.replayLog(idx)
+			if err == nil {
+				err = p.Log.Close()
+
+				p.Log = nil
+			}
+		} else {
+			store, err = sp.createStore(idx)
+		}
+
+		if err != nil {
+			if store != nil {
+				store.Close()
+			}
+
+			return nil, err
+		}
+
+		p.Store = store
+
+		err = sp.CheckMemoryBudget()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// CheckMemoryBudget makes the least recently accessed resident
+// partitions cold until the memory used by the resident partitions
+// fits within the Options.MemoryBudgetBytes. The most recently
+// accessed partition is always kept resident.
+func (sp *PartitionedRHStoreFile) CheckMemoryBudget() error {
+	for sp.MemoryBytes() > sp.Options.MemoryBudgetBytes {
+		coldest := -1
+
+		for i := range sp.Partitions {
+			p := &sp.Partitions[i]
+			if p.Store != nil && p.LastAccess != sp.Clock &&
+				(coldest < 0 ||
+					p.LastAccess < sp.Partitions[coldest].LastAccess) {
+				coldest = i
+			}
+		}
+
+		if coldest < 0 {
+			return nil
+		}
+
+		err := sp.Evict(coldest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Evict makes a resident partition cold by appending its key/vals to
+// the partition's log and closing its RHStoreFile. The RHStoreFile is
+// only closed once the whole log is written, so on an error, such as
+// ErrDiskQuotaExceeded, the partition stays resident.
+func (sp *PartitionedRHStoreFile) Evict(idx int) error {
+	p := &sp.Partitions[idx]
+	if p.Store == nil {
+		return nil
+	}
+
+	p.Log = &Heap{
+		Heap: &Chunks{
+			PathPrefix:        sp.partitionPrefix(idx) + "_log",
+			FileSuffix:        sp.Options.PartitionOptions.FileSuffix,
+			ChunkSizeBytes:    16 * 1024,
+			Quota:             sp.Options.PartitionOptions.Quota,
+			QuotaOwner:        sp.Options.PartitionOptions.QuotaOwner,
+			Pool:              sp.Options.PartitionOptions.ChunkPool,
+			FileIO:            sp.Options.PartitionOptions.FileIO,
+			FileIOCacheChunks: sp.Options.PartitionOptions.FileIOCacheChunks,
+			SingleFile:        sp.Options.PartitionOptions.SingleChunkFile,
+		},
+		Data: &Chunks{
+			PathPrefix:        sp.partitionPrefix(idx) + "_logData",
+			FileSuffix:        sp.Options.PartitionOptions.FileSuffix,
+			ChunkSizeBytes:    sp.Options.PartitionOptions.ChunkSizeBytes,
+			Quota:             sp.Options.PartitionOptions.Quota,
+			QuotaOwner:        sp.Options.PartitionOptions.QuotaOwner,
+			Pool:              sp.Options.PartitionOptions.ChunkPool,
+			FileIO:            sp.Options.PartitionOptions.FileIO,
+			FileIOCacheChunks: sp.Options.PartitionOptions.FileIOCacheChunks,
+			SingleFile:        sp.Options.PartitionOptions.SingleChunkFile,
+		},
+	}
+
+	var err error
+
+	errVisit := p.Store.Visit(func(k Key, v Val) bool {
+		err = sp.appendLog(p, partitionLogSet, k, v)
+		return err == nil
+	})
+	if err == nil {
+		err = errVisit
+	}
+	if err != nil {
+		// The partition stays resident, and its partial log and the
+		// log's files are removed.
+		p.Log.Close()
+		p.Log = nil
+
+		return err
+	}
+
+	p.Store.Close()
+	p.Store = nil
+
+	return nil
+}
+
+// ---------------------------------------------
+
+func (sp *PartitionedRHStoreFile) access(idx int) *Partition {
+	sp.Clock++
+
+	p := &sp.Partitions[idx]
+	p.LastAccess = sp.Clock
+
+	return p
+}
+
+func (sp *PartitionedRHStoreFile) partitionPrefix(idx int) string {
+	return fmt.Sprintf("%s_p%04d", sp.PathPrefix, idx)
+}
+
+func (sp *PartitionedRHStoreFile) createStore(idx int) (
+	*RHStoreFile, error) {
+	return CreateRHStoreFile(sp.partitionPrefix(idx),
+		sp.Options.PartitionOptions)
+}
+
+// appendLog appends a record to a cold partition's log, where the
+// record is encoded as [op][log record of k/v]. See AppendLogRecord().
+func (sp *PartitionedRHStoreFile) appendLog(p *Partition,
+	op byte, k Key, v Val) error {
+	sp.Temp = append(sp.Temp[:0], op)
+	sp.Temp = AppendLogRecord(sp.Temp, k, v)
+
+	return p.Log.PushBytes(sp.Temp)
+}
+
+// replayLog builds a new RHStoreFile from a cold partition's log.
+func (sp *PartitionedRHStoreFile) replayLog(idx int) (
+	*RHStoreFile, error) {
+	store, err := sp.createStore(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	log := sp.Partitions[idx].Log
+
+	for i := int64(0); i < log.CurItems; i++ {
+		rec, err := log.Get(i)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+
+		if len(rec) <= 0 {
+			store.Close()
+			return nil, ErrLogRecordCorrupt
+		}
+
+		k, v, err := DecodeLogRecord(rec[1:])
+		if err == nil {
+			if rec[0] == partitionLogSet {
+				_, err = store.Set(k, v)
+			} else {
+				_, _, err = store.Del(k)
+			}
+		}
+
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
@@ -0,0 +1,166 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPartitionedRHStoreFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testPartitioned")
+	defer os.RemoveAll(dir)
+
+	options := DefaultPartitionedRHStoreFileOptions
+	options.NumPartitions = 4
+	options.MemoryBudgetBytes = 4000
+	options.PartitionOptions.StartSize = 10
+	options.PartitionOptions.ChunkSizeBytes = 256
+	options.PartitionOptions.MemoryBudgetBytes = 4000
+
+	sp, err := CreatePartitionedRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sp.Close()
+
+	g := map[string]string{}
+
+	numCold := func() (rv int) {
+		for _, p := range sp.Partitions {
+			if p.Log != nil {
+				rv++
+			}
+		}
+		return rv
+	}
+
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("k%d", i%700)
+		v := fmt.Sprintf("v%d", i)
+
+		if i%7 == 0 {
+			err = sp.Del([]byte(k))
+			delete(g, k)
+		} else {
+			err = sp.Set([]byte(k), []byte(v))
+			g[k] = v
+		}
+		if err != nil {
+			t.Fatalf("i: %d, err: %v", i, err)
+		}
+	}
+
+	if numCold() == 0 {
+		t.Fatalf("expected some cold partitions")
+	}
+
+	if sp.MemoryBytes() > options.MemoryBudgetBytes {
+		t.Fatalf("expected memory within budget, got: %d",
+			sp.MemoryBytes())
+	}
+
+	visited := map[string]string{}
+
+	err = sp.Visit(func(k Key, v Val) bool {
+		visited[string(k)] = string(v)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(visited) != len(g) {
+		t.Fatalf("visited: %d, expected: %d", len(visited), len(g))
+	}
+
+	for k, v := range g {
+		if visited[k] != v {
+			t.Fatalf("visit k: %s, got: %s, expected: %s", k, visited[k], v)
+		}
+	}
+
+	// A Get() makes a cold partition resident again.
+	for k, v := range g {
+		got, found, err := sp.Get([]byte(k))
+		if err != nil || !found || string(got) != v {
+			t.Fatalf("get k: %s, got: %s, %t, %v", k, got, found, err)
+		}
+
+		if sp.Partitions[sp.PartitionIdx([]byte(k))].Store == nil {
+			t.Fatalf("expected resident partition after get")
+		}
+	}
+
+	_, found, err := sp.Get([]byte("not-there"))
+	if err != nil || found {
+		t.Fatalf("expected not found, got: %t, %v", found, err)
+	}
+
+	if err = sp.Set(nil, nil); err != ErrKeyZeroLen {
+		t.Fatalf("expected ErrKeyZeroLen, got: %v", err)
+	}
+}
+
+func TestPartitionedRHStoreFileEvictError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testPartitioned")
+	defer os.RemoveAll(dir)
+
+	options := DefaultPartitionedRHStoreFileOptions
+	options.NumPartitions = 1
+	options.PartitionOptions.StartSize = 10
+	options.PartitionOptions.ChunkSizeBytes = 256
+	options.PartitionOptions.MemoryBudgetBytes = 1024 * 1024
+
+	// The in-memory partition needs no files, while its log does.
+	options.PartitionOptions.Quota = NewDiskQuota(1)
+
+	sp, err := CreatePartitionedRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sp.Close()
+
+	for i := 0; i < 100; i++ {
+		err = sp.Set([]byte(fmt.Sprintf("k%d", i)), []byte("val"))
+		if err != nil {
+			t.Fatalf("i: %d, err: %v", i, err)
+		}
+	}
+
+	err = sp.Evict(0)
+	if err != ErrDiskQuotaExceeded {
+		t.Fatalf("expected ErrDiskQuotaExceeded, got: %v", err)
+	}
+
+	// The partition stays resident, without a partial log.
+	p := &sp.Partitions[0]
+	if p.Store == nil || p.Log != nil {
+		t.Fatalf("expected resident partition after failed evict")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Fatalf("expected no log files, got: %d", len(files))
+	}
+
+	for i := 0; i < 100; i++ {
+		v, found, err := sp.Get([]byte(fmt.Sprintf("k%d", i)))
+		if err != nil || !found || string(v) != "val" {
+			t.Fatalf("i: %d, get got: %s, %t, %v", i, v, found, err)
+		}
+	}
+}
@@ -15,8 +15,12 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -252,6 +256,9 @@ func test(t *testing.T, r *RHStore,
 		if rwasNew != gwasNew {
 			t.Fatalf("ops: %d, set different wasNew", ops)
 		}
+		if err = r.Validate(); err != nil {
+			t.Fatalf("ops: %d, set validate err: %v", ops, err)
+		}
 
 		checkCopyTo()
 	}
@@ -276,6 +283,9 @@ func test(t *testing.T, r *RHStore,
 		if rexisted != gexisted {
 			t.Fatalf("ops: %d, del different existed", ops)
 		}
+		if err = r.Validate(); err != nil {
+			t.Fatalf("ops: %d, del validate err: %v", ops, err)
+		}
 
 		checkCopyTo()
 	}
@@ -447,19 +457,33 @@ func TestRHStoreFileBigKeyVal(t *testing.T) {
 
 	r := &sf.RHStore
 
-	big := make([]byte, options.ChunkSizeBytes+1)
+	big := []byte("0123456789X")
+	if len(big) != options.ChunkSizeBytes+1 {
+		t.Fatalf("expected big to be larger than ChunkSizeBytes")
+	}
 
+	// Keys and vals larger than ChunkSizeBytes span chunks.
 	wasNew, err := r.Set(big, []byte("a"))
-	if err == nil || wasNew {
-		t.Errorf("expected err, got: %v, %t", err, wasNew)
+	if err != nil || !wasNew {
+		t.Errorf("expected no err, got: %v, %t", err, wasNew)
 	}
 
 	wasNew, err = r.Set([]byte("a"), big)
-	if err == nil || wasNew {
-		t.Errorf("expected err, got: %v, %t", err, wasNew)
+	if err != nil || !wasNew {
+		t.Errorf("expected no err, got: %v, %t", err, wasNew)
 	}
 
-	justRight := make([]byte, options.ChunkSizeBytes)
+	v, found := r.Get(big)
+	if !found || string(v) != "a" {
+		t.Errorf("expected big key, got: %s, %t", v, found)
+	}
+
+	v, found = r.Get([]byte("a"))
+	if !found || string(v) != string(big) {
+		t.Errorf("expected big val, got: %s, %t", v, found)
+	}
+
+	justRight := []byte("0123456789")
 
 	wasNew, err = r.Set(justRight, []byte("a"))
 	if err != nil || !wasNew {
@@ -467,12 +491,17 @@ func TestRHStoreFileBigKeyVal(t *testing.T) {
 	}
 
 	wasNew, err = r.Set([]byte("a"), justRight)
-	if err != nil || !wasNew {
+	if err != nil || wasNew {
 		t.Errorf("expected no err, got: %v, %t", err, wasNew)
 	}
 
-	if len(sf.Chunks.Chunks) != 4 {
-		t.Errorf("expected 4 chunks after inserting justRight, got: %d",
+	v, found = r.Get([]byte("a"))
+	if !found || string(v) != string(justRight) {
+		t.Errorf("expected justRight val, got: %s, %t", v, found)
+	}
+
+	if len(sf.Chunks.Chunks) != 5 {
+		t.Errorf("expected 5 chunks after inserting justRight, got: %d",
 			len(sf.Chunks.Chunks))
 	}
 
@@ -486,8 +515,8 @@ func TestRHStoreFileBigKeyVal(t *testing.T) {
 		}
 	}
 
-	if sf.Chunks.LastChunkLen != 1 { // For key "a"
-		t.Errorf("expected LastChunkLen == 1, got: %d",
+	if sf.Chunks.LastChunkLen != 10 { // An update does not append key "a".
+		t.Errorf("expected LastChunkLen == 10, got: %d",
 			sf.Chunks.LastChunkLen)
 	}
 
@@ -499,3 +528,709 @@ func TestRHStoreFileBigKeyVal(t *testing.T) {
 		t.Errorf("expected slots to be in-memory")
 	}
 }
+
+func TestInlineVals(t *testing.T) {
+	r := NewRHStore(10)
+	r.InlineVals = true
+	test(t, r, true, nil)
+	r.Reset()
+	test(t, r, true, nil)
+
+	testInlineVals(t, r)
+}
+
+func TestRHStoreFileInlineVals(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testRHStoreFile")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 2
+	options.InlineVals = true
+
+	sf, err := CreateRHStoreFile(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	r := &sf.RHStore
+
+	test(t, r, true, nil)
+	r.Reset()
+	test(t, r, true, nil)
+
+	testInlineVals(t, r)
+}
+
+func testInlineVals(t *testing.T, r *RHStore) {
+	r.Reset()
+
+	wasNew, err := r.Set([]byte("big"), []byte("123456789"))
+	if err != ErrValTooBig || wasNew {
+		t.Fatalf("expected ErrValTooBig, got: %v, %t", err, wasNew)
+	}
+
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("counter-%d", i%10))
+
+		n, err := r.Incr(k)
+		if err != nil {
+			t.Fatalf("incr err: %v", err)
+		}
+		if n != uint64(i/10+1) {
+			t.Fatalf("i: %d, wrong incr: %d", i, n)
+		}
+	}
+
+	if r.Count != 10 {
+		t.Fatalf("expected 10 counters, got: %d", r.Count)
+	}
+
+	n, err := r.Add([]byte("counter-0"), 1000)
+	if err != nil || n != 1100 {
+		t.Fatalf("expected 1100, got: %d, err: %v", n, err)
+	}
+
+	v, found := r.Get([]byte("counter-0"))
+	if !found || Uint64(v) != 1100 {
+		t.Fatalf("expected get 1100, got: %v, %t", v, found)
+	}
+
+	prev, existed, err := r.Del([]byte("counter-0"))
+	if err != nil || !existed || Uint64(prev) != 1100 {
+		t.Fatalf("expected del 1100, got: %v, %t, %v", prev, existed, err)
+	}
+
+	if _, err = r.Add(nil, 1); err != ErrKeyZeroLen {
+		t.Fatalf("expected ErrKeyZeroLen, got: %v", err)
+	}
+}
+
+func TestRHStoreFileSpanningChunks(t *testing.T) {
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 2
+	options.ChunkSizeBytes = 2
+	testRHStoreFile(t, options)
+
+	dir, _ := ioutil.TempDir("", "testRHStoreFile")
+	defer os.RemoveAll(dir)
+
+	sf, err := CreateRHStoreFile(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	r := &sf.RHStore
+
+	// Updates of spanning keys truncate back across chunks.
+	k := []byte("a key that spans many chunks")
+
+	for i := 0; i < 10; i++ {
+		v := []byte(fmt.Sprintf("val-%d", i))
+
+		wasNew, err := r.Set(k, v)
+		if err != nil || wasNew != (i == 0) {
+			t.Fatalf("i: %d, set got: %v, %t", i, err, wasNew)
+		}
+
+		got, found := r.Get(k)
+		if !found || string(got) != string(v) {
+			t.Fatalf("i: %d, get got: %s, %t", i, got, found)
+		}
+	}
+}
+
+func TestOverflowKeyVal(t *testing.T) {
+	r := NewRHStore(10)
+
+	big := make([]byte, MaxValLen+10)
+	big[len(big)-1] = 'z'
+
+	for _, kv := range [][2][]byte{
+		{[]byte("a"), big},
+		{big, []byte("b")},
+	} {
+		wasNew, err := r.Set(kv[0], kv[1])
+		if err != nil || !wasNew {
+			t.Fatalf("expected no err, got: %v, %t", err, wasNew)
+		}
+
+		v, found := r.Get(kv[0])
+		if !found || !bytes.Equal(v, kv[1]) {
+			t.Fatalf("expected overflow get")
+		}
+	}
+
+	e, _ := r.Find([]byte("a"))
+	if _, vSize := e.ValOffsetSize(); vSize != SizeOverflow {
+		t.Fatalf("expected SizeOverflow, got: %d", vSize)
+	}
+
+	var freed []uint64
+
+	r.BytesFree = func(m *RHStore, offset, size uint64) error {
+		freed = append(freed, offset, size)
+		return nil
+	}
+
+	descOffset, _ := e.ValOffsetSize()
+	vOffset, _, _ := r.ResolveOverflow(descOffset)
+
+	// Shrinking an overflow val in-place keeps it correct, and frees
+	// the unused tail of the val's bytes.
+	_, err := r.SetMerge([]byte("a"), big[:MaxValLen+5], MergeLast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, found := r.Get([]byte("a"))
+	if !found || len(v) != MaxValLen+5 {
+		t.Fatalf("expected shrunk overflow val")
+	}
+
+	if !reflect.DeepEqual(freed, []uint64{vOffset + MaxValLen + 5, 5}) {
+		t.Fatalf("expected freed tail, got: %v", freed)
+	}
+
+	freed = nil
+
+	// Shrinking to a val that no longer needs an overflow descriptor
+	// also frees the descriptor.
+	_, err = r.SetMerge([]byte("a"), []byte("small"), MergeLast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, found = r.Get([]byte("a"))
+	if !found || string(v) != "small" {
+		t.Fatalf("expected small val, got: %d", len(v))
+	}
+
+	if !reflect.DeepEqual(freed, []uint64{
+		vOffset + 5, MaxValLen, descOffset, OverflowDescLen}) {
+		t.Fatalf("expected freed tail and descriptor, got: %v", freed)
+	}
+
+	prev, existed, err := r.Del(big)
+	if err != nil || !existed || string(prev) != "b" {
+		t.Fatalf("expected del of big key")
+	}
+}
+
+func TestDistanceOverflow(t *testing.T) {
+	size := MaxItemDistance + 10
+
+	r := NewRHStore(size)
+	r.MaxDistance = math.MaxInt32
+
+	// Every key has the same home position until the RHStore grows.
+	r.HashFunc = func(k Key) uint32 {
+		i, _ := strconv.Atoi(string(k))
+		return uint32(i * size)
+	}
+
+	for i := 0; i < MaxItemDistance+1; i++ {
+		_, err := r.Set([]byte(strconv.Itoa(i)), nil)
+		if err != nil {
+			t.Fatalf("i: %d, set err: %v", i, err)
+		}
+	}
+
+	if r.Size == size {
+		t.Fatalf("expected a forced grow on distance overflow")
+	}
+
+	if err := r.Validate(); err != nil {
+		t.Fatalf("validate err: %v", err)
+	}
+
+	// Corrupt a distance to check that Validate notices.
+	e := r.Item(1)
+	e.DistanceAdd(1)
+
+	if err := r.Validate(); err == nil {
+		t.Fatalf("expected validate err")
+	}
+}
+
+func TestDistanceOverflowSameHash(t *testing.T) {
+	r := NewRHStore(10)
+
+	// Growing does not help when every key has the same hash.
+	r.HashFunc = func(k Key) uint32 { return 0 }
+
+	var err error
+
+	var i, size int
+
+	for i = 0; i < 1000; i++ {
+		size = r.Size
+
+		_, err = r.Set([]byte(strconv.Itoa(i)), nil)
+		if err != nil {
+			break
+		}
+	}
+
+	if err != ErrDistanceOverflow {
+		t.Fatalf("expected ErrDistanceOverflow, got: %v", err)
+	}
+
+	if r.Count != i || r.Size != size<<maxGrowsPerSet {
+		t.Fatalf("expected bounded grows, got count: %d, size: %d",
+			r.Count, r.Size)
+	}
+
+	// A later Set is also refused after a bounded number of grows.
+	size = r.Size
+
+	_, err = r.Set([]byte(strconv.Itoa(i)), nil)
+	if err != ErrDistanceOverflow {
+		t.Fatalf("expected ErrDistanceOverflow, got: %v", err)
+	}
+
+	if r.Size != size<<maxGrowsPerSet {
+		t.Fatalf("expected bounded grows, got size: %d", r.Size)
+	}
+
+	if err = r.Validate(); err != nil {
+		t.Fatalf("validate err: %v", err)
+	}
+
+	for j := 0; j < i; j++ {
+		if _, found := r.Get([]byte(strconv.Itoa(j))); !found {
+			t.Fatalf("expected found, j: %d", j)
+		}
+	}
+}
+
+func TestRHStoreFileDistanceOverflow(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testRHStoreFile")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = MaxItemDistance * 2
+
+	sf, err := CreateRHStoreFile(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	for i := 0; i < MaxItemDistance+1; i++ {
+		_, err := sf.Set([]byte(fmt.Sprintf("%d", i)), nil)
+		if err != nil {
+			t.Fatalf("i: %d, set err: %v", i, err)
+		}
+	}
+
+	// Growing into a table with a degenerate hash func would need
+	// distances that overflow, so the grow errors and the existing
+	// items are left intact.
+	sf.HashFunc = func(k Key) uint32 { return 0 }
+
+	err = sf.Grow(sf.Size * 2)
+	if err != ErrDistanceOverflow {
+		t.Fatalf("expected ErrDistanceOverflow, got: %v", err)
+	}
+
+	if sf.Generation != 0 || sf.Count != MaxItemDistance+1 {
+		t.Fatalf("expected unchanged RHStoreFile after failed grow")
+	}
+
+	// The failed grow did not free any of the live key/val bytes.
+	if sf.Chunks.Stats().FreeBytes != 0 {
+		t.Fatalf("expected no freed bytes, got: %d",
+			sf.Chunks.Stats().FreeBytes)
+	}
+}
+
+func TestRHStoreFileMemoryBudget(t *testing.T) {
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 64
+	options.MemoryBudgetBytes = 1024 * 1024
+	testRHStoreFile(t, options)
+
+	options.MemoryBudgetBytes = 1000
+	testRHStoreFile(t, options)
+
+	dir, _ := ioutil.TempDir("", "testRHStoreFile")
+	defer os.RemoveAll(dir)
+
+	var spills int
+
+	options.OnSpill = func(sf *RHStoreFile) { spills++ }
+
+	sf, err := CreateRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	numFiles := func() int {
+		files, _ := ioutil.ReadDir(dir)
+		return len(files)
+	}
+
+	n := 0
+
+	for ; n < 14; n++ {
+		_, err = sf.Set([]byte(fmt.Sprintf("k%d", n)), []byte("val"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if spills != 0 || sf.Spilled || numFiles() != 0 {
+		t.Fatalf("expected no spills, got: %d, %t, %d",
+			spills, sf.Spilled, numFiles())
+	}
+
+	if sf.Generation == 0 || len(sf.Chunks.Chunks) < 2 {
+		t.Fatalf("expected in-memory growth, got generation: %d,"+
+			" chunks: %d", sf.Generation, len(sf.Chunks.Chunks))
+	}
+
+	for ; n < 1000; n++ {
+		_, err = sf.Set([]byte(fmt.Sprintf("k%d", n)), []byte("val"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if spills != 1 || !sf.Spilled || numFiles() == 0 {
+		t.Fatalf("expected 1 spill, got: %d, %t, %d",
+			spills, sf.Spilled, numFiles())
+	}
+
+	if sf.Slots.Path == "" {
+		t.Fatalf("expected spilled slots")
+	}
+
+	for i := 1; i < len(sf.Chunks.Chunks); i++ {
+		if sf.Chunks.Chunks[i].Path == "" {
+			t.Fatalf("expected spilled chunk: %d", i)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		v, found := sf.Get([]byte(fmt.Sprintf("k%d", i)))
+		if !found || string(v) != "val" {
+			t.Fatalf("i: %d, expected get after spill", i)
+		}
+	}
+
+	if err = sf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRHStoreFileMemoryBudgetSpillDuringUpdate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testRHStoreFile")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 256
+	options.MemoryBudgetBytes = 4096
+
+	sf, err := CreateRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	mergeAppend := func(existing, incoming Val, out []byte) []byte {
+		return append(append(out, existing...), incoming...)
+	}
+
+	// Each update allocates a bigger val while the item is held, so
+	// the chunk allocation that exceeds the budget happens during an
+	// update, which must not lose the update.
+	for i := 0; i < 250; i++ {
+		_, err = sf.SetMerge([]byte("k"), []byte("x"), mergeAppend)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, found := sf.Get([]byte("k"))
+		if !found || len(v) != i+1 {
+			t.Fatalf("i: %d, expected len: %d, got: %d, %t",
+				i, i+1, len(v), found)
+		}
+	}
+
+	if !sf.Spilled {
+		t.Fatalf("expected a spill")
+	}
+}
+
+func TestKeysOnly(t *testing.T) {
+	testKeysOnly(t, NewRHStoreKeysOnly(10))
+}
+
+func TestRHStoreFileKeysOnly(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testRHStoreFile")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 64
+	options.KeysOnly = true
+
+	sf, err := CreateRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	testKeysOnly(t, &sf.RHStore)
+
+	if len(sf.Slots.Buf) != sf.Size*8*KeysOnlyItemLen {
+		t.Fatalf("expected keys-only slots file size, got: %d",
+			len(sf.Slots.Buf))
+	}
+}
+
+func testKeysOnly(t *testing.T, r *RHStore) {
+	if r.SlotsPerItem() != KeysOnlyItemLen {
+		t.Fatalf("expected keys-only items")
+	}
+
+	for i := 0; i < 200; i++ {
+		wasNew, err := r.Set([]byte(fmt.Sprintf("k%d", i%100)), nil)
+		if err != nil || wasNew != (i < 100) {
+			t.Fatalf("i: %d, wasNew: %t, err: %v", i, wasNew, err)
+		}
+	}
+
+	if r.Count != 100 || len(r.Slots) != r.Size*KeysOnlyItemLen {
+		t.Fatalf("wrong count: %d, or slots: %d", r.Count, len(r.Slots))
+	}
+
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i += 2 {
+		_, existed, err := r.Del([]byte(fmt.Sprintf("k%d", i)))
+		if err != nil || !existed {
+			t.Fatalf("del i: %d, existed: %t, err: %v", i, existed, err)
+		}
+	}
+
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		v, found := r.Get([]byte(fmt.Sprintf("k%d", i)))
+		if found != (i%2 == 1) || len(v) != 0 {
+			t.Fatalf("get i: %d, found: %t, v: %v", i, found, v)
+		}
+	}
+
+	_, err := r.Set([]byte("k"), []byte("v"))
+	if err != ErrValTooBig {
+		t.Fatalf("expected ErrValTooBig, got: %v", err)
+	}
+}
+
+func TestGrowIncremental(t *testing.T) {
+	r := NewRHStore(2)
+	r.Grow = GrowIncremental
+	r.MigrateStep = 1
+
+	testGrowIncremental(t, r)
+}
+
+func TestGrowIncrementalGetDuringVisit(t *testing.T) {
+	r := NewRHStore(2)
+	r.Grow = GrowIncremental
+	r.MigrateStep = 1
+
+	n := 0
+	for ; n < 1000 && (n < 10 || r.Old == nil); n++ {
+		_, err := r.Set([]byte(fmt.Sprintf("k%d", n)), []byte("v"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if r.Old == nil {
+		t.Fatalf("expected an incremental migration")
+	}
+
+	// Lookups do not migrate items, so a visit sees each item once.
+	seen := map[string]bool{}
+
+	err := r.Visit(func(k Key, v Val) bool {
+		if seen[string(k)] {
+			t.Fatalf("visited twice, k: %s", k)
+		}
+		seen[string(k)] = true
+
+		if _, found := r.Get(k); !found {
+			t.Fatalf("expected get during visit, k: %s", k)
+		}
+
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != n || r.Old == nil {
+		t.Fatalf("expected %d visited and no migration, got: %d, %t",
+			n, len(seen), r.Old == nil)
+	}
+}
+
+func TestRHStoreFileIncrementalGrow(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testRHStoreFile")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 2
+	options.ChunkSizeBytes = 64
+	options.IncrementalGrow = true
+
+	sf, err := CreateRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	sf.MigrateStep = 1
+
+	testGrowIncremental(t, &sf.RHStore)
+
+	if sf.OldSlots != nil {
+		t.Fatalf("expected old slots to be removed")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		if f.Name() != filepath.Base(sf.Slots.Path) &&
+			strings.Contains(f.Name(), "_slots_") {
+			t.Fatalf("expected no old slots files, got: %s", f.Name())
+		}
+	}
+}
+
+func testGrowIncremental(t *testing.T, r *RHStore) {
+	sawOld := false
+
+	test(t, r, false, func(g map[string][]byte,
+		get func(k string),
+		set func(k, v string),
+		del func(k string)) {
+		for i := 0; i < 3000; i++ {
+			k := fmt.Sprintf("k%d", i%701)
+
+			switch i % 5 {
+			case 0, 1, 2:
+				set(k, k+"-"+strconv.Itoa(i))
+			case 3:
+				del(k)
+			default:
+				get(k)
+			}
+
+			if r.Old != nil {
+				sawOld = true
+			}
+
+			if i%100 == 0 {
+				if err := r.Validate(); err != nil {
+					t.Fatalf("i: %d, err: %v", i, err)
+				}
+			}
+		}
+
+		if !sawOld {
+			t.Fatalf("expected an incremental migration")
+		}
+
+		visited := 0
+		r.Visit(func(k Key, v Val) bool {
+			if string(g[string(k)]) != string(v) {
+				t.Fatalf("visit k: %s, v: %s, expected: %s", k, v, g[string(k)])
+			}
+			visited++
+			return true
+		})
+		if visited != len(g) {
+			t.Fatalf("visited: %d, expected: %d", visited, len(g))
+		}
+
+		if err := r.FinishMigration(); err != nil || r.Old != nil {
+			t.Fatalf("expected migration done, err: %v", err)
+		}
+
+		for k := range g {
+			get(k)
+		}
+
+		if err := r.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRHStoreFileFlush(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testRHStoreFileFlush")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 256
+
+	sf, err := CreateRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	for i := 0; i < 500; i++ {
+		_, err = sf.Set([]byte(fmt.Sprintf("k%d", i)),
+			[]byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sf.Slots.Path == "" {
+		t.Fatalf("expected slots file")
+	}
+
+	if err = sf.Flush(FlushAsync); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sf.Flush(FlushSync); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(sf.Slots.Path)
+	if err != nil || !bytes.Equal(b, sf.Slots.Buf) {
+		t.Fatalf("expected flushed slots file, err: %v", err)
+	}
+
+	for i, chunk := range sf.Chunks.Chunks[1:] {
+		b, err = ioutil.ReadFile(chunk.Path)
+		if err != nil || !bytes.Equal(b, chunk.Buf) || chunk.dirty {
+			t.Fatalf("i: %d, expected flushed chunk file, err: %v", i, err)
+		}
+	}
+}
@@ -49,3 +49,24 @@ func ByteSliceToUint64Slice(in []byte) ([]uint64, error) {
 
 	return out, nil
 }
+
+// slotsLittleEndian is true when the in-memory slots, including any
+// inlined val words, hold the same bytes as their little-endian
+// encoding, which depends on the byte order of the host.
+var slotsLittleEndian = func() bool {
+	w := uint64(1)
+	return (*[8]byte)(unsafe.Pointer(&w))[0] == 1
+}()
+
+// inlineValWord packs up to 8 bytes of v into a uint64, where
+// inlineValBytes() on an item provides the same bytes in return.
+func inlineValWord(v []byte) uint64 {
+	var w uint64
+	copy((*[8]byte)(unsafe.Pointer(&w))[:], v)
+	return w
+}
+
+// inlineValBytes gives access to the inlined val bytes of an item.
+func inlineValBytes(item Item) []byte {
+	return (*[8]byte)(unsafe.Pointer(&item[1]))[:]
+}
@@ -43,3 +43,21 @@ func ByteSliceToUint64Slice(in []byte) ([]uint64, error) {
 
 	return out, nil
 }
+
+// slotsLittleEndian is true, as the slots and inlined val words are
+// always converted with their little-endian encoding.
+var slotsLittleEndian = true
+
+// inlineValWord packs up to 8 bytes of v into a uint64.
+func inlineValWord(v []byte) uint64 {
+	var buf [8]byte
+	copy(buf[:], v)
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// inlineValBytes returns a copy of the inlined val bytes of an item.
+func inlineValBytes(item Item) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, item[1])
+	return buf
+}
@@ -0,0 +1,401 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// ErrSnapshotInvalid means a file is not a valid snapshot.
+var ErrSnapshotInvalid = errors.New("snapshot invalid")
+
+// SnapshotMagic identifies a snapshot file.
+var SnapshotMagic = [8]byte{'r', 'h', 's', 't', 'o', 'r', 'e', 1}
+
+// SnapshotHeaderLen is the length in bytes of a snapshot's header.
+const SnapshotHeaderLen = 64
+
+// Snapshot header flags.
+const (
+	SnapshotFlagInlineVals = 1 << iota
+	SnapshotFlagKeysOnly
+)
+
+// A snapshot is a single file that holds the live items of an RHStore,
+// with a layout that's independent of any ChunkSizeBytes...
+//
+//   [header: SnapshotHeaderLen bytes]
+//   [slots: Size * SlotsPerItem() little-endian uint64's]
+//   [data: the packed key/val bytes of the live items]
+//
+// The header holds little-endian uint64's of...
+//
+//   [magic][flags][size][count][slotsPerItem][dataOffset][dataLen][0]
+//
+// An inlined val word instead holds the val bytes as-is, which is the
+// same as its little-endian uint64 on a little-endian host. On a host
+// that's not little-endian, OpenSnapshot() decodes the slots into a
+// copy rather than using the mmap()'ed slots in place.
+//
+// The slots keep each item at its same position, so the items do not
+// need to be rehashed, but with key/val offsets that are rewritten to
+// be relative to the start of the data. Dead bytes from updates and
+// deletes are dropped.
+
+// WriteSnapshot writes the live items of the RHStore as a snapshot,
+// which can be loaded by OpenSnapshot(). Any in-progress incremental
+// grow is first completed. The snapshot uses the RHStore's HashFunc,
+// which an application with a non-default HashFunc must also use
+// after OpenSnapshot().
+func (m *RHStore) WriteSnapshot(w io.Writer) error {
+	err := m.FinishMigration()
+	if err != nil {
+		return err
+	}
+
+	spi := m.SlotsPerItem()
+
+	var flags uint64
+	if m.InlineVals {
+		flags |= SnapshotFlagInlineVals
+	}
+	if m.KeysOnly {
+		flags |= SnapshotFlagKeysOnly
+	}
+
+	// The first pass computes the data length, the second pass writes
+	// the slots with rewritten offsets, and the third pass writes the
+	// data in the same order.
+	var dataLen uint64
+
+	bw := bufio.NewWriter(w)
+
+	var buf [8]byte
+
+	writeUint64 := func(v uint64) error {
+		binary.LittleEndian.PutUint64(buf[:], v)
+		_, err := bw.Write(buf[:])
+		return err
+	}
+
+	for i := 0; i < m.Size; i++ {
+		e := m.Item(i)
+
+		if _, kSize := e.KeyOffsetSize(); kSize != 0 {
+			_, kSize, vSize, err := m.snapshotSizes(e)
+			if err != nil {
+				return err
+			}
+
+			dataLen += snapshotLen(kSize, MaxKeyLen)
+
+			if !m.InlineVals && !m.KeysOnly {
+				dataLen += snapshotLen(vSize, MaxValLen)
+			}
+		}
+	}
+
+	dataOffset := uint64(SnapshotHeaderLen + m.Size*spi*8)
+
+	_, err = bw.Write(SnapshotMagic[:])
+	if err != nil {
+		return err
+	}
+
+	for _, v := range []uint64{flags, uint64(m.Size), uint64(m.Count),
+		uint64(spi), dataOffset, dataLen, 0} {
+		if err = writeUint64(v); err != nil {
+			return err
+		}
+	}
+
+	item := make(Item, spi)
+
+	var offset uint64
+
+	for i := 0; i < m.Size; i++ {
+		e := m.Item(i)
+
+		for j := range item {
+			item[j] = 0
+		}
+
+		if _, kSize := e.KeyOffsetSize(); kSize != 0 {
+			inlineVal, kSize, vSize, err := m.snapshotSizes(e)
+			if err != nil {
+				return err
+			}
+
+			kOffset, kSizeEnc := snapshotOffsetSize(offset, kSize, MaxKeyLen)
+			offset += snapshotLen(kSize, MaxKeyLen)
+
+			vOffset, vSizeEnc := inlineVal, vSize
+			if m.InlineVals && !slotsLittleEndian {
+				// Written as little-endian, the val bytes stay as-is.
+				vOffset = bits.ReverseBytes64(inlineVal)
+			}
+			if !m.InlineVals && !m.KeysOnly {
+				vOffset, vSizeEnc = snapshotOffsetSize(offset, vSize, MaxValLen)
+				offset += snapshotLen(vSize, MaxValLen)
+			}
+
+			item.Encode(kOffset, kSizeEnc, vOffset, vSizeEnc, e.Distance())
+		}
+
+		for _, v := range item {
+			if err = writeUint64(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	offset = 0
+
+	for i := 0; i < m.Size; i++ {
+		e := m.Item(i)
+
+		if _, kSize := e.KeyOffsetSize(); kSize == 0 {
+			continue
+		}
+
+		k, err := m.ItemKey(e)
+		if err != nil {
+			return err
+		}
+
+		offset, err = writeSnapshotBytes(bw, offset, k, MaxKeyLen)
+		if err != nil {
+			return err
+		}
+
+		if !m.InlineVals && !m.KeysOnly {
+			v, err := m.ItemVal(e)
+			if err != nil {
+				return err
+			}
+
+			offset, err = writeSnapshotBytes(bw, offset, v, MaxValLen)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// snapshotSizes returns the inlined val word, if any, and the actual
+// key and val sizes of an item, resolving any overflow descriptors.
+func (m *RHStore) snapshotSizes(e Item) (
+	inlineVal, kSize, vSize uint64, err error) {
+	kOffset, kSize := e.KeyOffsetSize()
+	if kSize == SizeOverflow {
+		_, kSize, err = m.ResolveOverflow(kOffset)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	vOffset, vSize := e.ValOffsetSize()
+	if m.InlineVals || m.KeysOnly {
+		return vOffset, kSize, vSize, nil
+	}
+
+	if vSize == SizeOverflow {
+		_, vSize, err = m.ResolveOverflow(vOffset)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	return 0, kSize, vSize, nil
+}
+
+// snapshotLen returns the number of data bytes of a key or val, which
+// includes an overflow descriptor when the size is beyond maxLen.
+func snapshotLen(size, maxLen uint64) uint64 {
+	if size > maxLen {
+		return size + OverflowDescLen
+	}
+
+	return size
+}
+
+// snapshotOffsetSize returns the offset and size to encode into an
+// item for a key or val that's written at the offset in the data.
+func snapshotOffsetSize(offset, size, maxLen uint64) (uint64, uint64) {
+	if size > maxLen {
+		return offset + size, SizeOverflow // The overflow descriptor.
+	}
+
+	return offset, size
+}
+
+// writeSnapshotBytes writes a key or val at the offset in the data,
+// followed by an overflow descriptor when its size is beyond maxLen,
+// and returns the offset after the written bytes.
+func writeSnapshotBytes(w *bufio.Writer, offset uint64, b []byte,
+	maxLen uint64) (uint64, error) {
+	_, err := w.Write(b)
+	if err != nil {
+		return 0, err
+	}
+
+	size := uint64(len(b))
+	if size <= maxLen {
+		return offset + size, nil
+	}
+
+	var desc [OverflowDescLen]byte
+	binary.LittleEndian.PutUint64(desc[0:8], offset)
+	binary.LittleEndian.PutUint64(desc[8:16], size)
+
+	_, err = w.Write(desc[:])
+
+	return offset + size + OverflowDescLen, err
+}
+
+// ---------------------------------------------
+
+// OpenSnapshot loads a snapshot file that was written by
+// WriteSnapshot(), as a ReadOnly RHStore that's backed by a read-only
+// mmap() of the file. The RHStore's Close() unmaps the file.
+func OpenSnapshot(path string) (*RHStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fstats, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if fstats.Size() < SnapshotHeaderLen {
+		file.Close()
+		return nil, ErrSnapshotInvalid
+	}
+
+	ref, err := MMapFileRegion(path, file, 0, fstats.Size(), false)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	m, err := snapshotRHStore(ref.Buf)
+	if err != nil {
+		ref.Close()
+		return nil, err
+	}
+
+	m.Extra = ref
+
+	m.Close = ref.Close
+
+	return m, nil
+}
+
+// snapshotRHStore returns a ReadOnly RHStore over the snapshot bytes.
+func snapshotRHStore(buf []byte) (*RHStore, error) {
+	var magic [8]byte
+	copy(magic[:], buf)
+
+	if magic != SnapshotMagic {
+		return nil, ErrSnapshotInvalid
+	}
+
+	header := func(i int) uint64 {
+		return binary.LittleEndian.Uint64(buf[i*8:])
+	}
+
+	flags, size, count := header(1), int(header(2)), int(header(3))
+	spi, dataOffset, dataLen := int(header(4)), header(5), header(6)
+
+	m := NewRHStore(0)
+
+	if flags&SnapshotFlagKeysOnly != 0 {
+		m.SetKeysOnly(0)
+	}
+
+	m.InlineVals = flags&SnapshotFlagInlineVals != 0
+
+	if size <= 0 || spi != m.SlotsPerItem() ||
+		dataOffset != uint64(SnapshotHeaderLen+size*spi*8) ||
+		dataOffset+dataLen != uint64(len(buf)) {
+		return nil, ErrSnapshotInvalid
+	}
+
+	slots, err := snapshotSlots(buf[SnapshotHeaderLen:dataOffset],
+		m.InlineVals, spi)
+	if err != nil {
+		return nil, err
+	}
+
+	data := buf[dataOffset:]
+
+	m.Slots = slots
+	m.Size = size
+	m.Count = count
+	m.ReadOnly = true
+
+	m.BytesRead = func(m *RHStore, offset, size uint64) ([]byte, error) {
+		if offset+size > uint64(len(data)) {
+			return nil, ErrSnapshotInvalid
+		}
+
+		return data[offset : offset+size], nil
+	}
+
+	readOnly := func() error { return ErrReadOnly }
+
+	m.BytesTruncate = func(m *RHStore, n uint64) error { return readOnly() }
+
+	m.BytesAppend = func(m *RHStore, b []byte) (uint64, uint64, error) {
+		return 0, 0, readOnly()
+	}
+
+	m.BytesWrite = func(m *RHStore, offset uint64, b []byte) error {
+		return readOnly()
+	}
+
+	m.Grow = func(m *RHStore, newSize int) error { return readOnly() }
+
+	return m, nil
+}
+
+// snapshotSlots returns the slots of a snapshot, which are used in
+// place when the slots of the host are little-endian, and are otherwise
+// decoded into a copy, where the inlined val words hold val bytes.
+func snapshotSlots(buf []byte, inlineVals bool, spi int) ([]uint64, error) {
+	if slotsLittleEndian {
+		return ByteSliceToUint64Slice(buf)
+	}
+
+	slots := make([]uint64, len(buf)/8)
+	for i := range slots {
+		slots[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+
+	if inlineVals {
+		for i := 1; i < len(slots); i += spi {
+			slots[i] = bits.ReverseBytes64(slots[i])
+		}
+	}
+
+	return slots, nil
+}
@@ -0,0 +1,212 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	for _, variant := range []string{"", "inline", "keysOnly"} {
+		testSnapshot(t, variant)
+	}
+}
+
+func testSnapshot(t *testing.T, variant string) {
+	dir, _ := ioutil.TempDir("", "testSnapshot")
+	defer os.RemoveAll(dir)
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 256
+	options.InlineVals = variant == "inline"
+	options.KeysOnly = variant == "keysOnly"
+	options.IncrementalGrow = true
+
+	sf, err := CreateRHStoreFile(dir+"/test", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sf.Close()
+
+	g := map[string]string{}
+
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("k%d", i%500)
+
+		v := ""
+		if variant != "keysOnly" {
+			v = fmt.Sprintf("v%d", i)
+		}
+
+		if i%7 == 0 {
+			sf.Del([]byte(k))
+			delete(g, k)
+		} else {
+			_, err = sf.Set([]byte(k), []byte(v))
+			if err != nil {
+				t.Fatalf("variant: %s, i: %d, err: %v", variant, i, err)
+			}
+			g[k] = v
+		}
+	}
+
+	f, err := os.Create(dir + "/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sf.WriteSnapshot(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("variant: %s, err: %v", variant, err)
+	}
+
+	m, err := OpenSnapshot(dir + "/snapshot")
+	if err != nil {
+		t.Fatalf("variant: %s, err: %v", variant, err)
+	}
+
+	defer m.Close()
+
+	if m.Count != len(g) || m.Size != sf.Size {
+		t.Fatalf("variant: %s, count: %d, size: %d, expected: %d, %d",
+			variant, m.Count, m.Size, len(g), sf.Size)
+	}
+
+	if err = m.Validate(); err != nil {
+		t.Fatalf("variant: %s, err: %v", variant, err)
+	}
+
+	for k, v := range g {
+		got, found := m.Get([]byte(k))
+		if !found || string(got) != v {
+			t.Fatalf("variant: %s, k: %s, got: %s, %t, expected: %s",
+				variant, k, got, found, v)
+		}
+	}
+
+	if _, found := m.Get([]byte("not-there")); found {
+		t.Fatalf("variant: %s, expected not found", variant)
+	}
+
+	// Dead bytes of updates and deletes are dropped.
+	fstats, _ := os.Stat(dir + "/snapshot")
+	if fstats.Size() >= int64(SnapshotHeaderLen+m.Size*m.SlotsPerItem()*8+
+		sf.Chunks.PrevChunkLens()+sf.Chunks.LastChunkLen) {
+		t.Fatalf("variant: %s, expected compact snapshot", variant)
+	}
+
+	if _, err = m.Set([]byte("k0"), nil); err != ErrReadOnly {
+		t.Fatalf("variant: %s, expected ErrReadOnly, got: %v", variant, err)
+	}
+
+	if _, _, err = m.Del([]byte("k1")); err != ErrReadOnly {
+		t.Fatalf("variant: %s, expected ErrReadOnly, got: %v", variant, err)
+	}
+}
+
+func TestOpenSnapshotInvalid(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testSnapshot")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(dir+"/bad", make([]byte, 100), 0600)
+
+	_, err := OpenSnapshot(dir + "/bad")
+	if err != ErrSnapshotInvalid {
+		t.Fatalf("expected ErrSnapshotInvalid, got: %v", err)
+	}
+
+	_, err = OpenSnapshot(dir + "/not-there")
+	if err == nil {
+		t.Fatalf("expected err on missing file")
+	}
+}
+
+func TestSnapshotByteOrder(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testSnapshot")
+	defer os.RemoveAll(dir)
+
+	for _, inlineVals := range []bool{false, true} {
+		m := NewRHStore(10)
+		m.InlineVals = inlineVals
+
+		if _, err := m.Set([]byte("key"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+
+		path := fmt.Sprintf("%s/snapshot_%t", dir, inlineVals)
+
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = m.WriteSnapshot(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		idx, err := m.FindIdx([]byte("key"))
+		if err != nil || idx < 0 {
+			t.Fatalf("expected key, err: %v", err)
+		}
+
+		// The slots are little-endian, whatever the host's byte order,
+		// and an inlined val word holds the val bytes as-is.
+		slot := b[SnapshotHeaderLen+idx*m.SlotsPerItem()*8:]
+
+		kOffset, kSize := Item{binary.LittleEndian.Uint64(slot[0:]),
+			0, binary.LittleEndian.Uint64(slot[16:])}.KeyOffsetSize()
+		if kOffset != 0 || kSize != 3 {
+			t.Fatalf("expected little-endian slots, got: %d, %d",
+				kOffset, kSize)
+		}
+
+		if inlineVals && !bytes.Equal(slot[8:16], []byte("val\x00\x00\x00\x00\x00")) {
+			t.Fatalf("expected inlined val bytes, got: %q", slot[8:16])
+		}
+
+		// The slots are also decoded into a copy, as on a host that's
+		// not little-endian, which is exact for the non-inlined vals.
+		if !inlineVals {
+			slotsLittleEndian = false
+
+			s, err := OpenSnapshot(path)
+
+			slotsLittleEndian = true
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v, found := s.Get([]byte("key"))
+			if !found || string(v) != "val" {
+				t.Fatalf("expected decoded slots, got: %q, %t", v, found)
+			}
+
+			s.Close()
+		}
+	}
+}
@@ -0,0 +1,200 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrLocked means a lock file is held by another owner.
+var ErrLocked = errors.New("locked")
+
+// SpillDirOwnerPrefix is the name prefix of each owner's subdirectory
+// in a SpillDir.
+const SpillDirOwnerPrefix = "owner-"
+
+// SpillDirLockName is the name of the lock file in each owner's
+// subdirectory.
+const SpillDirLockName = "LOCK"
+
+// SpillDir manages a directory for the spill files of RHStoreFile's,
+// Chunks and Heap's. Each SpillDir owner, usually one per process,
+// has its own subdirectory holding a lock file, and hands out unique
+// path prefixes within that subdirectory. As the lock file of a dead
+// process is no longer locked, the spill files that a crashed process
+// left behind are swept away when a SpillDir is next opened.
+type SpillDir struct {
+	// Dir is the shared, parent directory of the owners.
+	Dir string
+
+	// OwnerDir is the subdirectory that's owned by this SpillDir.
+	OwnerDir string
+
+	// FileSuffix is the file suffix of the spill files, which are the
+	// files that are removed when sweeping, like ".rhstore".
+	FileSuffix string
+
+	// Lock is the locked lock file of the OwnerDir.
+	Lock *os.File
+
+	// NextID is used to generate unique path prefixes.
+	NextID uint64
+}
+
+// OpenSpillDir sweeps the dir of any orphaned spill files with the
+// given file suffix, and then returns a ready-to-use SpillDir that
+// owns a new, locked subdirectory of the dir.
+func OpenSpillDir(dir, fileSuffix string) (*SpillDir, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = SweepSpillDir(dir, fileSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerDir, err := ioutil.TempDir(dir,
+		fmt.Sprintf("%s%d-", SpillDirOwnerPrefix, os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+
+	// The lock file is created and locked under a temporary name, and
+	// only then renamed into place, so that a concurrent sweep never
+	// sees an unlocked lock file of a starting owner.
+	lockTmpPath := filepath.Join(ownerDir, SpillDirLockName+".tmp")
+
+	lock, err := createLockFile(lockTmpPath)
+	if err != nil {
+		os.RemoveAll(ownerDir)
+		return nil, err
+	}
+
+	err = LockFile(lock)
+	if err == nil {
+		err = os.Rename(lockTmpPath, filepath.Join(ownerDir, SpillDirLockName))
+	}
+	if err != nil {
+		lock.Close()
+		os.RemoveAll(ownerDir)
+		return nil, err
+	}
+
+	return &SpillDir{
+		Dir:        dir,
+		OwnerDir:   ownerDir,
+		FileSuffix: fileSuffix,
+		Lock:       lock,
+	}, nil
+}
+
+// PathPrefix returns a unique path prefix in the OwnerDir, which can
+// be used for an RHStoreFile, Chunks, Heap, etc. The name is optional
+// and is only meant to help with debugging. PathPrefix is concurrent
+// safe.
+func (sd *SpillDir) PathPrefix(name string) string {
+	id := atomic.AddUint64(&sd.NextID, 1)
+
+	return filepath.Join(sd.OwnerDir, fmt.Sprintf("%s%09d", name, id))
+}
+
+// Close removes the OwnerDir, along with any remaining spill files,
+// and releases the lock. The users of the handed out path prefixes
+// are expected to have been closed already.
+func (sd *SpillDir) Close() error {
+	if sd.Lock == nil {
+		return nil
+	}
+
+	removeSpillFiles(sd.OwnerDir, sd.FileSuffix)
+
+	UnlockFile(sd.Lock)
+	sd.Lock.Close()
+	sd.Lock = nil
+
+	os.Remove(filepath.Join(sd.OwnerDir, SpillDirLockName))
+
+	return os.Remove(sd.OwnerDir)
+}
+
+// SweepSpillDir removes the spill files with the given file suffix
+// from the owner subdirectories of a dir whose lock files are no
+// longer locked, meaning that their owners have died. An owner
+// subdirectory that has no lock file might still be starting up, and
+// is left alone. The number of removed files is returned.
+func SweepSpillDir(dir, fileSuffix string) (removed int, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() ||
+			!strings.HasPrefix(entry.Name(), SpillDirOwnerPrefix) {
+			continue
+		}
+
+		ownerDir := filepath.Join(dir, entry.Name())
+
+		lockPath := filepath.Join(ownerDir, SpillDirLockName)
+
+		lock, err := os.OpenFile(lockPath, os.O_RDWR, 0600)
+		if err != nil {
+			continue // Missing lock file, or not ours to sweep.
+		}
+
+		if LockFile(lock) != nil {
+			lock.Close()
+			continue // The owner is alive.
+		}
+
+		removed += removeSpillFiles(ownerDir, fileSuffix)
+
+		UnlockFile(lock)
+		lock.Close()
+
+		os.Remove(lockPath)
+
+		// Only succeeds when the owner dir is now empty, so that
+		// files that aren't spill files are never removed.
+		os.Remove(ownerDir)
+	}
+
+	return removed, nil
+}
+
+// removeSpillFiles removes the files in a dir that have the given
+// file suffix, returning the number of removed files.
+func removeSpillFiles(dir, fileSuffix string) (removed int) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), fileSuffix) {
+			if os.Remove(filepath.Join(dir, entry.Name())) == nil {
+				removed++
+			}
+		}
+	}
+
+	return removed
+}
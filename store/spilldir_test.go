@@ -0,0 +1,130 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//  http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpillDir(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testSpillDir")
+	defer os.RemoveAll(dir)
+
+	suffix := DefaultRHStoreFileOptions.FileSuffix
+
+	// Simulate the leftovers of a crashed process, whose lock file is
+	// no longer locked.
+	deadDir := filepath.Join(dir, SpillDirOwnerPrefix+"dead")
+	os.Mkdir(deadDir, 0700)
+	ioutil.WriteFile(filepath.Join(deadDir, SpillDirLockName), nil, 0600)
+	ioutil.WriteFile(filepath.Join(deadDir, "x_slots_000000001"+suffix), nil, 0600)
+	ioutil.WriteFile(filepath.Join(deadDir, "x_chunk_000000001"+suffix), nil, 0600)
+
+	// A starting owner that has no lock file yet is left alone.
+	startingDir := filepath.Join(dir, SpillDirOwnerPrefix+"starting")
+	os.Mkdir(startingDir, 0700)
+	ioutil.WriteFile(filepath.Join(startingDir, "y"+suffix), nil, 0600)
+
+	sd, err := OpenSpillDir(dir, suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(deadDir); !os.IsNotExist(err) {
+		t.Fatalf("expected dead owner dir to be swept, err: %v", err)
+	}
+
+	if _, err = os.Stat(startingDir); err != nil {
+		t.Fatalf("expected starting owner dir to remain, err: %v", err)
+	}
+
+	// The lock file was renamed into place only once it was locked.
+	files, _ := ioutil.ReadDir(sd.OwnerDir)
+	if len(files) != 1 || files[0].Name() != SpillDirLockName {
+		t.Fatalf("expected only the lock file in the owner dir")
+	}
+
+	lock, err := os.OpenFile(filepath.Join(sd.OwnerDir, SpillDirLockName),
+		os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if LockFile(lock) != ErrLocked {
+		t.Fatalf("expected a locked lock file")
+	}
+
+	lock.Close()
+
+	p0, p1 := sd.PathPrefix("sf"), sd.PathPrefix("sf")
+	if p0 == p1 || filepath.Dir(p0) != sd.OwnerDir {
+		t.Fatalf("expected unique prefixes in owner dir, got: %s, %s", p0, p1)
+	}
+
+	options := DefaultRHStoreFileOptions
+	options.StartSize = 10
+	options.ChunkSizeBytes = 64
+
+	sf, err := CreateRHStoreFile(p0, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		sf.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+	}
+
+	// Simulate a crash of the owner, by leaving its files around.
+	sf.Slots.Close()
+	sf.Chunks.Close()
+
+	// The owner is alive, so its files are not swept.
+	removed, err := SweepSpillDir(dir, suffix)
+	if err != nil || removed != 0 {
+		t.Fatalf("expected no sweep of a live owner, got: %d, %v",
+			removed, err)
+	}
+
+	// Once unlocked, as if the owner process died, the files are swept.
+	UnlockFile(sd.Lock)
+
+	removed, err = SweepSpillDir(dir, suffix)
+	if err != nil || removed == 0 {
+		t.Fatalf("expected sweep of a dead owner, got: %d, %v", removed, err)
+	}
+
+	if _, err = os.Stat(sd.OwnerDir); !os.IsNotExist(err) {
+		t.Fatalf("expected owner dir to be swept, err: %v", err)
+	}
+
+	sd.Lock.Close()
+
+	// A normal Close() removes the owner dir.
+	sd, err = OpenSpillDir(dir, suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(sd.PathPrefix("z")+suffix, nil, 0600)
+
+	if err = sd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(sd.OwnerDir); !os.IsNotExist(err) {
+		t.Fatalf("expected owner dir to be removed, err: %v", err)
+	}
+}